@@ -0,0 +1,77 @@
+//Package ads holds the typed model of the ad server response and writes it
+//out as VMAP and VAST documents for standard video players.
+package ads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidAds = errors.New("invalid ad server response")
+
+//Ad metadata for a stream as returned from ADS_URL
+type Response struct {
+	BreakOffsets []BreakOffset `json:"breakOffsets"`
+	Breaks       []Break       `json:"breaks"`
+}
+
+//Where a break starts in the content, by its index in Breaks
+type BreakOffset struct {
+	Index      int     `json:"index"`
+	TimeOffset float64 `json:"timeOffset"`
+}
+
+//An ad break played at TimeOffset seconds into the content. Position is
+//one of preroll, midroll or postroll.
+type Break struct {
+	Ads        []Ad    `json:"ads"`
+	BreakID    string  `json:"breakId"`
+	Duration   float64 `json:"duration"`
+	Events     Events  `json:"events"`
+	Position   string  `json:"position"`
+	TimeOffset float64 `json:"timeOffset"`
+	Type       string  `json:"type"`
+}
+
+//A single ad creative within a break
+type Ad struct {
+	Creative string  `json:"creative"`
+	Duration float64 `json:"duration"`
+	Events   Events  `json:"events"`
+	//Size the creative is encoded at, when the ad server knows it
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+//Tracking urls fired as an ad or break plays
+type Events struct {
+	Impressions []string `json:"impressions"`
+}
+
+//Parses an ad server response
+func Parse(data []byte) (Response, error) {
+	var res Response
+	if err := json.Unmarshal(data, &res); err != nil {
+		return res, fmt.Errorf("%s: %s", ErrInvalidAds, err.Error())
+	}
+	return res, nil
+}
+
+//Finds a break by its id
+func (r Response) Break(id string) (Break, bool) {
+	for _, b := range r.Breaks {
+		if b.BreakID == id {
+			return b, true
+		}
+	}
+	return Break{}, false
+}
+
+//Formats seconds as HH:MM:SS.mmm, the time format VMAP and VAST share
+func formatOffset(seconds float64) string {
+	d := time.Duration(seconds*float64(time.Second) + 0.5*float64(time.Millisecond))
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
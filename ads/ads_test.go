@@ -0,0 +1,120 @@
+package ads
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func readResponse(t *testing.T) Response {
+	data, err := ioutil.ReadFile("testdata/response.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestParse(t *testing.T) {
+	res := readResponse(t)
+	if len(res.Breaks) != 3 || len(res.BreakOffsets) != 3 {
+		t.Fatalf("got %d breaks and %d offsets instead of 3", len(res.Breaks), len(res.BreakOffsets))
+	}
+
+	b, ok := res.Break("mid1")
+	if !ok {
+		t.Fatal("mid1 was not found")
+	}
+	if b.Position != "midroll" || b.TimeOffset != 1212.0304583333 || len(b.Ads) != 3 {
+		t.Fatalf("mid1 was parsed as %+v", b)
+	}
+	if ad := b.Ads[2]; ad.Creative != "abcd1239" || ad.Duration != 30 || len(ad.Events.Impressions) != 1 {
+		t.Fatalf("abcd1239 was parsed as %+v", ad)
+	}
+
+	if _, err := Parse([]byte(`{"breaks": "nope"}`)); err == nil {
+		t.Fatal("expected an error for a malformed response")
+	}
+}
+
+func TestVMAP(t *testing.T) {
+	res := readResponse(t)
+	out := string(VMAP(res.Breaks, func(b Break) string {
+		return "https://api.example.com/ads/" + b.BreakID + "/vast.xml"
+	}))
+
+	want := []string{
+		`<vmap:VMAP xmlns:vmap="http://www.iab.net/videosuite/vmap" version="1.0">`,
+		`<vmap:AdBreak timeOffset="start" breakType="linear" breakId="0.0.0.125406899">`,
+		`<vmap:AdTagURI templateType="vast4"><![CDATA[https://api.example.com/ads/0.0.0.125406899/vast.xml]]></vmap:AdTagURI>`,
+		`<vmap:Tracking event="breakStart"><![CDATA[http://some-ad-server.com/ad/l/1]]></vmap:Tracking>`,
+		`<vmap:AdBreak timeOffset="00:09:13.070" breakType="linear" breakId="mid0">`,
+		`<vmap:AdBreak timeOffset="00:20:12.030" breakType="linear" breakId="mid1">`,
+	}
+	last := 0
+	for _, line := range want {
+		i := strings.Index(out[last:], line)
+		if i < 0 {
+			t.Fatalf("%s is missing or out of order in\n%s", line, out)
+		}
+		last += i + len(line)
+	}
+}
+
+func TestVMAP_PostRoll(t *testing.T) {
+	out := string(VMAP([]Break{{BreakID: "post", Position: "postroll", TimeOffset: 600}}, func(b Break) string { return "" }))
+	if !strings.Contains(out, `timeOffset="end"`) {
+		t.Fatal(out)
+	}
+}
+
+func TestVAST(t *testing.T) {
+	b := Break{BreakID: "mid0", Ads: []Ad{
+		{Creative: "abcd1234", Duration: 30.5, Events: Events{Impressions: []string{"http://some-ad-server.com/ad/l/1"}}},
+	}}
+	out := string(VAST(b, func(ad Ad) string { return "https://ads.example.com/" + ad.Creative + ".ts" }))
+
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<VAST version="4.0" xmlns="http://www.iab.com/VAST">
+  <Ad id="abcd1234" sequence="1">
+    <InLine>
+      <AdSystem>DiscoveryStreams</AdSystem>
+      <AdTitle>abcd1234</AdTitle>
+      <Impression id="abcd1234"><![CDATA[http://some-ad-server.com/ad/l/1]]></Impression>
+      <Creatives>
+        <Creative id="abcd1234" sequence="1" adId="abcd1234">
+          <UniversalAdId idRegistry="unknown" idValue="abcd1234">abcd1234</UniversalAdId>
+          <Linear>
+            <Duration>00:00:30.500</Duration>
+            <MediaFiles>
+              <MediaFile delivery="progressive" type="video/mp2t" width="1920" height="1080"><![CDATA[https://ads.example.com/abcd1234.ts]]></MediaFile>
+            </MediaFiles>
+          </Linear>
+        </Creative>
+      </Creatives>
+    </InLine>
+  </Ad>
+</VAST>
+`
+	if out != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestVAST_MediaFileSize(t *testing.T) {
+	b := Break{BreakID: "mid0", Ads: []Ad{{Creative: "abcd1234", Duration: 15, Width: 1280, Height: 720}}}
+	out := string(VAST(b, func(ad Ad) string { return "https://ads.example.com/" + ad.Creative + ".mp4" }))
+	if !strings.Contains(out, `<MediaFile delivery="progressive" type="video/mp4" width="1280" height="720">`) {
+		t.Fatal(out)
+	}
+}
+
+func TestVAST_EmptyBreak(t *testing.T) {
+	out := string(VAST(Break{BreakID: "0.0.0.125406899"}, func(ad Ad) string { return "" }))
+	if strings.Contains(out, "<Ad ") || !strings.Contains(out, `<VAST version="4.0"`) {
+		t.Fatal(out)
+	}
+}
@@ -0,0 +1,88 @@
+package ads
+
+import (
+	"sync"
+	"time"
+)
+
+//States of a circuit breaker
+const (
+	closed = iota
+	open
+	halfOpen
+)
+
+//Circuit breaker that stops calls to the ad server after threshold failures
+//in a row. Once cooldown has passed a single call is let through to probe
+//it, closing the breaker on success and opening it again on failure.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+//Returns true if a call may be made
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case open:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = halfOpen
+		b.probing = true
+		return true
+	case halfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = closed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == halfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.state = open
+		b.openedAt = b.now()
+	}
+}
+
+//Lets a half open breaker probe again when a call ends without telling
+//anything about the ad server, such as when the caller gave up
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+//Returns true while calls are being refused
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == open && b.now().Sub(b.openedAt) < b.cooldown
+}
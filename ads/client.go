@@ -0,0 +1,167 @@
+package ads
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("ad server circuit breaker is open")
+
+//Settings for a Client. Zero values fall back to the defaults in NewClient.
+type Options struct {
+	//Timeout of each attempt
+	Timeout time.Duration
+	//Attempts made after the first one fails
+	Retries int
+	//Base delay between attempts, doubled after each one and jittered
+	Backoff time.Duration
+	//Failed calls in a row that open the circuit breaker
+	FailureThreshold int
+	//How long the circuit breaker stays open before probing again
+	Cooldown time.Duration
+}
+
+//Client for the ad server at ADS_URL. It is safe for concurrent use and
+//should be shared so connections are reused.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	opts    Options
+	breaker *breaker
+}
+
+//Error for an ad server response that retrying won't fix
+type statusError struct {
+	url    string
+	status int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("Returned %d from %s", e.status, e.url)
+}
+
+func (e statusError) retryable() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests
+}
+
+func NewClient(baseURL string, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 30 * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	return &Client{
+		baseURL: baseURL,
+		http:    &http.Client{Transport: transport},
+		opts:    opts,
+		breaker: newBreaker(opts.FailureThreshold, opts.Cooldown),
+	}
+}
+
+//Fetches the ad server response for a stream, retrying network errors and
+//5xx responses. ErrCircuitOpen is returned without calling the ad server
+//while the breaker is open.
+func (c *Client) Fetch(ctx context.Context, streamID string) (json.RawMessage, error) {
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.opts.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.backoff(attempt)):
+			case <-ctx.Done():
+				c.breaker.release()
+				return nil, ctx.Err()
+			}
+		}
+
+		var ads json.RawMessage
+		ads, err = c.fetchOnce(ctx, c.baseURL+streamID)
+		if err == nil {
+			c.breaker.success()
+			return ads, nil
+		}
+		if ctx.Err() != nil {
+			c.breaker.release()
+			return nil, err
+		}
+		if e, ok := err.(statusError); ok && !e.retryable() {
+			//the ad server answered so it isn't down
+			c.breaker.success()
+			return nil, err
+		}
+	}
+
+	c.breaker.failure()
+	return nil, err
+}
+
+func (c *Client) fetchOnce(ctx context.Context, url string) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return nil, statusError{url: url, status: res.StatusCode}
+	}
+
+	var ads json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&ads); err != nil {
+		return nil, err
+	}
+	return ads, nil
+}
+
+//Exponential backoff with equal jitter, so between half and all of
+//Backoff * 2^(attempt-1)
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.Backoff << uint(attempt-1)
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+//Returns true while the circuit breaker is refusing calls
+func (c *Client) CircuitOpen() bool {
+	return c.breaker.isOpen()
+}
@@ -0,0 +1,109 @@
+package ads
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"breaks": []}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", Options{Retries: 2, Backoff: time.Millisecond})
+	ads, err := client.Fetch(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ads) != `{"breaks": []}` || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("got %s after %d calls", ads, calls)
+	}
+}
+
+func TestClient_DoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", Options{Retries: 2, Backoff: time.Millisecond, FailureThreshold: 1})
+	if _, err := client.Fetch(context.Background(), "abc"); err == nil {
+		t.Fatal("expected an error for a 404")
+	}
+	if atomic.LoadInt32(&calls) != 1 || client.CircuitOpen() {
+		t.Fatalf("made %d calls and left the breaker open %t", calls, client.CircuitOpen())
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	var calls int32
+	healthy := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL+"/", Options{Retries: 0, FailureThreshold: 2, Cooldown: 50 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if _, err := client.Fetch(context.Background(), "abc"); err == nil {
+			t.Fatal("expected an error from a failing ad server")
+		}
+	}
+
+	if _, err := client.Fetch(context.Background(), "abc"); err != ErrCircuitOpen {
+		t.Fatalf("expected ErrCircuitOpen instead of %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("the ad server was called %d times while the breaker was open", calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	if _, err := client.Fetch(context.Background(), "abc"); err != nil {
+		t.Fatalf("the probe after the cooldown failed with %v", err)
+	}
+	if client.CircuitOpen() {
+		t.Fatal("the breaker stayed open after a successful probe")
+	}
+}
+
+func TestBreaker_HalfOpenAllowsOneProbe(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(1, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("an open breaker allowed a call")
+	}
+
+	now = now.Add(2 * time.Second)
+	if !b.allow() {
+		t.Fatal("the breaker didn't allow a probe after the cooldown")
+	}
+	if b.allow() {
+		t.Fatal("the breaker allowed a second call while probing")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("a failed probe didn't open the breaker again")
+	}
+}
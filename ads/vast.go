@@ -0,0 +1,129 @@
+package ads
+
+import (
+	"encoding/xml"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//Name written as the AdSystem of every VAST ad
+const adSystem = "DiscoveryStreams"
+
+type vastDoc struct {
+	XMLName   xml.Name `xml:"VAST"`
+	Version   string   `xml:"version,attr"`
+	Namespace string   `xml:"xmlns,attr"`
+	Ads       []vastAd `xml:"Ad"`
+}
+
+type vastAd struct {
+	ID       string     `xml:"id,attr"`
+	Sequence int        `xml:"sequence,attr"`
+	InLine   vastInLine `xml:"InLine"`
+}
+
+type vastInLine struct {
+	AdSystem    string         `xml:"AdSystem"`
+	AdTitle     string         `xml:"AdTitle"`
+	Impressions []vastURI      `xml:"Impression"`
+	Creatives   []vastCreative `xml:"Creatives>Creative"`
+}
+
+type vastURI struct {
+	ID  string `xml:"id,attr"`
+	URI string `xml:",cdata"`
+}
+
+type vastCreative struct {
+	ID            string            `xml:"id,attr"`
+	Sequence      int               `xml:"sequence,attr"`
+	AdID          string            `xml:"adId,attr"`
+	UniversalAdID vastUniversalAdID `xml:"UniversalAdId"`
+	Linear        vastLinear        `xml:"Linear"`
+}
+
+type vastUniversalAdID struct {
+	Registry string `xml:"idRegistry,attr"`
+	Value    string `xml:"idValue,attr"`
+	ID       string `xml:",chardata"`
+}
+
+type vastLinear struct {
+	Duration   string          `xml:"Duration"`
+	MediaFiles []vastMediaFile `xml:"MediaFiles>MediaFile"`
+}
+
+type vastMediaFile struct {
+	Delivery string `xml:"delivery,attr"`
+	Type     string `xml:"type,attr"`
+	Width    int    `xml:"width,attr"`
+	Height   int    `xml:"height,attr"`
+	URI      string `xml:",cdata"`
+}
+
+//Size media files are listed with when the ad server doesn't give one
+const (
+	defaultMediaWidth  = 1920
+	defaultMediaHeight = 1080
+)
+
+//Registry creative ids are listed under as UniversalAdId, since the ad
+//server's ids aren't registered anywhere
+const universalAdIDRegistry = "unknown"
+
+//Writes a break as a VAST 4.0 ad pod with one linear ad per creative. A
+//break without ads is written as an empty VAST document, which players
+//treat as no fill. mediaURL gives the url a creative is played from.
+func VAST(b Break, mediaURL func(ad Ad) string) []byte {
+	doc := vastDoc{Version: "4.0", Namespace: "http://www.iab.com/VAST"}
+	for i, ad := range b.Ads {
+		uri := mediaURL(ad)
+		delivery, mediaType := mediaFileType(uri)
+
+		inline := vastInLine{AdSystem: adSystem, AdTitle: ad.Creative}
+		for j, impression := range ad.Events.Impressions {
+			inline.Impressions = append(inline.Impressions, vastURI{ID: impressionID(ad, j), URI: impression})
+		}
+		width, height := ad.Width, ad.Height
+		if width <= 0 || height <= 0 {
+			width, height = defaultMediaWidth, defaultMediaHeight
+		}
+		inline.Creatives = []vastCreative{{
+			ID:            ad.Creative,
+			Sequence:      1,
+			AdID:          ad.Creative,
+			UniversalAdID: vastUniversalAdID{Registry: universalAdIDRegistry, Value: ad.Creative, ID: ad.Creative},
+			Linear: vastLinear{
+				Duration:   formatOffset(ad.Duration),
+				MediaFiles: []vastMediaFile{{Delivery: delivery, Type: mediaType, Width: width, Height: height, URI: uri}},
+			},
+		}}
+
+		doc.Ads = append(doc.Ads, vastAd{ID: ad.Creative, Sequence: i + 1, InLine: inline})
+	}
+	return marshalXML(doc)
+}
+
+func impressionID(ad Ad, i int) string {
+	if len(ad.Events.Impressions) == 1 {
+		return ad.Creative
+	}
+	return ad.Creative + "-" + strconv.Itoa(i+1)
+}
+
+//Guesses a media file's delivery and mime type from its extension
+func mediaFileType(uri string) (string, string) {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	switch strings.ToLower(path.Ext(uri)) {
+	case ".m3u8":
+		return "streaming", "application/x-mpegURL"
+	case ".ts":
+		return "progressive", "video/mp2t"
+	case ".webm":
+		return "progressive", "video/webm"
+	}
+	return "progressive", "video/mp4"
+}
@@ -0,0 +1,81 @@
+package ads
+
+import (
+	"encoding/xml"
+)
+
+type vmapDoc struct {
+	XMLName   xml.Name    `xml:"vmap:VMAP"`
+	Namespace string      `xml:"xmlns:vmap,attr"`
+	Version   string      `xml:"version,attr"`
+	Breaks    []vmapBreak `xml:"vmap:AdBreak"`
+}
+
+type vmapBreak struct {
+	TimeOffset string         `xml:"timeOffset,attr"`
+	BreakType  string         `xml:"breakType,attr"`
+	BreakID    string         `xml:"breakId,attr"`
+	AdSource   vmapAdSource   `xml:"vmap:AdSource"`
+	Tracking   []vmapTracking `xml:"vmap:TrackingEvents>vmap:Tracking,omitempty"`
+}
+
+type vmapAdSource struct {
+	ID               string     `xml:"id,attr"`
+	AllowMultipleAds bool       `xml:"allowMultipleAds,attr"`
+	FollowRedirects  bool       `xml:"followRedirects,attr"`
+	AdTagURI         vmapTagURI `xml:"vmap:AdTagURI"`
+}
+
+type vmapTagURI struct {
+	TemplateType string `xml:"templateType,attr"`
+	URI          string `xml:",cdata"`
+}
+
+type vmapTracking struct {
+	Event string `xml:"event,attr"`
+	URI   string `xml:",cdata"`
+}
+
+//Writes breaks as a VMAP 1.0 playlist. Each break points at its VAST
+//document through vastURL and fires the break's impressions on breakStart.
+func VMAP(breaks []Break, vastURL func(b Break) string) []byte {
+	doc := vmapDoc{Namespace: "http://www.iab.net/videosuite/vmap", Version: "1.0"}
+	for _, b := range breaks {
+		vb := vmapBreak{
+			TimeOffset: vmapOffset(b),
+			BreakType:  "linear",
+			BreakID:    b.BreakID,
+			AdSource: vmapAdSource{
+				ID:               b.BreakID,
+				AllowMultipleAds: true,
+				FollowRedirects:  true,
+				AdTagURI:         vmapTagURI{TemplateType: "vast4", URI: vastURL(b)},
+			},
+		}
+		if b.Type != "" {
+			vb.BreakType = b.Type
+		}
+		for _, uri := range b.Events.Impressions {
+			vb.Tracking = append(vb.Tracking, vmapTracking{Event: "breakStart", URI: uri})
+		}
+		doc.Breaks = append(doc.Breaks, vb)
+	}
+	return marshalXML(doc)
+}
+
+//Pre-rolls and post-rolls use VMAP's start and end offsets so they play
+//regardless of the content's exact duration
+func vmapOffset(b Break) string {
+	switch {
+	case b.Position == "preroll" || (b.Position == "" && b.TimeOffset == 0):
+		return "start"
+	case b.Position == "postroll":
+		return "end"
+	}
+	return formatOffset(b.TimeOffset)
+}
+
+func marshalXML(doc interface{}) []byte {
+	out, _ := xml.MarshalIndent(doc, "", "  ")
+	return append([]byte(xml.Header), append(out, '\n')...)
+}
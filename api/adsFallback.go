@@ -0,0 +1,67 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+//Policies for serving a stream when the ad server can't be reached, set
+//with ADS_FALLBACK. The default responds with AdsError.
+const (
+	adsFallbackError         = "error"
+	adsFallbackEmpty         = "empty"
+	adsFallbackLastKnownGood = "last-known-good"
+)
+
+//Ads served when a stream is degraded to having none
+var emptyAds = json.RawMessage(`{"breakOffsets":[],"breaks":[]}`)
+
+//Header that tells clients which fallback their ads came from
+const adsDegradedHeader = "X-Ads-Degraded"
+
+//Gets the ads of a stream from the ad server, keeping a copy as the last
+//known-good ads. When the ad server fails the fallback policy decides what
+//is served and the fallback used is returned as the degraded reason.
+func (s *StreamController) fetchAds(ctx context.Context, streamID string) (json.RawMessage, string, error) {
+	res, err := s.adsClient.Fetch(ctx, streamID)
+	if err == nil {
+		ttl := config.GetDuration("ADS_LKG_TTL", 7*24*time.Hour)
+		if e := s.Cache.Set(lastKnownGoodKey(streamID), res, ttl); e != nil {
+			s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+		}
+		return res, "", nil
+	}
+	s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+
+	switch s.adsFallback {
+	case adsFallbackLastKnownGood:
+		hit, e := s.Cache.Get(lastKnownGoodKey(streamID))
+		if e == nil {
+			return json.RawMessage(hit), adsFallbackLastKnownGood, nil
+		} else if e != cache.ErrMiss {
+			s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+		}
+		return emptyAds, adsFallbackEmpty, nil
+	case adsFallbackEmpty:
+		return emptyAds, adsFallbackEmpty, nil
+	}
+	return nil, "", internals.AdsError
+}
+
+func lastKnownGoodKey(streamID string) string {
+	return "ads:lkg:" + streamID
+}
+
+//Marks responses built from degraded ads
+func setDegradedHeader(w http.ResponseWriter, stream Stream) {
+	if stream.AdsDegraded != "" {
+		w.Header().Set(adsDegradedHeader, stream.AdsDegraded)
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+//APIKeyStore kept in process memory, for tests and running without mongo
+type memoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryAPIKeyStore(keys ...APIKey) APIKeyStore {
+	m := &memoryAPIKeyStore{keys: map[string]APIKey{}}
+	for _, key := range keys {
+		m.Create(context.Background(), key)
+	}
+	return m
+}
+
+func (m *memoryAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[key.ID]; ok {
+		return ErrDuplicate
+	}
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *memoryAPIKeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, ok := m.keys[id]
+	if !ok {
+		return key, ErrNotFound
+	}
+	return key, nil
+}
+
+func (m *memoryAPIKeyStore) List(ctx context.Context, owner string) ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []APIKey
+	for _, key := range m.keys {
+		if key.Owner == owner {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *memoryAPIKeyStore) Replace(ctx context.Context, key APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[key.ID]; !ok {
+		return ErrNotFound
+	}
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *memoryAPIKeyStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.keys[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *memoryAPIKeyStore) ChangeOwner(ctx context.Context, owner string, newOwner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, key := range m.keys {
+		if key.Owner == owner {
+			key.Owner = newOwner
+			m.keys[id] = key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+//APIKeyStore backed by the mongo apikeys collection, which has an index on owner
+type mongoAPIKeyStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoAPIKeyStore(db *mongo.Database) APIKeyStore {
+	return mongoAPIKeyStore{collection: db.Collection("apikeys")}
+}
+
+func (m mongoAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.collection.InsertOne(ctx, key)
+	if _, ok := err.(mongo.WriteException); ok {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoAPIKeyStore) Get(ctx context.Context, id string) (APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var key APIKey
+	err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+func (m mongoAPIKeyStore) List(ctx context.Context, owner string) ([]APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cur, err := m.collection.Find(ctx, bson.M{"owner": owner}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var keys []APIKey
+	for cur.Next(ctx) {
+		var key APIKey
+		if err := cur.Decode(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, cur.Err()
+}
+
+func (m mongoAPIKeyStore) Replace(ctx context.Context, key APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.ReplaceOne(ctx, bson.M{"_id": key.ID}, key)
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m mongoAPIKeyStore) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	} else if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m mongoAPIKeyStore) ChangeOwner(ctx context.Context, owner string, newOwner string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.collection.UpdateMany(ctx, bson.M{"owner": owner}, bson.M{"$set": bson.M{"owner": newOwner}})
+	return err
+}
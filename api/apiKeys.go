@@ -0,0 +1,365 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//Keys start with this so they are easy to tell apart and to find when leaked
+const apiKeyPrefix = "dsk_"
+
+//Domain service account emails are made up under
+const serviceAccountDomain = "service-accounts.local"
+
+//A key machine clients send in the X-API-Key header. Only a hash of its
+//secret is kept.
+type APIKey struct {
+	ID    string `json:"id" bson:"_id"`
+	Owner string `json:"owner" bson:"owner"`
+	Name  string `json:"name" bson:"name"`
+	//Permissions the key can use, as long as its owner's role has them
+	Scopes    []string  `json:"scopes" bson:"scopes"`
+	Hash      string    `json:"-" bson:"hash"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	//Unset for keys that don't expire
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	RotatedAt *time.Time `json:"rotatedAt,omitempty" bson:"rotatedAt,omitempty"`
+	//Hash of the secret the key had before it was rotated, which keeps
+	//working until PreviousUntil so clients can switch over
+	PreviousHash  string     `json:"-" bson:"previousHash,omitempty"`
+	PreviousUntil *time.Time `json:"-" bson:"previousUntil,omitempty"`
+}
+
+//A key as it is returned when it is made or rotated, the only time its
+//secret is shown
+type newAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type APIKeysController struct {
+	keys  APIKeyStore
+	users UserStore
+	*config.Tools
+}
+
+func NewAPIKeysController(keys APIKeyStore, users UserStore, tools *config.Tools) *APIKeysController {
+	return &APIKeysController{keys: keys, users: users, Tools: tools}
+}
+
+func apiKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//A new secret for the key with id and the full key it makes
+func newAPIKeySecret(id string) (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	return secret, apiKeyPrefix + id + "." + secret, nil
+}
+
+//Finds the principal an API key stands for. Unknown, expired and revoked
+//keys give internals.APIKeyError. The owner is looked up every time so
+//a change of role or a deleted owner applies to their keys at once.
+func (a *APIKeysController) Authenticate(ctx context.Context, raw string) (*Principal, error) {
+	parts := strings.SplitN(strings.TrimPrefix(raw, apiKeyPrefix), ".", 2)
+	if !strings.HasPrefix(raw, apiKeyPrefix) || len(parts) != 2 {
+		return nil, internals.APIKeyError
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	key, err := a.keys.Get(ctx, parts[0])
+	if err == ErrNotFound {
+		return nil, internals.APIKeyError
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	hash := apiKeyHash(parts[1])
+	current := subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) == 1
+	previous := key.PreviousUntil != nil && now.Before(*key.PreviousUntil) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(key.PreviousHash)) == 1
+	if (!current && !previous) || (key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)) {
+		return nil, internals.APIKeyError
+	}
+
+	owner, err := a.users.FindByEmail(ctx, key.Owner)
+	if err == ErrNotFound {
+		return nil, internals.APIKeyError
+	} else if err != nil {
+		return nil, err
+	}
+	p := &Principal{Email: owner.Email, Role: owner.role(), Plan: owner.plan(), APIKeyID: key.ID}
+	for _, scope := range key.Scopes {
+		if Can(p.Role, scope) {
+			p.Permissions = append(p.Permissions, scope)
+		}
+	}
+	return p, nil
+}
+
+//Finds the owner of the keys a request is about: the user in the url for
+//admins, or the signed in user. It responds with an error and returns false
+//when that fails.
+func (a *APIKeysController) keyOwner(w http.ResponseWriter, r *http.Request) (User, bool) {
+	email := chi.URLParam(r, "email")
+	if email == "" {
+		email = emailFromContext(r.Context())
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := a.users.FindByEmail(ctx, email)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoUserError)
+		return user, false
+	} else if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return user, false
+	}
+	return user, true
+}
+
+//Keys can use their owner's permissions without a second factor, so users
+//whose role needs one have to have signed in with it to hand them out.
+//Admins managing other users' keys already had to.
+func requireMFAForKeys(w http.ResponseWriter, r *http.Request) bool {
+	p := PrincipalFromContext(r.Context())
+	if chi.URLParam(r, "email") == "" && mfaRequiredFor(p.Role) && !p.MFA {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.MFARequiredError)
+		return false
+	}
+	return true
+}
+
+//Finds the key in the url among the owner's, responding with an error and
+//returning false when it isn't one of theirs
+func (a *APIKeysController) ownedKey(w http.ResponseWriter, r *http.Request) (APIKey, bool) {
+	owner, ok := a.keyOwner(w, r)
+	if !ok {
+		return APIKey{}, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	key, err := a.keys.Get(ctx, chi.URLParam(r, "id"))
+	if err == ErrNotFound || (err == nil && key.Owner != owner.Email) {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoAPIKeyError)
+		return key, false
+	} else if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return key, false
+	}
+	return key, true
+}
+
+//Lists the owner's keys, without their secrets
+func (a *APIKeysController) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	owner, ok := a.keyOwner(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	keys, err := a.keys.List(ctx, owner.Email)
+	if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	res, _ := json.Marshal(keys)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Makes a key for the owner from {"name", "scopes", "expiresAt"}. Scopes are
+//permissions, which the owner's role has to have, and expiresAt is optional.
+func (a *APIKeysController) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Name) == "" {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if !requireMFAForKeys(w, r) {
+		return
+	}
+	owner, ok := a.keyOwner(w, r)
+	if !ok {
+		return
+	}
+	if len(body.Scopes) == 0 {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidScopeError)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !Can(owner.role(), scope) {
+			internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidScopeError)
+			return
+		}
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidExpiryError)
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	var secret, raw string
+	if err == nil {
+		secret, raw, err = newAPIKeySecret(id.String())
+	}
+	if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	key := APIKey{
+		ID:        id.String(),
+		Owner:     owner.Email,
+		Name:      strings.TrimSpace(body.Name),
+		Scopes:    body.Scopes,
+		Hash:      apiKeyHash(secret),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: body.ExpiresAt,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := a.keys.Create(ctx, key); err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	a.Logger.Info("api key "+key.ID+" made for "+owner.Email+" by "+emailFromContext(r.Context()), zap.String("reqId", middleware.GetReqID(r.Context())))
+	res, _ := json.Marshal(newAPIKey{APIKey: key, Key: raw})
+	internals.RespondAsJson(w, res, http.StatusCreated)
+}
+
+//Gives the key in the url a new secret. The old one keeps working for
+//API_KEY_ROTATION_GRACE (default 24h) so clients can switch over.
+func (a *APIKeysController) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireMFAForKeys(w, r) {
+		return
+	}
+	key, ok := a.ownedKey(w, r)
+	if !ok {
+		return
+	}
+	secret, raw, err := newAPIKeySecret(key.ID)
+	if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	now := time.Now().UTC()
+	until := now.Add(config.GetDuration("API_KEY_ROTATION_GRACE", 24*time.Hour))
+	key.PreviousHash, key.PreviousUntil = key.Hash, &until
+	key.Hash, key.RotatedAt = apiKeyHash(secret), &now
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := a.keys.Replace(ctx, key); err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoAPIKeyError)
+		return
+	} else if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	res, _ := json.Marshal(newAPIKey{APIKey: key, Key: raw})
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Deletes the key in the url, which stops working at once
+func (a *APIKeysController) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := a.ownedKey(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := a.keys.Delete(ctx, key.ID); err != nil && err != ErrNotFound {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	a.Logger.Info("api key "+key.ID+" of "+key.Owner+" revoked by "+emailFromContext(r.Context()), zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
+
+//Makes an account for a backend job or partner integration from
+//{"name", "role"}. It has no password, so it can only be used through the
+//API keys admins make for it at /v1/users/{email}/keys.
+func (a *APIKeysController) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if !regexp.MustCompile(`^[a-z0-9][a-z0-9\-]{0,62}$`).MatchString(body.Name) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.ServiceAccountNameError)
+		return
+	}
+	if body.Role == "" {
+		body.Role = RoleViewer
+	} else if !isRole(body.Role) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidRoleError)
+		return
+	}
+
+	user := User{
+		Email:          body.Name + "@" + serviceAccountDomain,
+		FirstName:      body.Name,
+		LastName:       "(service account)",
+		Role:           body.Role,
+		ServiceAccount: true,
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := a.users.Create(ctx, user)
+	if err == ErrDuplicate {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DuplicateError)
+		return
+	} else if err != nil {
+		a.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	a.Logger.Info("service account "+user.Email+" made by "+emailFromContext(r.Context()), zap.String("reqId", middleware.GetReqID(r.Context())))
+	res, _ := json.Marshal(map[string]string{"email": user.Email, "role": user.Role})
+	internals.RespondAsJson(w, res, http.StatusCreated)
+}
+
+//Keeps a user's keys working after their email changes. It is registered
+//with UsersController.OnEmailChange.
+func (a *APIKeysController) ChangeOwner(ctx context.Context, email string, newEmail string) error {
+	return a.keys.ChangeOwner(ctx, email, newEmail)
+}
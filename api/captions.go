@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Caption formats a Stream can carry
+var captionFormats = []string{"vtt", "scc", "srt", "ttml"}
+
+//Loose check for BCP-47 language tags such as en, es-419 or zh-Hant-TW
+var languageTagRegex = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+//Caption files of a Stream grouped by format
+type Captions struct {
+	Vtt  CaptionTracks `json:"vtt" bson:"vtt"`
+	Scc  CaptionTracks `json:"scc" bson:"scc"`
+	Srt  CaptionTracks `json:"srt,omitempty" bson:"srt,omitempty"`
+	Ttml CaptionTracks `json:"ttml,omitempty" bson:"ttml,omitempty"`
+}
+
+//Caption tracks of a single format keyed by BCP-47 language tag
+type CaptionTracks map[string]CaptionTrack
+
+//A caption file for one language. Label, Default and Forced are optional
+//and help players build their subtitle menus.
+type CaptionTrack struct {
+	URL     string `json:"url" bson:"url"`
+	Label   string `json:"label,omitempty" bson:"label,omitempty"`
+	Default bool   `json:"default,omitempty" bson:"default,omitempty"`
+	Forced  bool   `json:"forced,omitempty" bson:"forced,omitempty"`
+}
+
+//Returns the caption tracks for a format name such as "vtt"
+func (c Captions) byFormat(format string) CaptionTracks {
+	switch format {
+	case "vtt":
+		return c.Vtt
+	case "scc":
+		return c.Scc
+	case "srt":
+		return c.Srt
+	case "ttml":
+		return c.Ttml
+	}
+	return nil
+}
+
+//Tracks with no languages are written as {} instead of null
+func (c CaptionTracks) MarshalJSON() ([]byte, error) {
+	if c == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]CaptionTrack(c))
+}
+
+//Tracks that only have a url are written as a plain string so clients of the
+//original {"en": "<url>"} shape keep working. Slashes in the url are written
+//as \/ to match the responses the API has always returned.
+func (t CaptionTrack) MarshalJSON() ([]byte, error) {
+	url, err := json.Marshal(t.URL)
+	if err != nil {
+		return nil, err
+	}
+	url = bytes.Replace(url, []byte("/"), []byte(`\/`), -1)
+	if t.Label == "" && !t.Default && !t.Forced {
+		return url, nil
+	}
+	return json.Marshal(struct {
+		URL     json.RawMessage `json:"url"`
+		Label   string          `json:"label,omitempty"`
+		Default bool            `json:"default,omitempty"`
+		Forced  bool            `json:"forced,omitempty"`
+	}{url, t.Label, t.Default, t.Forced})
+}
+
+//Accepts either a plain url string or a track object
+func (t *CaptionTrack) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*t = CaptionTrack{URL: url}
+		return nil
+	}
+
+	type track CaptionTrack
+	var tr track
+	if err := json.Unmarshal(data, &tr); err != nil {
+		return err
+	}
+	*t = CaptionTrack(tr)
+	return nil
+}
+
+//Reads tracks stored by older versions of the API where the language
+//only held the caption url as a string.
+func (t *CaptionTrack) UnmarshalBSONValue(bt bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: bt, Value: data}
+	if url, ok := raw.StringValueOK(); ok {
+		*t = CaptionTrack{URL: url}
+		return nil
+	}
+
+	type track CaptionTrack
+	var tr track
+	if err := raw.Unmarshal(&tr); err != nil {
+		return err
+	}
+	*t = CaptionTrack(tr)
+	return nil
+}
+
+func (c Captions) validate() []error {
+	var errs []error
+	for _, format := range captionFormats {
+		tracks := c.byFormat(format)
+
+		langs := make([]string, 0, len(tracks))
+		for lang := range tracks {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+
+		defaults := 0
+		for _, lang := range langs {
+			track := tracks[lang]
+			if !languageTagRegex.MatchString(lang) {
+				errs = append(errs, fmt.Errorf("invalid %s caption language tag %s", format, lang))
+			}
+			if track.URL != "" && !isValidURL(track.URL) {
+				errs = append(errs, fmt.Errorf("invalid %s caption url for %s", format, lang))
+			}
+			if track.Default {
+				defaults++
+			}
+		}
+
+		if defaults > 1 {
+			errs = append(errs, errors.New("only one "+format+" caption can be the default"))
+		}
+	}
+	return errs
+}
+
+//Rewrites stream documents that still store caption urls as plain strings
+//into the caption track shape. Safe to run more than once.
+func MigrateCaptions(ctx context.Context, db *mongo.Database) (int, error) {
+	collection := db.Collection("streams")
+	cur, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+
+	migrated := 0
+	for cur.Next(ctx) {
+		if !hasLegacyCaptions(cur.Current) {
+			continue
+		}
+
+		var stream Stream
+		if err := cur.Decode(&stream); err != nil {
+			return migrated, err
+		}
+		if _, err := collection.ReplaceOne(ctx, bson.M{"_id": stream.ID}, stream); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, cur.Err()
+}
+
+func hasLegacyCaptions(doc bson.Raw) bool {
+	for _, format := range captionFormats {
+		val, err := doc.LookupErr("captions", format)
+		if err != nil {
+			continue
+		}
+		tracks, ok := val.DocumentOK()
+		if !ok {
+			continue
+		}
+		elems, _ := tracks.Elements()
+		for _, e := range elems {
+			if e.Value().Type == bsontype.String {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isCaptionFormat(format string) bool {
+	for _, f := range captionFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+//Picks the caption track to serve a language from. The requested format is
+//preferred so it can be passed through, then the formats that convert best.
+func (c Captions) find(lang string, format string) (CaptionTrack, string, bool) {
+	order := []string{format, "vtt", "ttml", "srt", "scc"}
+	for _, f := range order {
+		for tag, track := range c.byFormat(f) {
+			if strings.EqualFold(tag, lang) && track.URL != "" {
+				return track, f, true
+			}
+		}
+	}
+	return CaptionTrack{}, "", false
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+//A stream stored before caption tracks had labels, with one language already
+//in the new shape
+var legacyStream = bson.M{
+	"_id":       "captions-legacy",
+	"streamUrl": "https://example.com/master.m3u8",
+	"captions": bson.M{
+		"vtt": bson.M{
+			"en": "https://example.com/en.vtt",
+			"es": bson.M{"url": "https://example.com/es.vtt", "label": "Español", "default": true},
+		},
+		"scc": bson.M{},
+	},
+}
+
+func TestCaptionTrack_UnmarshalBSONValue(t *testing.T) {
+	data, err := bson.Marshal(legacyStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream Stream
+	if err := bson.Unmarshal(data, &stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if en := stream.Captions.Vtt["en"]; en != (CaptionTrack{URL: "https://example.com/en.vtt"}) {
+		t.Fatalf("%+v was read from a legacy string track", en)
+	}
+	if es := stream.Captions.Vtt["es"]; es != (CaptionTrack{URL: "https://example.com/es.vtt", Label: "Español", Default: true}) {
+		t.Fatalf("%+v was read from a track object", es)
+	}
+}
+
+func TestHasLegacyCaptions(t *testing.T) {
+	legacy, _ := bson.Marshal(legacyStream)
+	if !hasLegacyCaptions(legacy) {
+		t.Fatal("a string track wasn't found")
+	}
+
+	migrated, _ := bson.Marshal(Stream{ID: "captions-migrated", Captions: Captions{Vtt: CaptionTracks{"en": {URL: "https://example.com/en.vtt"}}}})
+	if hasLegacyCaptions(migrated) {
+		t.Fatal("a migrated stream was found to have string tracks")
+	}
+	none, _ := bson.Marshal(bson.M{"_id": "captions-none"})
+	if hasLegacyCaptions(none) {
+		t.Fatal("a stream without captions was found to have string tracks")
+	}
+}
+
+func TestCaptions_Validate_OneDefault(t *testing.T) {
+	one := Captions{
+		Vtt: CaptionTracks{"en": {URL: "https://example.com/en.vtt", Default: true}, "es": {URL: "https://example.com/es.vtt"}},
+		Scc: CaptionTracks{"en": {URL: "https://example.com/en.scc", Default: true}},
+	}
+	if errs := one.validate(); len(errs) != 0 {
+		t.Fatalf("%v was returned for one default in each format", errs)
+	}
+
+	two := Captions{Vtt: CaptionTracks{"en": {URL: "https://example.com/en.vtt", Default: true}, "es": {URL: "https://example.com/es.vtt", Default: true}}}
+	errs := two.validate()
+	if len(errs) != 1 || errs[0].Error() != "only one vtt caption can be the default" {
+		t.Fatalf("%v was returned instead of one error for two defaults", errs)
+	}
+}
+
+func TestMigrateCaptions(t *testing.T) {
+	if os.Getenv("MONGO_URI") == "" {
+		t.Skip("MONGO_URI is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGO_URI")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+	db := client.Database("captions_migration_test")
+	defer db.Drop(ctx)
+
+	migrated := Stream{ID: "captions-migrated", Captions: Captions{Vtt: CaptionTracks{"en": {URL: "https://example.com/en.vtt"}}}}
+	if _, err := db.Collection("streams").InsertMany(ctx, []interface{}{legacyStream, migrated}); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := MigrateCaptions(ctx, db); err != nil || count != 1 {
+		t.Fatalf("%d streams were migrated with %v instead of the legacy one", count, err)
+	}
+	raw, err := db.Collection("streams").FindOne(ctx, bson.M{"_id": "captions-legacy"}).DecodeBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasLegacyCaptions(raw) {
+		t.Fatalf("%s still has string tracks after migrating", raw)
+	}
+	var stream Stream
+	if err := bson.Unmarshal(raw, &stream); err != nil || stream.Captions.Vtt["es"].Label != "Español" {
+		t.Fatalf("%+v was left with %v after migrating", stream, err)
+	}
+
+	if count, err := MigrateCaptions(ctx, db); err != nil || count != 0 {
+		t.Fatalf("%d streams were migrated again with %v", count, err)
+	}
+}
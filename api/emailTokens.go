@@ -0,0 +1,343 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"DiscoveryStreams/mail"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//What an email token is for. A token only works for the purpose it was made for.
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposePasswordReset = "password-reset"
+	purposeChangeEmail   = "change-email"
+	//Not emailed, but signed the same way: what /login gives accounts with
+	//two-factor authentication to finish signing in at /login/mfa
+	purposeMFAChallenge = "mfa-challenge"
+)
+
+//Contents of an email verification or password reset token
+type emailToken struct {
+	Purpose string `json:"p"`
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+	//Random id the token is marked used under
+	Nonce string `json:"n"`
+	//Reset tokens carry a fingerprint of the password hash they were issued
+	//for, so changing the password voids every other one still out there.
+	//MFA challenges carry one of the TOTP secret instead.
+	Password string `json:"h,omitempty"`
+	//Address an email change token moves the account to
+	NewEmail string `json:"ne,omitempty"`
+}
+
+//Email tokens are signed with EMAIL_TOKEN_SECRET, or TOKEN_SECRET when it
+//isn't set. Without either a random key is used, which means tokens stop
+//working when the server restarts and only work on the instance that made them.
+func emailTokenSecret(tools *config.Tools) []byte {
+	secret := os.Getenv("EMAIL_TOKEN_SECRET")
+	if secret == "" {
+		secret = os.Getenv("TOKEN_SECRET")
+	}
+	if secret != "" {
+		return []byte(secret)
+	}
+	tools.Logger.Warn("EMAIL_TOKEN_SECRET and TOKEN_SECRET are unset, email tokens are signed with a random key")
+	random := make([]byte, 32)
+	rand.Read(random)
+	return random
+}
+
+func passwordFingerprint(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+func emailTokenUsedKey(nonce string) string {
+	return "emailtoken:" + nonce + ":used"
+}
+
+func (u *UsersController) signature(payload string) []byte {
+	mac := hmac.New(sha256.New, u.emailSecret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+//Signs a token that is good for ttl. It is the base64 json of
+//an emailToken and its HMAC, separated by a dot.
+func (u *UsersController) signEmailToken(token emailToken, ttl time.Duration) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	token.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	token.Expires = time.Now().Add(ttl).Unix()
+
+	doc, _ := json.Marshal(token)
+	payload := base64.RawURLEncoding.EncodeToString(doc)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(u.signature(payload)), nil
+}
+
+//Checks a token's signature, purpose and expiry and marks it used. Tokens
+//that fail any check, or were used before, give internals.EmailTokenError.
+func (u *UsersController) useEmailToken(raw string, purposes ...string) (emailToken, error) {
+	token, err := u.readEmailToken(raw, purposes...)
+	if err != nil {
+		return token, err
+	}
+	return token, u.markEmailTokenUsed(token)
+}
+
+//Checks a token's signature, purpose and expiry without using it up
+func (u *UsersController) readEmailToken(raw string, purposes ...string) (emailToken, error) {
+	var token emailToken
+	parts := strings.Split(raw, ".")
+	if len(parts) != 2 {
+		return token, internals.EmailTokenError
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, u.signature(parts[0])) {
+		return token, internals.EmailTokenError
+	}
+	doc, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(doc, &token) != nil {
+		return token, internals.EmailTokenError
+	}
+	expires := time.Unix(token.Expires, 0)
+	allowed := false
+	for _, purpose := range purposes {
+		allowed = allowed || token.Purpose == purpose
+	}
+	if !allowed || token.Nonce == "" || !time.Now().Before(expires) {
+		return token, internals.EmailTokenError
+	}
+	return token, nil
+}
+
+//Marks a token used, giving internals.EmailTokenError if it already was
+func (u *UsersController) markEmailTokenUsed(token emailToken) error {
+	first, err := u.Cache.SetNX(emailTokenUsedKey(token.Nonce), []byte("true"), time.Until(time.Unix(token.Expires, 0)))
+	if err != nil {
+		return err
+	} else if !first {
+		return internals.EmailTokenError
+	}
+	return nil
+}
+
+//Puts a token into the link template in env, where {token} is replaced by
+//it. Without a template the token is sent on its own.
+func emailLink(env string, token string) string {
+	link := os.Getenv(env)
+	if link == "" {
+		return token
+	}
+	return strings.Replace(link, "{token}", token, -1)
+}
+
+//Emails a link to verify their address to a new user. The link lasts for
+//EMAIL_VERIFY_TTL (default 48h).
+func (u *UsersController) sendVerificationEmail(ctx context.Context, user User) error {
+	ttl := config.GetDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+	token, err := u.signEmailToken(emailToken{Purpose: purposeVerifyEmail, Email: user.Email}, ttl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return u.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address with the link below. It expires in %s.\n\n%s\n",
+			user.FirstName, ttl, emailLink("VERIFY_EMAIL_URL", token)),
+	})
+}
+
+//Emails a password reset link to a user. The link lasts for
+//PASSWORD_RESET_TTL (default 1h).
+func (u *UsersController) sendPasswordResetEmail(ctx context.Context, user User) error {
+	ttl := config.GetDuration("PASSWORD_RESET_TTL", time.Hour)
+	token, err := u.signEmailToken(emailToken{
+		Purpose:  purposePasswordReset,
+		Email:    user.Email,
+		Password: passwordFingerprint(user.Password),
+	}, ttl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return u.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nChoose a new password with the link below. It expires in %s.\n"+
+			"If you didn't ask to reset your password you can ignore this email.\n\n%s\n",
+			user.FirstName, ttl, emailLink("RESET_PASSWORD_URL", token)),
+	})
+}
+
+//Emails a link to confirm a new address to it. The account keeps its old
+//address until the link is used. It lasts for EMAIL_VERIFY_TTL too.
+func (u *UsersController) sendEmailChangeEmail(ctx context.Context, user User, newEmail string) error {
+	ttl := config.GetDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+	token, err := u.signEmailToken(emailToken{Purpose: purposeChangeEmail, Email: user.Email, NewEmail: newEmail}, ttl)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return u.Mailer.Send(ctx, mail.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm this is your new email address with the link below. It expires in %s.\n"+
+			"Until then you keep signing in with %s.\n\n%s\n",
+			user.FirstName, ttl, user.Email, emailLink("VERIFY_EMAIL_URL", token)),
+	})
+}
+
+//Verifies the email address of the account a token from the signup email
+//was sent to, or moves an account to the new address a change token was sent to
+func (u *UsersController) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	token, err := u.useEmailToken(body.Token, purposeVerifyEmail, purposeChangeEmail)
+	if err == internals.EmailTokenError {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	if token.Purpose == purposeChangeEmail {
+		u.changeEmail(w, r, token)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err = u.users.MarkVerified(ctx, token.Email)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.EmailTokenError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	internals.RespondAsJson(w, nil, http.StatusOK)
+}
+
+//Emails a password reset link to the address in the body if it has an
+//account. It answers 202 either way so it can't be used to find out which
+//emails are signed up. The account is looked up and the email sent after
+//answering, so the time taken doesn't tell either.
+func (u *UsersController) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	go u.sendPasswordResetEmailTo(detachedContext(r.Context()), body.Email)
+	internals.RespondAsJson(w, nil, http.StatusAccepted)
+}
+
+func (u *UsersController) sendPasswordResetEmailTo(ctx context.Context, email string) {
+	findCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(findCtx, email)
+	if err == nil {
+		err = u.sendPasswordResetEmail(ctx, user)
+	}
+	if err != nil && err != ErrNotFound {
+		u.Logger.Error("password reset for "+email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+}
+
+//Sets a new password with a token from the reset email and signs out every
+//session. Receiving the email proves the address too, so the account is
+//verified as well.
+func (u *UsersController) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if err := validatePassword(body.Password); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, []error{err})
+		return
+	}
+
+	token, err := u.useEmailToken(body.Token, purposePasswordReset)
+	if err == internals.EmailTokenError {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(ctx, token.Email)
+	if err == ErrNotFound || (err == nil && passwordFingerprint(user.Password) != token.Password) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.EmailTokenError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	hash, err := u.hasher.Hash(body.Password)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.PasswordHashError)
+		return
+	}
+	if err = u.users.UpdatePassword(ctx, user.Email, hash); err == nil && user.Unverified {
+		err = u.users.MarkVerified(ctx, user.Email)
+	}
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	if err := u.revokeAllTokens(user.Email); err != nil {
+		u.Logger.Error("revoking tokens of "+user.Email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+
+	u.Logger.Info("password of "+user.Email+" was reset", zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusOK)
+}
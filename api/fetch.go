@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//Shared client for fetching caption files and playlists from where they are stored
+var originClient = &http.Client{Timeout: 10 * time.Second}
+
+//Downloads a file of at most maxSize bytes
+func fetchURL(ctx context.Context, url string, maxSize int64) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := originClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return nil, fmt.Errorf("Returned %d from %s", res.StatusCode, url)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	} else if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, maxSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,16 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"encoding/json"
+	"net/http"
+)
+
+//Publishes the public keys access tokens can be verified with so other
+//services don't need a shared secret. Rotated keys stay listed for as long
+//as they are configured to verify.
+func (u *UsersController) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(u.Keys.JWKS())
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	internals.Respond(w, body, "application/jwk-set+json", http.StatusOK)
+}
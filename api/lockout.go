@@ -0,0 +1,161 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Failed logins are counted separately for the email that was tried and the
+//IP it was tried from, so one attacker can't lock out an account from many
+//IPs without it showing and one IP can't try many accounts.
+const (
+	lockoutEmail = "email"
+	lockoutIP    = "ip"
+)
+
+func loginFailuresKey(kind string, id string) string {
+	return "login:failures:" + kind + ":" + id
+}
+
+func loginLockKey(kind string, id string) string {
+	return "login:lock:" + kind + ":" + id
+}
+
+//How many times an email or IP has been locked out recently, which is what
+//makes each lockout longer than the one before
+func loginLockoutsKey(kind string, id string) string {
+	return "login:lockouts:" + kind + ":" + id
+}
+
+//Emails are matched case insensitively so changing their case doesn't get
+//an attacker fresh attempts
+func lockoutEmailID(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+//The address middleware.RealIP left in RemoteAddr, without its port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+//How many failures lock out an email or IP within LOGIN_FAILURE_WINDOW
+func maxLoginFailures(kind string) int {
+	if kind == lockoutIP {
+		return config.GetInt("LOGIN_MAX_IP_FAILURES", 20)
+	}
+	return config.GetInt("LOGIN_MAX_FAILURES", 5)
+}
+
+//Lockouts start at LOGIN_LOCKOUT (default 1m) and double every time the same
+//email or IP is locked out again within LOGIN_LOCKOUT_MEMORY (default 24h),
+//up to LOGIN_LOCKOUT_MAX (default 24h).
+func lockoutDuration(lockouts int64) time.Duration {
+	base := config.GetDuration("LOGIN_LOCKOUT", time.Minute)
+	max := config.GetDuration("LOGIN_LOCKOUT_MAX", 24*time.Hour)
+	d := base
+	for i := int64(1); i < lockouts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+//Returns how long until the email or IP of a login attempt can try again,
+//or 0 if neither is locked out
+func (u *UsersController) loginRetryAfter(email string, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for kind, id := range map[string]string{lockoutEmail: email, lockoutIP: ip} {
+		ttl, err := u.Cache.TTL(loginLockKey(kind, id))
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+//Counts a failed login against its email and IP, locking either out once it
+//reaches its limit
+func (u *UsersController) recordLoginFailure(r *http.Request, email string, ip string) error {
+	window := config.GetDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+	for kind, id := range map[string]string{lockoutEmail: email, lockoutIP: ip} {
+		failures, err := u.Cache.Incr(loginFailuresKey(kind, id), window)
+		if err != nil {
+			return err
+		}
+		if failures < int64(maxLoginFailures(kind)) {
+			continue
+		}
+
+		lockouts, err := u.Cache.Incr(loginLockoutsKey(kind, id), config.GetDuration("LOGIN_LOCKOUT_MEMORY", 24*time.Hour))
+		if err != nil {
+			return err
+		}
+		d := lockoutDuration(lockouts)
+		if err := u.Cache.Set(loginLockKey(kind, id), []byte("true"), d); err != nil {
+			return err
+		}
+		if err := u.Cache.Del(loginFailuresKey(kind, id)); err != nil {
+			return err
+		}
+		u.Logger.Warn(fmt.Sprintf("login locked for %s %s for %s after %d failed attempts", kind, id, d, failures),
+			zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+	return nil
+}
+
+//A successful login forgives the email's failed attempts but not the IP's,
+//so an attacker can't reset their count by logging into their own account
+func (u *UsersController) clearLoginFailures(email string) error {
+	return u.Cache.Del(loginFailuresKey(lockoutEmail, email))
+}
+
+//Responds 429 with a Retry-After header in whole seconds
+func respondLocked(w http.ResponseWriter, wait time.Duration) {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	internals.RespondAsErrorJson(w, http.StatusTooManyRequests, internals.LoginLockedError)
+}
+
+//Lifts the lockout on the email in the url and forgets its failed attempts
+func (u *UsersController) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	u.unlock(w, r, lockoutEmail, lockoutEmailID(chi.URLParam(r, "email")))
+}
+
+//Lifts the lockout on the IP in the url and forgets its failed attempts
+func (u *UsersController) UnlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(chi.URLParam(r, "ip"))
+	if ip == nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidIPError)
+		return
+	}
+	u.unlock(w, r, lockoutIP, ip.String())
+}
+
+func (u *UsersController) unlock(w http.ResponseWriter, r *http.Request, kind string, id string) {
+	err := u.Cache.Del(loginLockKey(kind, id), loginFailuresKey(kind, id), loginLockoutsKey(kind, id))
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	u.Logger.Info("login unlocked for "+kind+" "+id+" by "+emailFromContext(r.Context()),
+		zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
@@ -0,0 +1,379 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"DiscoveryStreams/totp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//How many recovery codes are given out at a time
+const recoveryCodeCount = 10
+
+//Time steps a TOTP code may be off by either way, for clocks that are off
+const totpSkew = 1
+
+//Returned by /login instead of tokens for accounts with two-factor
+//authentication, to be finished at /login/mfa
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfaRequired"`
+	MFAToken    string `json:"mfaToken"`
+	ExpiresIn   int64  `json:"expiresIn"`
+}
+
+//A TOTP code is only accepted once, even though it is good for a few steps
+func totpUsedKey(email string, step int64) string {
+	return fmt.Sprintf("totp:used:%s:%d", strings.ToLower(email), step)
+}
+
+//Roles in MFA_REQUIRED_ROLES (comma separated) have to sign in with
+//two-factor authentication before they can use their permissions
+func mfaRequiredFor(role string) bool {
+	for _, r := range strings.Split(os.Getenv("MFA_REQUIRED_ROLES"), ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+//Whether the principal in the request context signed in with two-factor
+//authentication
+func mfaFromContext(ctx context.Context) bool {
+	if p := PrincipalFromContext(ctx); p != nil {
+		return p.MFA
+	}
+	return false
+}
+
+//Recovery codes are random, so a plain hash is enough to keep them. Dashes,
+//spaces and case are ignored since people copy them by hand.
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+//A new set of recovery codes and the hashes that are stored for them
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		codes[i] = code[:8] + "-" + code[8:]
+		hashes[i] = recoveryCodeHash(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+//Checks a code from the user's authenticator app, which can't be used twice
+func (u *UsersController) checkTOTP(user User, code string) (bool, error) {
+	step, ok := totp.Validate(user.TOTPSecret, strings.TrimSpace(code), time.Now(), totpSkew)
+	if !ok {
+		return false, nil
+	}
+	return u.Cache.SetNX(totpUsedKey(user.Email, step), []byte("true"), (2*totpSkew+1)*totp.Period)
+}
+
+//Checks a second factor, which is either a code from the user's
+//authenticator app or one of their recovery codes. A recovery code is used
+//up by a successful check.
+func (u *UsersController) checkSecondFactor(ctx context.Context, user User, code string) (bool, error) {
+	if len(strings.TrimSpace(code)) == totp.Digits {
+		return u.checkTOTP(user, code)
+	}
+	err := u.users.UseRecoveryCode(ctx, user.Email, recoveryCodeHash(code))
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err == nil {
+		u.Logger.Info(user.Email+" used a recovery code", zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+	return err == nil, err
+}
+
+//Signs a user in once their password or identity provider has been checked.
+//Accounts with two-factor authentication get a challenge that lasts for
+//MFA_CHALLENGE_TTL (default 5m) instead of tokens.
+func (u *UsersController) completeLogin(w http.ResponseWriter, r *http.Request, user User) {
+	if user.TOTPEnabled {
+		ttl := config.GetDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+		token, err := u.signEmailToken(emailToken{Purpose: purposeMFAChallenge, Email: user.Email, Password: passwordFingerprint(user.TOTPSecret)}, ttl)
+		if err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+			return
+		}
+		res, _ := json.Marshal(mfaChallenge{MFARequired: true, MFAToken: token, ExpiresIn: int64(ttl / time.Second)})
+		internals.RespondAsJson(w, res, http.StatusOK)
+		return
+	}
+
+	refresh, session, err := u.startRefreshFamily(r, user.Email, false)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	u.respondWithTokens(w, r, user, session, refresh)
+}
+
+//Finishes a login with the mfaToken from /login and a code from the user's
+//authenticator app or a recovery code. Wrong codes count towards the same
+//lockout as wrong passwords, and a challenge can only be finished once.
+func (u *UsersController) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MFAToken string `json:"mfaToken"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	challenge, err := u.readEmailToken(body.MFAToken, purposeMFAChallenge)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.MFAChallengeError)
+		return
+	}
+
+	email, ip := lockoutEmailID(challenge.Email), clientIP(r)
+	wait, err := u.loginRetryAfter(email, ip)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	} else if wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(ctx, challenge.Email)
+	//turning two-factor authentication off or on again voids open challenges
+	if err == ErrNotFound || (err == nil && (!user.TOTPEnabled || passwordFingerprint(user.TOTPSecret) != challenge.Password)) {
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.MFAChallengeError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	ok, err := u.checkSecondFactor(ctx, user, body.Code)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	if !ok {
+		if err := u.recordLoginFailure(r, email, ip); err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		}
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.MFACodeError)
+		return
+	}
+	if err := u.markEmailTokenUsed(challenge); err == internals.EmailTokenError {
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.MFAChallengeError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	if err := u.clearLoginFailures(email); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+
+	refresh, session, err := u.startRefreshFamily(r, user.Email, true)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	u.respondWithTokens(w, r, user, session, refresh)
+}
+
+//Starts setting up an authenticator app for the signed in user. The secret
+//isn't used for logins until a code from it is sent to /v1/me/mfa/totp/confirm.
+func (u *UsersController) StartTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		internals.RespondAsErrorJson(w, http.StatusConflict, internals.MFAEnabledError)
+		return
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := u.users.SetTOTP(ctx, user.Email, secret, false, nil); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = "Discovery Streams"
+	}
+	res, _ := json.Marshal(map[string]string{"secret": secret, "uri": totp.URI(issuer, user.Email, secret)})
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Turns on two-factor authentication once a code from the authenticator app
+//set up with /v1/me/mfa/totp is given, and returns the recovery codes. They
+//are only ever shown here.
+func (u *UsersController) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		internals.RespondAsErrorJson(w, http.StatusConflict, internals.MFAEnabledError)
+		return
+	} else if user.TOTPSecret == "" {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.MFANotEnabledError)
+		return
+	}
+	if ok, err := u.checkTOTP(user, body.Code); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	} else if !ok {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.MFACodeError)
+		return
+	}
+
+	u.replaceRecoveryCodes(w, r, user)
+	u.Logger.Info("two-factor authentication of "+user.Email+" was turned on", zap.String("reqId", middleware.GetReqID(r.Context())))
+}
+
+//Swaps the signed in user's recovery codes for new ones once they give a
+//second factor
+func (u *UsersController) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.checkMFABody(w, r)
+	if !ok {
+		return
+	}
+	u.replaceRecoveryCodes(w, r, user)
+}
+
+//Turns off two-factor authentication for the signed in user once they give
+//a second factor, unless their role requires it
+func (u *UsersController) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.checkMFABody(w, r)
+	if !ok {
+		return
+	}
+	if mfaRequiredFor(user.role()) {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.MFARequiredError)
+		return
+	}
+	u.resetTOTP(w, r, user.Email)
+}
+
+//Turns off two-factor authentication for the user in the url, for when
+//they have lost their authenticator app and recovery codes
+func (u *UsersController) ResetMFA(w http.ResponseWriter, r *http.Request) {
+	u.resetTOTP(w, r, chi.URLParam(r, "email"))
+}
+
+//Reads {"code"} from the body and checks it as a second factor of the
+//signed in user, responding with an error and returning false when that fails
+func (u *UsersController) checkMFABody(w http.ResponseWriter, r *http.Request) (User, bool) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return User{}, false
+	}
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return user, false
+	}
+	if !user.TOTPEnabled {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.MFANotEnabledError)
+		return user, false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if ok, err := u.checkSecondFactor(ctx, user, body.Code); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return user, false
+	} else if !ok {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.MFACodeError)
+		return user, false
+	}
+	return user, true
+}
+
+//Stores new recovery codes for user, which has its TOTP secret, and
+//responds with them
+func (u *UsersController) replaceRecoveryCodes(w http.ResponseWriter, r *http.Request, user User) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := u.users.SetTOTP(ctx, user.Email, user.TOTPSecret, true, hashes); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	res, _ := json.Marshal(map[string][]string{"recoveryCodes": codes})
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+func (u *UsersController) resetTOTP(w http.ResponseWriter, r *http.Request, email string) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := u.users.SetTOTP(ctx, email, "", false, nil)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoUserError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	u.Logger.Info("two-factor authentication of "+email+" was turned off by "+emailFromContext(r.Context()),
+		zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
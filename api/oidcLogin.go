@@ -0,0 +1,241 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"DiscoveryStreams/oidc"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//What is kept between sending a user to their identity provider and them
+//coming back with a code
+type oidcState struct {
+	Provider string `json:"provider"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+//An identity provider and how far its emails are trusted
+type identityProvider struct {
+	*oidc.Provider
+	//Whether a first sign in may be linked to the viewer account that has the
+	//same email. Only providers that own the emails they verify, like a
+	//company's own directory, should be trusted with this.
+	autoLink bool
+}
+
+//Identity providers named in OIDC_PROVIDERS (comma separated). Each one is
+//set up with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID,
+//OIDC_<NAME>_CLIENT_SECRET, OIDC_<NAME>_REDIRECT_URL and optionally
+//OIDC_<NAME>_SCOPES (space separated) and OIDC_<NAME>_AUTO_LINK.
+func oidcProviders(tools *config.Tools) map[string]identityProvider {
+	providers := map[string]identityProvider{}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		env := "OIDC_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+		cfg := oidc.Config{
+			Issuer:       os.Getenv(env + "ISSUER"),
+			ClientID:     os.Getenv(env + "CLIENT_ID"),
+			ClientSecret: os.Getenv(env + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(env + "REDIRECT_URL"),
+			Scopes:       strings.Fields(os.Getenv(env + "SCOPES")),
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			tools.Logger.Error("identity provider " + name + " needs " + env + "ISSUER, " + env + "CLIENT_ID and " + env + "REDIRECT_URL")
+			continue
+		}
+		providers[name] = identityProvider{
+			Provider: oidc.NewProvider(cfg, client),
+			autoLink: os.Getenv(env+"AUTO_LINK") == "true",
+		}
+	}
+	return providers
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+//Sends the user to the identity provider in the url to sign in. The state,
+//nonce and PKCE verifier of the attempt are kept for OIDC_STATE_TTL
+//(default 10m) for when they come back.
+func (u *UsersController) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	provider, ok := u.providers[name]
+	if !ok {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoOIDCProviderError)
+		return
+	}
+
+	var state oidcState
+	key, err := randomString()
+	if err == nil {
+		state.Nonce, err = randomString()
+	}
+	if err == nil {
+		state.Verifier, err = randomString()
+	}
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	state.Provider = name
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	redirect, err := provider.AuthCodeURL(ctx, key, state.Nonce, state.Verifier)
+	if err != nil {
+		u.Logger.Error("identity provider "+name+" gave "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.OIDCProviderError)
+		return
+	}
+
+	doc, _ := json.Marshal(state)
+	if err := u.Cache.Set(oidcStateKey(key), doc, config.GetDuration("OIDC_STATE_TTL", 10*time.Minute)); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+//Takes the code the identity provider sent the user back with, checks the
+//id_token it is swapped for and signs in the user the identity belongs to,
+//responding like /login
+func (u *UsersController) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "provider")
+	provider, ok := u.providers[name]
+	if !ok {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoOIDCProviderError)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		u.Logger.Info("identity provider "+name+" refused a sign in: "+e+" "+q.Get("error_description"), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.OIDCError)
+		return
+	}
+
+	//a state can only be used once
+	var state oidcState
+	doc, err := u.Cache.Get(oidcStateKey(q.Get("state")))
+	if err == nil {
+		err = u.Cache.Del(oidcStateKey(q.Get("state")))
+	}
+	if err == cache.ErrMiss || (err == nil && (json.Unmarshal(doc, &state) != nil || state.Provider != name)) {
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.OIDCError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	raw, err := provider.Exchange(ctx, q.Get("code"), state.Verifier)
+	if err != nil {
+		u.Logger.Error("identity provider "+name+" gave "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.OIDCProviderError)
+		return
+	}
+	idToken, err := provider.VerifyIDToken(ctx, raw, state.Nonce)
+	if _, invalid := err.(*oidc.ValidationError); invalid {
+		u.Logger.Warn("identity provider "+name+": "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.OIDCError)
+		return
+	} else if err != nil {
+		u.Logger.Error("identity provider "+name+" gave "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.OIDCProviderError)
+		return
+	}
+
+	user, err := u.userForIdentity(ctx, provider, idToken)
+	if err == internals.OIDCEmailError || err == internals.DuplicateError || err == internals.OIDCLinkError {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, err)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	u.completeLogin(w, r, user)
+}
+
+//Finds the user an identity is linked to. An identity seen for the first
+//time gets a new account, but only when the provider has verified the email.
+//Accounts made this way have no password until one is set with the forgotten
+//password flow. If an account already has the email, the identity is only
+//linked to it when the provider is trusted to, and never to service accounts
+//or accounts with more than a viewer's role, which would otherwise be taken
+//over by anyone the provider lets claim the email. Unverified accounts aren't
+//linked either: whoever signed up with the email may not own it, and their
+//password would keep working on the account.
+func (u *UsersController) userForIdentity(ctx context.Context, provider identityProvider, idToken oidc.IDToken) (User, error) {
+	identity := Identity{Issuer: provider.Issuer(), Subject: idToken.Subject}
+	user, err := u.users.FindByIdentity(ctx, identity)
+	if err != ErrNotFound {
+		return user, err
+	}
+	if idToken.Email == "" || !idToken.EmailVerified {
+		return user, internals.OIDCEmailError
+	}
+
+	user, err = u.users.FindByEmail(ctx, idToken.Email)
+	if err == nil && (!provider.autoLink || user.ServiceAccount || user.Unverified || user.role() != RoleViewer) {
+		u.Logger.Warn(identity.Issuer+" account "+identity.Subject+" wasn't linked to "+user.Email, zap.String("reqId", middleware.GetReqID(ctx)))
+		return user, internals.OIDCLinkError
+	} else if err == nil {
+		if err := u.users.LinkIdentity(ctx, user.Email, identity); err != nil {
+			return user, err
+		}
+		u.Logger.Info(identity.Issuer+" account "+identity.Subject+" linked to "+user.Email, zap.String("reqId", middleware.GetReqID(ctx)))
+		return user, nil
+	} else if err != ErrNotFound {
+		return user, err
+	}
+
+	user = User{
+		Email:      idToken.Email,
+		FirstName:  idToken.GivenName,
+		LastName:   idToken.FamilyName,
+		Role:       RoleViewer,
+		Identities: []Identity{identity},
+	}
+	if user.FirstName == "" && user.LastName == "" {
+		names := strings.Fields(idToken.Name)
+		if len(names) > 0 {
+			user.FirstName, user.LastName = names[0], strings.Join(names[1:], " ")
+		}
+	}
+	if err := u.users.Create(ctx, user); err == ErrDuplicate {
+		return user, internals.DuplicateError
+	} else if err != nil {
+		return user, err
+	}
+	u.Logger.Info("created "+user.Email+" for "+identity.Issuer+" account "+identity.Subject, zap.String("reqId", middleware.GetReqID(ctx)))
+	return user, nil
+}
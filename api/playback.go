@@ -0,0 +1,228 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//A stream being played on a device. Players get one from /play and keep it
+//alive with heartbeats; it expires PLAYBACK_LEASE_TTL after the last one.
+//Each user can only hold so many at once.
+type playbackLease struct {
+	ID        string    `json:"id"`
+	StreamID  string    `json:"streamId"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	StartedAt time.Time `json:"startedAt"`
+	RenewedAt time.Time `json:"renewedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	//Seconds between heartbeats that keep the lease from expiring, only set
+	//when it is issued or renewed
+	HeartbeatEvery int64 `json:"heartbeatEvery,omitempty"`
+	//Playlist to play the stream from with the lease, only set when it is issued
+	ManifestURL string `json:"manifestUrl,omitempty"`
+}
+
+//Leases are kept under their user so they can be counted and listed together
+func playbackPrefix(email string) string {
+	return "playback:" + strings.ToLower(email) + ":"
+}
+
+func playbackKey(email string, id string) string {
+	return playbackPrefix(email) + id
+}
+
+func playbackLeaseTTL() time.Duration {
+	return config.GetDuration("PLAYBACK_LEASE_TTL", 2*time.Minute)
+}
+
+//How many streams a user on plan may play at once: PLAYBACK_MAX_STREAMS_<PLAN>,
+//then PLAYBACK_MAX_STREAMS, then 3. 0 means no limit.
+func maxConcurrentStreams(plan string) int {
+	key := "PLAYBACK_MAX_STREAMS_" + strings.ToUpper(strings.Replace(plan, "-", "_", -1))
+	if max, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return max
+	}
+	return config.GetInt("PLAYBACK_MAX_STREAMS", 3)
+}
+
+//Reads the leases of a user, leaving out ones that expired while listing
+func (s *StreamController) playbackLeases(email string) ([]playbackLease, error) {
+	keys, err := s.Cache.Keys(playbackPrefix(email))
+	if err != nil {
+		return nil, err
+	}
+	leases := []playbackLease{}
+	for _, key := range keys {
+		doc, err := s.Cache.Get(key)
+		if err == cache.ErrMiss {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var lease playbackLease
+		if err := json.Unmarshal(doc, &lease); err != nil {
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+//Reads a lease of a user for the stream with streamID. Leases that expired,
+//were stopped or are for another stream give NoPlaybackError.
+func (s *StreamController) leaseFor(email string, id string, streamID string) (playbackLease, error) {
+	var lease playbackLease
+	if id == "" {
+		return lease, internals.NoPlaybackError
+	}
+	doc, err := s.Cache.Get(playbackKey(email, id))
+	if err == cache.ErrMiss {
+		return lease, internals.NoPlaybackError
+	} else if err != nil {
+		return lease, err
+	}
+	if err := json.Unmarshal(doc, &lease); err != nil || lease.StreamID != streamID {
+		return lease, internals.NoPlaybackError
+	}
+	return lease, nil
+}
+
+func (s *StreamController) saveLease(email string, lease *playbackLease) error {
+	ttl := playbackLeaseTTL()
+	lease.RenewedAt = time.Now()
+	lease.ExpiresAt = lease.RenewedAt.Add(ttl)
+	lease.HeartbeatEvery = 0
+	doc, _ := json.Marshal(lease)
+	lease.HeartbeatEvery = int64(ttl / 3 / time.Second)
+	if lease.HeartbeatEvery < 1 {
+		lease.HeartbeatEvery = 1
+	}
+	return s.Cache.Set(playbackKey(email, lease.ID), doc, ttl)
+}
+
+func (s *StreamController) respondPlaybackRedisError(w http.ResponseWriter, r *http.Request, err error) {
+	s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+}
+
+//Starts playing the stream in the url, returning a lease the player has to
+//renew every heartbeatEvery seconds. Users already playing as many streams
+//as their plan allows get a 409 until one of them stops or expires.
+func (s *StreamController) PlayStream(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "id")
+	if _, err := s.cachedStream(r.Context(), streamID); err != nil {
+		respondStreamError(w, err)
+		return
+	}
+
+	p := PrincipalFromContext(r.Context())
+	max := maxConcurrentStreams(p.Plan)
+	lease := playbackLease{
+		StreamID:  streamID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		StartedAt: time.Now(),
+	}
+	id, err := uuid.NewRandom()
+	if err == nil {
+		lease.ID = id.String()
+		err = s.saveLease(p.Email, &lease)
+	}
+	if err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+
+	//counting after saving means two plays racing for the last slot can both
+	//be refused, but never both let through
+	if max > 0 {
+		leases, err := s.playbackLeases(p.Email)
+		if err != nil {
+			s.Cache.Del(playbackKey(p.Email, lease.ID))
+			s.respondPlaybackRedisError(w, r, err)
+			return
+		}
+		if len(leases) > max {
+			s.Cache.Del(playbackKey(p.Email, lease.ID))
+			internals.RespondAsErrorJson(w, http.StatusConflict, internals.ConcurrentStreamsError)
+			return
+		}
+	}
+
+	lease.ManifestURL = strings.TrimSuffix(r.URL.Path, "/play") + "/manifest.m3u8?lease=" + url.QueryEscape(lease.ID)
+	res, _ := json.Marshal(lease)
+	internals.RespondAsJson(w, res, http.StatusCreated)
+}
+
+//Renews a lease of the signed in user. Leases that expired or were stopped
+//give a 404, after which the player has to start playing again.
+func (s *StreamController) PlaybackHeartbeat(w http.ResponseWriter, r *http.Request) {
+	email := emailFromContext(r.Context())
+	lease, err := s.leaseFor(email, chi.URLParam(r, "leaseId"), chi.URLParam(r, "id"))
+	if err == internals.NoPlaybackError {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+	if err := s.saveLease(email, &lease); err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(lease)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Lists the streams the signed in user is playing, most recently started first
+func (s *StreamController) ListPlayback(w http.ResponseWriter, r *http.Request) {
+	leases, err := s.playbackLeases(emailFromContext(r.Context()))
+	if err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].StartedAt.After(leases[j].StartedAt)
+	})
+	res, _ := json.Marshal(leases)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Ends one of the signed in user's leases, freeing its slot at once. Players
+//stop with it when they are done and users kick other devices with it. When
+//it is reached under a stream, the lease has to be for that stream.
+func (s *StreamController) StopPlayback(w http.ResponseWriter, r *http.Request) {
+	email, id := emailFromContext(r.Context()), chi.URLParam(r, "leaseId")
+	exists, err := s.Cache.Exists(playbackKey(email, id))
+	if err == nil && !exists {
+		err = internals.NoPlaybackError
+	}
+	if streamID := chi.URLParam(r, "id"); err == nil && streamID != "" {
+		_, err = s.leaseFor(email, id, streamID)
+	}
+	if err == nil {
+		err = s.Cache.Del(playbackKey(email, id))
+	}
+	if err == internals.NoPlaybackError {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
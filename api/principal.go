@@ -0,0 +1,85 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"context"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+)
+
+//Who a request is made by, whether they signed in with a token or sent an
+//API key. The authentication middleware puts it in the request context.
+type Principal struct {
+	Email string
+	Role  string
+	//What the principal may do. A token gets its role's permissions and an
+	//API key the scopes it was made with that its owner's role still has.
+	Permissions []string
+	//Whether the login the token is from passed two-factor authentication
+	MFA bool
+	//The access token and its session, for principals that signed in
+	Token     *jwt.Token
+	SessionID string
+	//Id of the API key, for principals that sent one
+	APIKeyID string
+	//Plan of the user, which picks their rate limits
+	Plan string
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+//The principal the authentication middleware put in the context, or nil
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+//Principal for a verified access token. Tokens issued before roles existed
+//are treated as a viewer's and ones from before plans as the free plan's.
+func PrincipalFromToken(tkn *jwt.Token) *Principal {
+	claims, _ := tkn.Claims.(jwt.MapClaims)
+	p := &Principal{Role: RoleViewer, Plan: DefaultPlan, Token: tkn}
+	p.Email, _ = claims["email"].(string)
+	if role, _ := claims["role"].(string); role != "" {
+		p.Role = role
+	}
+	p.Permissions = rolePermissions[p.Role]
+	p.MFA, _ = claims["mfa"].(bool)
+	p.SessionID, _ = claims["sid"].(string)
+	if plan, _ := claims["plan"].(string); plan != "" {
+		p.Plan = plan
+	}
+	return p
+}
+
+//Reports whether the principal has a permission
+func (p *Principal) Can(permission string) bool {
+	for _, perm := range p.Permissions {
+		if perm == permission {
+			return true
+		}
+	}
+	return false
+}
+
+//Only lets requests through that were made with an access token. API keys
+//are for calling the API, not for managing the account they belong to.
+func RequireToken(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		p := PrincipalFromContext(r.Context())
+		if p == nil {
+			internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.TokenNotValidError)
+			return
+		}
+		if p.Token == nil {
+			internals.RespondAsErrorJson(w, http.StatusForbidden, internals.APIKeyNotAllowedError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+//What users see of their own account at /v1/me. It is kept apart from User
+//so the password hash can never end up in a response.
+type profile struct {
+	Email        string `json:"email"`
+	FirstName    string `json:"firstname"`
+	LastName     string `json:"lastname"`
+	Role         string `json:"role"`
+	Verified     bool   `json:"verified"`
+	MFA          bool   `json:"mfa"`
+	PendingEmail string `json:"pendingEmail,omitempty"`
+}
+
+func (u *User) profile() profile {
+	return profile{
+		Email:        u.Email,
+		FirstName:    u.FirstName,
+		LastName:     u.LastName,
+		Role:         u.role(),
+		Verified:     !u.Unverified,
+		MFA:          u.TOTPEnabled,
+		PendingEmail: u.PendingEmail,
+	}
+}
+
+//Looks up the user the request's token belongs to, responding with an error
+//and returning false when that fails
+func (u *UsersController) currentUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(ctx, emailFromContext(r.Context()))
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoUserError)
+		return user, false
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return user, false
+	}
+	return user, true
+}
+
+func respondWithProfile(w http.ResponseWriter, user User) {
+	res, _ := json.Marshal(user.profile())
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Returns the profile of the signed in user
+func (u *UsersController) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return
+	}
+	respondWithProfile(w, user)
+}
+
+//Applies a JSON merge patch to the signed in user's email, firstname and
+//lastname. A new email isn't used until it is verified with the link sent
+//to it, and setting the current one again cancels the change.
+func (u *UsersController) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	existing, _ := json.Marshal(user.profile())
+	patched, err := internals.MergePatch(existing, patch)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	var changes profile
+	if err := json.Unmarshal(patched, &changes); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	//the stored hash stands in for the password, which isn't being changed
+	updated := user
+	updated.Email, updated.FirstName, updated.LastName = changes.Email, changes.FirstName, changes.LastName
+	if errs := updated.validate(); len(errs) != 0 {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if updated.FirstName != user.FirstName || updated.LastName != user.LastName {
+		if err := u.users.UpdateName(ctx, user.Email, updated.FirstName, updated.LastName); err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+			return
+		}
+		user.FirstName, user.LastName = updated.FirstName, updated.LastName
+	}
+
+	pending := ""
+	if updated.Email != user.Email {
+		pending = updated.Email
+	}
+	if pending == user.PendingEmail {
+		respondWithProfile(w, user)
+		return
+	}
+	if pending != "" {
+		if _, err := u.users.FindByEmail(ctx, pending); err == nil {
+			internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DuplicateError)
+			return
+		} else if err != ErrNotFound {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+			return
+		}
+	}
+	if err := u.users.SetPendingEmail(ctx, user.Email, pending); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	user.PendingEmail = pending
+	if pending != "" {
+		if err := u.sendEmailChangeEmail(r.Context(), user, pending); err != nil {
+			u.Logger.Error("email change link to "+pending+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		}
+	}
+	respondWithProfile(w, user)
+}
+
+//Moves an account to the address an email change token was sent to. Every
+//token issued for the old address is revoked, so the user signs in again
+//with the new one.
+func (u *UsersController) changeEmail(w http.ResponseWriter, r *http.Request, token emailToken) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(ctx, token.Email)
+	if err == ErrNotFound || (err == nil && user.PendingEmail != token.NewEmail) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.EmailTokenError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	err = u.users.ChangeEmail(ctx, user.Email, token.NewEmail)
+	if err == ErrDuplicate {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DuplicateError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	if err := u.revokeAllTokens(user.Email); err != nil {
+		u.Logger.Error("revoking tokens of "+user.Email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+	for _, hook := range u.emailChangeHooks {
+		if err := hook(ctx, user.Email, token.NewEmail); err != nil {
+			u.Logger.Error("moving data of "+user.Email+" to "+token.NewEmail+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		}
+	}
+
+	u.Logger.Info("email of "+user.Email+" changed to "+token.NewEmail, zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusOK)
+}
+
+//Changes the signed in user's password once they give their current one.
+//Every other session is signed out and the caller gets new tokens.
+func (u *UsersController) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if err := validatePassword(body.NewPassword); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, []error{err})
+		return
+	}
+	user, ok := u.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if ok, _ := u.hasher.Verify(body.CurrentPassword, user.Password); !ok {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.CurrentPasswordError)
+		return
+	}
+	hash, err := u.hasher.Hash(body.NewPassword)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.PasswordHashError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := u.users.UpdatePassword(ctx, user.Email, hash); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	if err := u.revokeAllTokens(user.Email); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	refresh, session, err := u.startRefreshFamily(r, user.Email, mfaFromContext(r.Context()))
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	u.Logger.Info("password of "+user.Email+" was changed", zap.String("reqId", middleware.GetReqID(r.Context())))
+	u.respondWithTokens(w, r, user, session, refresh)
+}
@@ -0,0 +1,388 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Streams watched up to this share of their duration count as finished and
+//drop out of continue watching
+const finishedRatio = 0.95
+
+//How far a user got playing a stream, in seconds
+type Progress struct {
+	ID        string    `json:"-" bson:"_id"`
+	Email     string    `json:"-" bson:"email"`
+	StreamID  string    `json:"streamId" bson:"streamId"`
+	Position  float64   `json:"position" bson:"position"`
+	Duration  float64   `json:"duration" bson:"duration"`
+	Finished  bool      `json:"finished" bson:"finished"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+func progressID(email string, streamID string) string {
+	return email + ":" + streamID
+}
+
+//Progress is kept under the lowercased email, like sessions and playback leases
+func progressOwner(r *http.Request) string {
+	return strings.ToLower(emailFromContext(r.Context()))
+}
+
+func (p Progress) started() bool {
+	return p.Position > 0
+}
+
+//Struct to give progress endpoints access to where progress is stored, the
+//streams it is about, logging, and cache
+type ProgressController struct {
+	progress ProgressStore
+	streams  *StreamController
+	*config.Tools
+}
+
+func NewProgressController(progress ProgressStore, streams *StreamController, tools *config.Tools) *ProgressController {
+	return &ProgressController{progress: progress, streams: streams, Tools: tools}
+}
+
+//Players report progress every few seconds, so it is kept in the cache and
+//only written to mongo by Flush. Entries are kept under their user so
+//continue watching can find the ones that weren't flushed yet.
+const pendingProgressPrefix = "progress:"
+
+//Taken while progress is written to the store or moved to another user
+const progressFlushLock = "lock:progress-flush"
+
+//How long the flush lock is held before it expires on its own. A flush stops
+//writing early enough to release it before then, leaving the rest for the
+//next one.
+const progressFlushLockTTL = time.Minute
+
+func pendingProgressUserPrefix(email string) string {
+	return pendingProgressPrefix + email + ":"
+}
+
+func pendingProgressKey(email string, streamID string) string {
+	return pendingProgressUserPrefix(email) + streamID
+}
+
+//Reads progress that wasn't flushed yet from the cache keys given
+func (p *ProgressController) pendingProgress(keys []string) ([]Progress, error) {
+	var list []Progress
+	for _, key := range keys {
+		progress, _, err := p.readPendingProgress(key)
+		if err == cache.ErrMiss {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, progress)
+	}
+	return list, nil
+}
+
+//Reads the progress at a cache key, along with the document it was read from.
+//The email isn't in the document, so it is taken from the key.
+func (p *ProgressController) readPendingProgress(key string) (Progress, []byte, error) {
+	var progress Progress
+	doc, err := p.Cache.Get(key)
+	if err != nil {
+		return progress, nil, err
+	}
+	if err := json.Unmarshal(doc, &progress); err != nil || !strings.HasSuffix(key, ":"+progress.StreamID) {
+		//not something SaveProgress wrote, so there is nothing to keep
+		p.Cache.Del(key)
+		return progress, nil, cache.ErrMiss
+	}
+	progress.Email = strings.TrimSuffix(strings.TrimPrefix(key, pendingProgressPrefix), ":"+progress.StreamID)
+	return progress, doc, nil
+}
+
+//Records how far the signed in user got playing the stream in the url, from
+//{"position", "duration"} in seconds
+func (p *ProgressController) SaveProgress(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "streamId")
+	var body struct {
+		Position *float64 `json:"position"`
+		Duration *float64 `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if body.Position == nil || body.Duration == nil || *body.Duration <= 0 || *body.Position < 0 || *body.Position > *body.Duration {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidProgressError)
+		return
+	}
+	if _, err := p.streams.cachedStream(r.Context(), streamID); err != nil {
+		respondStreamError(w, err)
+		return
+	}
+
+	email := progressOwner(r)
+	progress := Progress{
+		Email:     email,
+		StreamID:  streamID,
+		Position:  *body.Position,
+		Duration:  *body.Duration,
+		Finished:  *body.Position >= *body.Duration*finishedRatio,
+		UpdatedAt: time.Now(),
+	}
+	doc, _ := json.Marshal(progress)
+	//kept well past the flush interval so a few failed flushes lose nothing
+	ttl := 10 * config.GetDuration("PROGRESS_FLUSH_INTERVAL", 30*time.Second)
+	if err := p.Cache.Set(pendingProgressKey(email, streamID), doc, ttl); err != nil {
+		p.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	res, _ := json.Marshal(progress)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Returns how far the signed in user got playing the stream in the url, to
+//resume it from there
+func (p *ProgressController) GetProgress(w http.ResponseWriter, r *http.Request) {
+	email := progressOwner(r)
+	streamID := chi.URLParam(r, "streamId")
+
+	pending, err := p.pendingProgress([]string{pendingProgressKey(email, streamID)})
+	if err != nil {
+		p.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	var progress Progress
+	if len(pending) > 0 {
+		progress = pending[0]
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		progress, err = p.progress.Get(ctx, email, streamID)
+		if err == ErrNotFound {
+			internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoProgressError)
+			return
+		} else if err != nil {
+			p.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+			return
+		}
+	}
+
+	res, _ := json.Marshal(progress)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Lists the streams the signed in user started but didn't finish, most
+//recently watched first, along with each stream. It takes a limit of 1 to
+//100 (default 20). Streams that were deleted are left out.
+func (p *ProgressController) ContinueWatching(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if l := r.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidLimitError)
+			return
+		}
+		limit = parsed
+	}
+	email := progressOwner(r)
+
+	keys, err := p.Cache.Keys(pendingProgressUserPrefix(email))
+	var pending []Progress
+	if err == nil {
+		pending, err = p.pendingProgress(keys)
+	}
+	if err != nil {
+		p.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	//pending progress can finish streams that are stored as unfinished, so
+	//enough are read to fill the page after those are dropped
+	stored, err := p.progress.ListUnfinished(ctx, email, limit+len(pending))
+	if err != nil {
+		p.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	latest := map[string]Progress{}
+	for _, progress := range append(stored, pending...) {
+		if current, ok := latest[progress.StreamID]; !ok || progress.UpdatedAt.After(current.UpdatedAt) {
+			latest[progress.StreamID] = progress
+		}
+	}
+	var unfinished []Progress
+	for _, progress := range latest {
+		if progress.started() && !progress.Finished {
+			unfinished = append(unfinished, progress)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].UpdatedAt.After(unfinished[j].UpdatedAt)
+	})
+
+	type watching struct {
+		Progress
+		Stream Stream `json:"stream"`
+	}
+	list := []watching{}
+	for _, progress := range unfinished {
+		if len(list) == limit {
+			break
+		}
+		stream, err := p.streams.cachedStream(r.Context(), progress.StreamID)
+		if err == internals.NoStreamError {
+			continue
+		} else if err != nil {
+			respondStreamError(w, err)
+			return
+		}
+		list = append(list, watching{Progress: progress, Stream: stream.forPrincipal(PrincipalFromContext(r.Context()))})
+	}
+
+	res, _ := json.Marshal(list)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Writes the progress waiting in the cache to the store and returns how much
+//was written. Instances take a lock in the cache so only one flushes at a
+//time; the others return 0. Progress reported again while it was being
+//written stays in the cache for the next flush.
+func (p *ProgressController) Flush(ctx context.Context) (int, error) {
+	lock, acquired, err := p.lockFlush()
+	if err != nil || !acquired {
+		return 0, err
+	}
+	defer p.unlockFlush(lock)
+	deadline := time.Now().Add(progressFlushLockTTL - 5*time.Second)
+
+	keys, err := p.Cache.Keys(pendingProgressPrefix)
+	if err != nil {
+		return 0, err
+	}
+	flushed := 0
+	for _, key := range keys {
+		if time.Now().After(deadline) {
+			break
+		}
+		progress, doc, err := p.readPendingProgress(key)
+		if err == cache.ErrMiss {
+			continue
+		} else if err != nil {
+			return flushed, err
+		}
+		saveCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = p.progress.Save(saveCtx, progress)
+		cancel()
+		if err != nil {
+			return flushed, err
+		}
+		flushed++
+		if _, err := p.Cache.DelIfEqual(key, doc); err != nil {
+			return flushed, err
+		}
+	}
+	return flushed, nil
+}
+
+//Takes the flush lock under a value of its own, so a holder whose lock expired
+//can't release the next holder's
+func (p *ProgressController) lockFlush() (string, bool, error) {
+	lock := uuid.New().String()
+	acquired, err := p.Cache.SetNX(progressFlushLock, []byte(lock), progressFlushLockTTL)
+	return lock, acquired, err
+}
+
+func (p *ProgressController) unlockFlush(lock string) {
+	if _, err := p.Cache.DelIfEqual(progressFlushLock, []byte(lock)); err != nil {
+		p.Logger.Error("releasing the progress flush lock failed: " + err.Error())
+	}
+}
+
+//Flushes progress every PROGRESS_FLUSH_INTERVAL (default 30s) until ctx is done
+func (p *ProgressController) FlushEvery(ctx context.Context) {
+	ticker := time.NewTicker(config.GetDuration("PROGRESS_FLUSH_INTERVAL", 30*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.flushAndLog(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *ProgressController) flushAndLog(ctx context.Context) {
+	if flushed, err := p.Flush(ctx); err != nil {
+		p.Logger.Error("flushing progress failed: " + err.Error())
+	} else if flushed > 0 {
+		p.Logger.Info("flushed progress of " + strconv.Itoa(flushed) + " streams")
+	}
+}
+
+//Moves a user's progress, flushed or not, to the email they changed theirs to.
+//It is registered with UsersController.OnEmailChange. It waits for a flush
+//that is running, which could otherwise store the old email's progress again
+//after it moved.
+func (p *ProgressController) ChangeOwner(ctx context.Context, email string, newEmail string) error {
+	email, newEmail = strings.ToLower(email), strings.ToLower(newEmail)
+	var lock string
+	for {
+		var acquired bool
+		var err error
+		lock, acquired, err = p.lockFlush()
+		if err != nil {
+			return err
+		} else if acquired {
+			break
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer p.unlockFlush(lock)
+
+	keys, err := p.Cache.Keys(pendingProgressUserPrefix(email))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		progress, doc, err := p.readPendingProgress(key)
+		if err == cache.ErrMiss {
+			continue
+		} else if err != nil {
+			return err
+		}
+		ttl, err := p.Cache.TTL(key)
+		if err != nil {
+			return err
+		} else if ttl <= 0 {
+			continue
+		}
+		if err := p.Cache.Set(pendingProgressKey(newEmail, progress.StreamID), doc, ttl); err != nil {
+			return err
+		}
+		p.Cache.Del(key)
+	}
+	return p.progress.ChangeOwner(ctx, email, newEmail)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+//ProgressStore kept in process memory, for tests and running without mongo
+type memoryProgressStore struct {
+	mu       sync.RWMutex
+	progress map[string]Progress
+}
+
+func NewMemoryProgressStore() ProgressStore {
+	return &memoryProgressStore{progress: map[string]Progress{}}
+}
+
+func (m *memoryProgressStore) Save(ctx context.Context, progress Progress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := progressID(progress.Email, progress.StreamID)
+	if stored, ok := m.progress[id]; ok && !stored.UpdatedAt.Before(progress.UpdatedAt) {
+		return nil
+	}
+	progress.ID = id
+	m.progress[id] = progress
+	return nil
+}
+
+func (m *memoryProgressStore) Get(ctx context.Context, email string, streamID string) (Progress, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	progress, ok := m.progress[progressID(email, streamID)]
+	if !ok {
+		return progress, ErrNotFound
+	}
+	return progress, nil
+}
+
+func (m *memoryProgressStore) ListUnfinished(ctx context.Context, email string, limit int) ([]Progress, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var list []Progress
+	for _, progress := range m.progress {
+		if progress.Email == email && progress.started() && !progress.Finished {
+			list = append(list, progress)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UpdatedAt.After(list[j].UpdatedAt)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (m *memoryProgressStore) ChangeOwner(ctx context.Context, email string, newEmail string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, progress := range m.progress {
+		if progress.Email != email {
+			continue
+		}
+		delete(m.progress, id)
+		progress.Email = newEmail
+		progress.ID = progressID(newEmail, progress.StreamID)
+		if stored, ok := m.progress[progress.ID]; !ok || stored.UpdatedAt.Before(progress.UpdatedAt) {
+			m.progress[progress.ID] = progress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+//ProgressStore backed by the mongo progress collection, which has an index on
+//email and updatedAt
+type mongoProgressStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoProgressStore(db *mongo.Database) ProgressStore {
+	return mongoProgressStore{collection: db.Collection("progress")}
+}
+
+func (m mongoProgressStore) Save(ctx context.Context, progress Progress) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	progress.ID = progressID(progress.Email, progress.StreamID)
+	//a document updated later doesn't match, so the upsert tries to insert
+	//its id again and fails, which leaves the newer progress in place
+	filter := bson.M{"_id": progress.ID, "updatedAt": bson.M{"$lt": progress.UpdatedAt}}
+	_, err := m.collection.ReplaceOne(ctx, filter, progress, options.Replace().SetUpsert(true))
+	if isDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+//Whether every write in err failed only because its key was taken
+func isDuplicateKeyError(err error) bool {
+	exception, ok := err.(mongo.WriteException)
+	if !ok || exception.WriteConcernError != nil || len(exception.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeError := range exception.WriteErrors {
+		if writeError.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m mongoProgressStore) Get(ctx context.Context, email string, streamID string) (Progress, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var progress Progress
+	err := m.collection.FindOne(ctx, bson.M{"_id": progressID(email, streamID)}).Decode(&progress)
+	if err == mongo.ErrNoDocuments {
+		return progress, ErrNotFound
+	}
+	return progress, err
+}
+
+func (m mongoProgressStore) ListUnfinished(ctx context.Context, email string, limit int) ([]Progress, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"email": email, "finished": false, "position": bson.M{"$gt": 0}}
+	opts := options.Find().SetSort(bson.M{"updatedAt": -1}).SetLimit(int64(limit))
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var list []Progress
+	for cur.Next(ctx) {
+		var progress Progress
+		if err := cur.Decode(&progress); err != nil {
+			return nil, err
+		}
+		list = append(list, progress)
+	}
+	return list, cur.Err()
+}
+
+//The id of each document has the email in it, so they are stored again under
+//the new email before the old ones are deleted
+func (m mongoProgressStore) ChangeOwner(ctx context.Context, email string, newEmail string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cur, err := m.collection.Find(ctx, bson.M{"email": email})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var progress Progress
+		if err := cur.Decode(&progress); err != nil {
+			return err
+		}
+		progress.Email = newEmail
+		if err := m.Save(ctx, progress); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	_, err = m.collection.DeleteMany(ctx, bson.M{"email": email})
+	return err
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Plan of users who haven't been given one
+const DefaultPlan = "free"
+
+//Plan rate limits for requests without a principal are looked up under
+const anonymousPlan = "anonymous"
+
+//How many requests fit in a window
+type Limit struct {
+	Requests int64
+	Window   time.Duration
+}
+
+//Reads a limit written as <requests>/<window>, e.g. 100/1m. "off" turns
+//limiting off, which is a zero Limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "off" {
+		return Limit{}, nil
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("rate limit %q is not <requests>/<window>", s)
+	}
+	requests, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || requests < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive number of requests", s)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil || window < time.Second {
+		return Limit{}, fmt.Errorf("rate limit %q needs a window of at least 1s", s)
+	}
+	return Limit{Requests: requests, Window: window}, nil
+}
+
+func (u *User) plan() string {
+	if u.Plan == "" {
+		return DefaultPlan
+	}
+	return u.Plan
+}
+
+type rateLimiter struct {
+	group string
+	//Limits of the plans that have their own, by the <PLAN> of their setting
+	plans map[string]Limit
+	//Limit of every other plan
+	limit Limit
+	tools *config.Tools
+}
+
+//Reads the limits of a route group once: RATE_LIMIT_<GROUP>_<PLAN> for each
+//plan that has one, and RATE_LIMIT_<GROUP> or fallback for the rest. Bad
+//settings are logged and skipped.
+func newRateLimiter(tools *config.Tools, group string, fallback Limit) *rateLimiter {
+	l := &rateLimiter{group: group, plans: map[string]Limit{}, limit: fallback, tools: tools}
+	env := "RATE_LIMIT_" + strings.ToUpper(group)
+	for _, setting := range os.Environ() {
+		parts := strings.SplitN(setting, "=", 2)
+		key := parts[0]
+		if len(parts) != 2 || parts[1] == "" || (key != env && !strings.HasPrefix(key, env+"_")) {
+			continue
+		}
+		limit, err := ParseLimit(parts[1])
+		if err != nil {
+			tools.Logger.Error(key + ": " + err.Error())
+		} else if key == env {
+			l.limit = limit
+		} else {
+			l.plans[strings.TrimPrefix(key, env+"_")] = limit
+		}
+	}
+	return l
+}
+
+func (l *rateLimiter) limitFor(plan string) Limit {
+	if limit, ok := l.plans[strings.ToUpper(strings.Replace(plan, "-", "_", -1))]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+//Limits how many requests each user, API key or, for requests without
+//either, IP makes to a group of routes, with a sliding window kept in the
+//cache. Limits are set per plan as described at newRateLimiter. Responses
+//carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers and
+//requests over the limit get a 429. After the authentication middleware it
+//tells principals apart; before it, it limits every request by IP, which
+//also counts the ones with made up credentials.
+func RateLimit(tools *config.Tools, group string, fallback Limit) func(next http.Handler) http.Handler {
+	l := newRateLimiter(tools, group, fallback)
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			id, plan := "ip:"+clientIP(r), anonymousPlan
+			if p := PrincipalFromContext(r.Context()); p != nil {
+				id, plan = "user:"+strings.ToLower(p.Email), p.Plan
+				if p.APIKeyID != "" {
+					id = "key:" + p.APIKeyID
+				}
+			}
+			limit := l.limitFor(plan)
+			if limit.Requests == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			remaining, reset, err := l.take(id, limit)
+			if err != nil {
+				//the limit is there to protect mongo, so a cache outage
+				//shouldn't take the API down with it
+				tools.Logger.Error("rate limiting failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+				next.ServeHTTP(w, r)
+				return
+			}
+			setRateLimitHeaders(w, limit, remaining, reset)
+			if remaining < 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(reset/time.Second), 10))
+				internals.RespondAsErrorJson(w, http.StatusTooManyRequests, internals.RateLimitError)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+//Counts a request in the current window and estimates how many requests
+//are left, weighing the previous window by how much of it still overlaps
+//the sliding window. A negative count means the request is over the limit.
+//It also returns how long until the current window ends.
+func (l *rateLimiter) take(id string, limit Limit) (int64, time.Duration, error) {
+	now := time.Now()
+	window := now.UnixNano() / int64(limit.Window)
+	key := func(window int64) string {
+		return fmt.Sprintf("ratelimit:%s:%s:%d", l.group, id, window)
+	}
+
+	current, err := l.tools.Cache.Incr(key(window), 2*limit.Window)
+	if err != nil {
+		return 0, 0, err
+	}
+	var previous int64
+	if doc, err := l.tools.Cache.Get(key(window - 1)); err == nil {
+		previous, _ = strconv.ParseInt(string(doc), 10, 64)
+	}
+
+	elapsed := time.Duration(now.UnixNano() - window*int64(limit.Window))
+	overlap := float64(limit.Window-elapsed) / float64(limit.Window)
+	used := current + int64(float64(previous)*overlap)
+	reset := limit.Window - elapsed
+	if reset < time.Second {
+		reset = time.Second
+	}
+	return limit.Requests - used, reset, nil
+}
+
+//Sets the RateLimit headers, keeping the ones of an earlier limiter on the
+//same request if it has fewer requests left
+func setRateLimitHeaders(w http.ResponseWriter, limit Limit, remaining int64, reset time.Duration) {
+	if earlier, err := strconv.ParseInt(w.Header().Get("RateLimit-Remaining"), 10, 64); err == nil && earlier <= remaining {
+		return
+	}
+	if remaining < 0 {
+		remaining = 0
+	}
+	w.Header().Set("RateLimit-Limit", strconv.FormatInt(limit.Requests, 10))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(int64((reset+time.Second-1)/time.Second), 10))
+}
+
+//Changes the plan of the user in the url to the one in the request body,
+//which picks their rate limits. Tokens carry the plan, so it applies once
+//the user's token is refreshed; their API keys get it at once.
+func (u *UsersController) UpdatePlan(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+	var body struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if !regexp.MustCompile(`^[a-z0-9][a-z0-9\-]{0,31}$`).MatchString(body.Plan) || body.Plan == anonymousPlan {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidPlanError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := u.users.UpdatePlan(ctx, email, body.Plan)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoUserError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	u.Logger.Info("plan of "+email+" changed to "+body.Plan+" by "+emailFromContext(r.Context()),
+		zap.String("reqId", middleware.GetReqID(r.Context())))
+	res, _ := json.Marshal(map[string]string{"email": email, "plan": body.Plan})
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
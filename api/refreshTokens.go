@@ -0,0 +1,188 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+//What is kept server-side for a refresh token. Every token issued by
+//rotating another one shares its Family, which is the id of the session
+//that gets revoked.
+type refreshSession struct {
+	Family    string    `json:"family"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	//Token version of the user when the family was started
+	Version int64 `json:"version"`
+	//Whether the login that started the family passed two-factor authentication
+	MFA bool `json:"mfa,omitempty"`
+}
+
+//Tokens returned by /login and /token/refresh. The access token is also
+//sent in the Authorization header.
+type tokenResponse struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+//Refresh tokens are only kept hashed so a cache dump can't be replayed
+func refreshKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "refresh:" + hex.EncodeToString(sum[:])
+}
+
+func refreshUsedKey(token string) string {
+	return refreshKey(token) + ":used"
+}
+
+//Refresh tokens last for REFRESH_TOKEN_TTL (default 720h) from the login that
+//started their family. Rotating a token doesn't extend it.
+func refreshTTL() time.Duration {
+	return config.GetDuration("REFRESH_TOKEN_TTL", 720*time.Hour)
+}
+
+//Starts a new session and refresh token family for a login, which passed
+//two-factor authentication when mfa is set
+func (u *UsersController) startRefreshFamily(r *http.Request, email string, mfa bool) (string, refreshSession, error) {
+	family, err := uuid.NewRandom()
+	if err != nil {
+		return "", refreshSession{}, err
+	}
+	version, err := tokenVersion(u.Cache, email)
+	if err != nil {
+		return "", refreshSession{}, err
+	}
+	session := refreshSession{Family: family.String(), Email: email, ExpiresAt: time.Now().Add(refreshTTL()), Version: version, MFA: mfa}
+	if err := u.recordSession(r, email, session); err != nil {
+		return "", session, err
+	}
+	token, err := u.issueRefreshToken(session)
+	return token, session, err
+}
+
+//Stores a new opaque refresh token for a session
+func (u *UsersController) issueRefreshToken(session refreshSession) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	doc, _ := json.Marshal(session)
+	if err := u.Cache.Set(refreshKey(token), doc, time.Until(session.ExpiresAt)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//Swaps a refresh token for a new one in the same family. Unknown, expired
+//and revoked tokens give internals.RefreshTokenError. A token can only be
+//swapped once: presenting it again means it leaked, so its whole family is
+//revoked and every token in it stops working.
+func (u *UsersController) rotateRefreshToken(ctx context.Context, token string) (string, refreshSession, error) {
+	var session refreshSession
+	doc, err := u.Cache.Get(refreshKey(token))
+	if err == cache.ErrMiss {
+		return "", session, internals.RefreshTokenError
+	} else if err != nil {
+		return "", session, err
+	}
+	if err := json.Unmarshal(doc, &session); err != nil {
+		return "", session, internals.RefreshTokenError
+	}
+
+	active, err := u.Cache.Exists(sessionKey(session.Email, session.Family))
+	if err != nil {
+		return "", session, err
+	} else if !active {
+		return "", session, internals.RefreshTokenError
+	}
+	version, err := tokenVersion(u.Cache, session.Email)
+	if err != nil {
+		return "", session, err
+	} else if version != session.Version {
+		return "", session, internals.RefreshTokenError
+	}
+
+	first, err := u.Cache.SetNX(refreshUsedKey(token), []byte("true"), time.Until(session.ExpiresAt))
+	if err != nil {
+		return "", session, err
+	} else if !first {
+		u.Logger.Warn("refresh token reused, revoking its family for "+session.Email, zap.String("reqId", middleware.GetReqID(ctx)))
+		if err := u.revokeSession(session.Email, session.Family); err != nil {
+			return "", session, err
+		}
+		return "", session, internals.RefreshTokenError
+	}
+
+	next, err := u.issueRefreshToken(session)
+	if err != nil {
+		return "", session, err
+	}
+	return next, session, u.touchSession(session.Email, session.Family)
+}
+
+//Issues an access token and a new refresh token for a refresh token from
+///login or an earlier refresh
+func (u *UsersController) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	refresh, session, err := u.rotateRefreshToken(r.Context(), body.RefreshToken)
+	if err == internals.RefreshTokenError {
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, err)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	user, err := u.users.FindByEmail(ctx, session.Email)
+	if err == ErrNotFound {
+		u.revokeSession(session.Email, session.Family)
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.RefreshTokenError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	u.respondWithTokens(w, r, user, session, refresh)
+}
+
+//Sends a new access token in the Authorization header and body along with
+//the refresh token that goes with it
+func (u *UsersController) respondWithTokens(w http.ResponseWriter, r *http.Request, user User, session refreshSession, refresh string) {
+	access, err := u.generateToken(user, session)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+		return
+	}
+	w.Header().Set("Authorization", "Bearer "+access)
+
+	body, _ := json.Marshal(tokenResponse{AccessToken: access, RefreshToken: refresh, ExpiresIn: int64(accessTokenTTL / time.Second)})
+	internals.RespondAsJson(w, body, http.StatusOK)
+}
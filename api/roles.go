@@ -0,0 +1,183 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Roles a user can have, from least to most access
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+//Things a role can be allowed to do
+const (
+	PermStreamsRead  = "streams:read"
+	PermStreamsWrite = "streams:write"
+	PermUsersManage  = "users:manage"
+	PermMetricsRead  = "metrics:read"
+)
+
+var rolePermissions = map[string][]string{
+	RoleViewer: {PermStreamsRead},
+	RoleEditor: {PermStreamsRead, PermStreamsWrite},
+	RoleAdmin:  {PermStreamsRead, PermStreamsWrite, PermUsersManage, PermMetricsRead},
+}
+
+func isRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+//Reports whether a role has a permission
+func Can(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+//Users stored before roles existed have none and are viewers
+func (u *User) role() string {
+	if u.Role == "" {
+		return RoleViewer
+	}
+	return u.Role
+}
+
+//Only lets requests through from a signed in user with one of roles. API
+//keys are refused since they only carry scopes. It has to come after the
+//authentication middleware.
+func RequireRole(roles ...string) func(next http.Handler) http.Handler {
+	return requirePrincipal(func(p *Principal) bool {
+		for _, r := range roles {
+			if r == p.Role && p.APIKeyID == "" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+//Only lets requests through whose principal has permission. It has to come
+//after the authentication middleware.
+func RequirePermission(permission string) func(next http.Handler) http.Handler {
+	return requirePrincipal(func(p *Principal) bool {
+		return p.Can(permission)
+	})
+}
+
+func requirePrincipal(allowed func(p *Principal) bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			p := PrincipalFromContext(r.Context())
+			if p == nil {
+				internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.TokenNotValidError)
+				return
+			}
+			if !allowed(p) {
+				internals.RespondAsErrorJson(w, http.StatusForbidden, internals.ForbiddenError)
+				return
+			}
+			//API keys can only be made by users who could use the permissions themselves
+			if p.APIKeyID == "" && mfaRequiredFor(p.Role) && !p.MFA {
+				internals.RespondAsErrorJson(w, http.StatusForbidden, internals.MFARequiredError)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+//Changes the role of the user in the url to the one in the request body.
+//Only admins can reach it and they can't take away their own admin role,
+//so there is always one left. The user's tokens carry the old role, so they
+//are all revoked.
+func (u *UsersController) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	email := chi.URLParam(r, "email")
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	if !isRole(body.Role) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidRoleError)
+		return
+	}
+	if strings.EqualFold(email, emailFromContext(r.Context())) && body.Role != RoleAdmin {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.OwnAdminRoleError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := u.users.UpdateRole(ctx, email, body.Role)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoUserError)
+		return
+	} else if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+	if err := u.revokeAllTokens(email); err != nil {
+		u.Logger.Error("revoking tokens of "+email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+
+	u.Logger.Info("role of "+email+" changed to "+body.Role+" by "+emailFromContext(r.Context()),
+		zap.String("reqId", middleware.GetReqID(r.Context())))
+	res, _ := json.Marshal(map[string]string{"email": email, "role": body.Role})
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Email of the principal the authentication middleware put in the request context
+func emailFromContext(ctx context.Context) string {
+	if p := PrincipalFromContext(ctx); p != nil {
+		return p.Email
+	}
+	return ""
+}
+
+//Makes the user with email an admin, creating them with password when they
+//don't exist yet. It is run from the command line to set up the first admin,
+//who can then give out roles through the API.
+func (u *UsersController) BootstrapAdmin(ctx context.Context, email string, password string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	err := u.users.UpdateRole(ctx, email, RoleAdmin)
+	if err != ErrNotFound {
+		return false, err
+	}
+
+	admin := User{Email: email, FirstName: "Admin", LastName: "User", Password: password, Role: RoleAdmin}
+	if errs := admin.validate(); len(errs) != 0 {
+		return false, errs[0]
+	}
+	if admin.Password, err = u.hasher.Hash(password); err != nil {
+		return false, err
+	}
+	if err := u.users.Create(ctx, admin); err != nil {
+		if err == ErrDuplicate {
+			return false, errors.New(email + " was created while it was being bootstrapped")
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//A signed in device. Every access and refresh token issued from one login
+//belongs to the same session, whose id is their sid claim and their refresh
+//token family. Revoking the session revokes all of them.
+type session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	//Whether this is the session making the request, only set when listing
+	Current bool `json:"current"`
+}
+
+//Sessions are kept under their user so they can be listed and revoked together
+func sessionsPrefix(email string) string {
+	return "sessions:" + strings.ToLower(email) + ":"
+}
+
+func sessionKey(email string, id string) string {
+	return sessionsPrefix(email) + id
+}
+
+//Records the session a login starts, along with the device it came from
+func (u *UsersController) recordSession(r *http.Request, email string, refresh refreshSession) error {
+	now := time.Now()
+	doc, _ := json.Marshal(session{
+		ID:         refresh.Family,
+		UserAgent:  r.UserAgent(),
+		IP:         clientIP(r),
+		IssuedAt:   now,
+		LastUsedAt: now,
+		ExpiresAt:  refresh.ExpiresAt,
+	})
+	return u.Cache.Set(sessionKey(email, refresh.Family), doc, time.Until(refresh.ExpiresAt))
+}
+
+//Marks a session as used now, when its refresh token is rotated
+func (u *UsersController) touchSession(email string, id string) error {
+	doc, err := u.Cache.Get(sessionKey(email, id))
+	if err == cache.ErrMiss {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var s session
+	if err := json.Unmarshal(doc, &s); err != nil {
+		return err
+	}
+	s.LastUsedAt = time.Now()
+	doc, _ = json.Marshal(s)
+	return u.Cache.Set(sessionKey(email, id), doc, time.Until(s.ExpiresAt))
+}
+
+func (u *UsersController) revokeSession(email string, id string) error {
+	return u.Cache.Del(sessionKey(email, id))
+}
+
+//Reports whether a verified access token is still good: its jti isn't
+//blacklisted, its user's tokens haven't been revoked since it was issued and
+//its session hasn't been signed out. Tokens from before sessions existed
+//have no sid and only go by the first two.
+func IsTokenActive(tools *config.Tools, tkn *jwt.Token) (bool, error) {
+	claims, ok := tkn.Claims.(jwt.MapClaims)
+	if !ok {
+		return false, nil
+	}
+	email, _ := claims["email"].(string)
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+
+	if revoked, err := tools.Blacklist.IsRevoked(jti); err != nil || revoked {
+		return false, err
+	}
+	if current, err := isCurrentTokenVersion(tools.Cache, claims); err != nil || !current {
+		return false, err
+	}
+	if sid == "" {
+		return true, nil
+	}
+	return tools.Cache.Exists(sessionKey(email, sid))
+}
+
+//Session of the token the authentication middleware put in the request context
+func sessionFromContext(ctx context.Context) string {
+	if p := PrincipalFromContext(ctx); p != nil {
+		return p.SessionID
+	}
+	return ""
+}
+
+//Lists the signed in user's sessions, most recently used first
+func (u *UsersController) ListSessions(w http.ResponseWriter, r *http.Request) {
+	email := emailFromContext(r.Context())
+	keys, err := u.Cache.Keys(sessionsPrefix(email))
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	sessions := []session{}
+	for _, key := range keys {
+		doc, err := u.Cache.Get(key)
+		if err == cache.ErrMiss {
+			continue
+		} else if err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+			return
+		}
+		var s session
+		if err := json.Unmarshal(doc, &s); err != nil {
+			continue
+		}
+		s.Current = s.ID == sessionFromContext(r.Context())
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	res, _ := json.Marshal(sessions)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Signs out one of the signed in user's sessions
+func (u *UsersController) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	email := emailFromContext(r.Context())
+	id := chi.URLParam(r, "id")
+
+	exists, err := u.Cache.Exists(sessionKey(email, id))
+	if err == nil && exists {
+		err = u.revokeSession(email, id)
+	}
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	} else if !exists {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoSessionError)
+		return
+	}
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
+
+//Signs out every session of the signed in user, including the one making the request
+func (u *UsersController) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	email := emailFromContext(r.Context())
+	if err := u.revokeAllTokens(email); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+	u.Logger.Info("every session of "+email+" was signed out", zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
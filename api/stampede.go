@@ -0,0 +1,93 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"context"
+	"expvar"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"time"
+)
+
+//Counters for cache misses published at /debug/vars
+//  stream_fetches, ads_fetches - calls made to mongo and the ad server
+//  stream_coalesced, ads_coalesced - requests that waited on another's call
+//  lock_waits - loads that waited on another instance holding the lock
+//  lock_timeouts - waits that gave up and loaded anyway
+var cacheMetrics = expvar.NewMap("streamCache")
+
+//How often a load waiting on another instance's lock checks the cache
+const lockPollInterval = 25 * time.Millisecond
+
+//Loads a cached value that is missing. Requests in this process for the same
+//key share one call to load. With CACHE_LOCK_TTL set, instances also take a
+//short lock in redis so only one of them calls load while the others wait
+//for read to find what it cached. The shared call runs on a context of its
+//own so a client that goes away doesn't fail the others waiting on it; each
+//request only stops waiting when its own context is done.
+func (s *StreamController) loadOnce(ctx context.Context, kind string, key string,
+	read func(context.Context) (interface{}, bool), load func(context.Context) (interface{}, error)) (interface{}, error) {
+	leader := false
+	ch := s.flight.DoChan(key, func() (interface{}, error) {
+		leader = true
+		shared, cancel := context.WithTimeout(detachedContext(ctx), sharedLoadTimeout)
+		defer cancel()
+		return s.loadLocked(shared, key, read, load)
+	})
+	select {
+	case res := <-ch:
+		if !leader {
+			cacheMetrics.Add(kind+"_coalesced", 1)
+		}
+		return res.Val, res.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//How long a load shared by several requests may take
+const sharedLoadTimeout = 30 * time.Second
+
+//Context that keeps the request id of ctx but not its cancellation, for work
+//that outlives the request
+func detachedContext(ctx context.Context) context.Context {
+	return context.WithValue(context.Background(), middleware.RequestIDKey, middleware.GetReqID(ctx))
+}
+
+func (s *StreamController) loadLocked(ctx context.Context, key string,
+	read func(context.Context) (interface{}, bool), load func(context.Context) (interface{}, error)) (interface{}, error) {
+	lockTTL := config.GetDuration("CACHE_LOCK_TTL", 0)
+	if lockTTL <= 0 {
+		return load(ctx)
+	}
+
+	lockKey := "lock:" + key
+	reqId := middleware.GetReqID(ctx)
+	acquired, err := s.Cache.SetNX(lockKey, []byte(reqId), lockTTL)
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", reqId))
+		return load(ctx)
+	}
+	if acquired {
+		//a load that outlives the lock must not release the next holder's lock
+		defer s.Cache.DelIfEqual(lockKey, []byte(reqId))
+		return load(ctx)
+	}
+
+	cacheMetrics.Add("lock_waits", 1)
+	deadline := time.Now().Add(lockTTL)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if v, ok := read(ctx); ok {
+			return v, nil
+		}
+	}
+
+	//the instance holding the lock didn't cache anything in time
+	cacheMetrics.Add("lock_timeouts", 1)
+	return load(ctx)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+//Returned by stores when a document doesn't exist
+var ErrNotFound = errors.New("document not found")
+
+//Returned by stores when a document's id or unique field is already taken
+var ErrDuplicate = errors.New("document already exists")
+
+//Storage for stream documents
+type StreamStore interface {
+	Get(ctx context.Context, id string) (Stream, error)
+	//Gets the streams with any of ids in no particular order, leaving out the
+	//ones that don't exist
+	GetMany(ctx context.Context, ids []string) ([]Stream, error)
+	//Lists every stream id
+	IDs(ctx context.Context) ([]string, error)
+	//Lists up to opts.Limit+1 streams matching opts in sort order so callers
+	//can tell whether there is another page
+	List(ctx context.Context, opts ListOptions) ([]Stream, error)
+	Create(ctx context.Context, stream Stream) error
+	Replace(ctx context.Context, stream Stream) error
+	Delete(ctx context.Context, id string) error
+}
+
+//Storage for user accounts, keyed by email
+type UserStore interface {
+	Create(ctx context.Context, user User) error
+	FindByEmail(ctx context.Context, email string) (User, error)
+	//Replaces the stored password hash of the user with email
+	UpdatePassword(ctx context.Context, email string, hash string) error
+	UpdateRole(ctx context.Context, email string, role string) error
+	UpdatePlan(ctx context.Context, email string, plan string) error
+	//Clears the Unverified flag of the user with email
+	MarkVerified(ctx context.Context, email string) error
+	UpdateName(ctx context.Context, email string, firstName string, lastName string) error
+	//Records the address the user with email asked to change to, or clears it
+	SetPendingEmail(ctx context.Context, email string, pending string) error
+	//Moves the user with email to newEmail, which has been verified, and
+	//clears their pending email. A taken newEmail gives ErrDuplicate.
+	ChangeEmail(ctx context.Context, email string, newEmail string) error
+	//Finds the user an identity provider account is linked to
+	FindByIdentity(ctx context.Context, identity Identity) (User, error)
+	//Links an identity provider account to the user with email
+	LinkIdentity(ctx context.Context, email string, identity Identity) error
+	//Replaces the TOTP secret, whether it is enabled and the recovery code
+	//hashes of the user with email
+	SetTOTP(ctx context.Context, email string, secret string, enabled bool, recoveryCodes []string) error
+	//Removes a recovery code hash from the user with email, giving
+	//ErrNotFound when they don't have it
+	UseRecoveryCode(ctx context.Context, email string, hash string) error
+}
+
+//Storage for API keys, keyed by id
+type APIKeyStore interface {
+	Create(ctx context.Context, key APIKey) error
+	Get(ctx context.Context, id string) (APIKey, error)
+	//Lists the keys of the user with owner as their email, oldest first
+	List(ctx context.Context, owner string) ([]APIKey, error)
+	Replace(ctx context.Context, key APIKey) error
+	Delete(ctx context.Context, id string) error
+	//Gives every key of owner to newOwner, when the owner's email changes
+	ChangeOwner(ctx context.Context, owner string, newOwner string) error
+}
+
+//Storage for how far users got playing streams, keyed by user and stream
+type ProgressStore interface {
+	//Stores progress unless what is stored for its user and stream was
+	//updated after it
+	Save(ctx context.Context, progress Progress) error
+	Get(ctx context.Context, email string, streamID string) (Progress, error)
+	//Lists up to limit streams the user with email started but didn't
+	//finish, most recently watched first
+	ListUnfinished(ctx context.Context, email string, limit int) ([]Progress, error)
+	//Moves the progress of email to newEmail, when the user's email changes
+	ChangeOwner(ctx context.Context, email string, newEmail string) error
+}
+
+//Storage for watchlists, keyed by their owner and id
+type WatchlistStore interface {
+	Create(ctx context.Context, list Watchlist) error
+	Get(ctx context.Context, owner string, id string) (Watchlist, error)
+	//Lists the watchlists of the user with owner as their email, oldest first
+	List(ctx context.Context, owner string) ([]Watchlist, error)
+	Replace(ctx context.Context, list Watchlist) error
+	Delete(ctx context.Context, owner string, id string) error
+	//Gives every list of owner to newOwner, when the owner's email changes
+	ChangeOwner(ctx context.Context, owner string, newOwner string) error
+}
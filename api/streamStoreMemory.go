@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//StreamStore kept in process memory, for tests and running without mongo.
+//Streams are copied in and out through bson like they are with mongo.
+type memoryStreamStore struct {
+	mu      sync.RWMutex
+	streams map[string][]byte
+}
+
+func NewMemoryStreamStore(streams ...Stream) StreamStore {
+	m := &memoryStreamStore{streams: map[string][]byte{}}
+	for _, stream := range streams {
+		m.Create(context.Background(), stream)
+	}
+	return m
+}
+
+func (m *memoryStreamStore) Get(ctx context.Context, id string) (Stream, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stream Stream
+	doc, ok := m.streams[id]
+	if !ok {
+		return stream, ErrNotFound
+	}
+	err := bson.Unmarshal(doc, &stream)
+	return stream, err
+}
+
+func (m *memoryStreamStore) GetMany(ctx context.Context, ids []string) ([]Stream, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var streams []Stream
+	for _, id := range ids {
+		doc, ok := m.streams[id]
+		if !ok {
+			continue
+		}
+		var stream Stream
+		if err := bson.Unmarshal(doc, &stream); err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+func (m *memoryStreamStore) IDs(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var ids []string
+	for id := range m.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (m *memoryStreamStore) List(ctx context.Context, opts ListOptions) ([]Stream, error) {
+	m.mu.RLock()
+	var all []Stream
+	for _, doc := range m.streams {
+		var stream Stream
+		if err := bson.Unmarshal(doc, &stream); err != nil {
+			m.mu.RUnlock()
+			return nil, err
+		}
+		all = append(all, stream)
+	}
+	m.mu.RUnlock()
+
+	host := hostMatcher(opts.Host)
+	var streams []Stream
+	for _, stream := range all {
+		if opts.matches(stream, host) {
+			streams = append(streams, stream)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return opts.compare(streams[i], streams[j]) < 0 })
+
+	if int64(len(streams)) > opts.Limit+1 {
+		streams = streams[:opts.Limit+1]
+	}
+	return streams, nil
+}
+
+func (m *memoryStreamStore) Create(ctx context.Context, stream Stream) error {
+	doc, err := bson.Marshal(stream)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.streams[stream.ID]; ok {
+		return ErrDuplicate
+	}
+	m.streams[stream.ID] = doc
+	return nil
+}
+
+func (m *memoryStreamStore) Replace(ctx context.Context, stream Stream) error {
+	doc, err := bson.Marshal(stream)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.streams[stream.ID]; !ok {
+		return ErrNotFound
+	}
+	m.streams[stream.ID] = doc
+	return nil
+}
+
+func (m *memoryStreamStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.streams[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.streams, id)
+	return nil
+}
+
+//Matches stream urls served from host the same way mongoFilter does
+func hostMatcher(host string) *regexp.Regexp {
+	if host == "" {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)^https?://` + regexp.QuoteMeta(host) + `(:[0-9]+)?(/|$)`)
+}
+
+//Applies the filters and cursor position of o to a single stream
+func (o ListOptions) matches(stream Stream, host *regexp.Regexp) bool {
+	formats := captionFormats
+	if o.Captions != "" {
+		formats = []string{o.Captions}
+	}
+	if o.Lang != "" {
+		found := false
+		for _, format := range formats {
+			if _, ok := stream.Captions.byFormat(format)[o.Lang]; ok {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	} else if o.Captions != "" && len(stream.Captions.byFormat(o.Captions)) == 0 {
+		return false
+	}
+
+	if host != nil && !host.MatchString(stream.StreamURL) {
+		return false
+	}
+
+	if o.Cursor != nil {
+		last := Stream{ID: o.Cursor.ID, StreamURL: o.Cursor.Value}
+		if o.compare(stream, last) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Orders streams by the sort field and then by id, in the sort's direction
+func (o ListOptions) compare(a Stream, b Stream) int {
+	c := 0
+	if sortFields[strings.TrimPrefix(o.Sort, "-")] == "streamUrl" {
+		c = strings.Compare(a.StreamURL, b.StreamURL)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if strings.HasPrefix(o.Sort, "-") {
+		return -c
+	}
+	return c
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//StreamStore backed by the mongo streams collection
+type mongoStreamStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoStreamStore(db *mongo.Database) StreamStore {
+	return mongoStreamStore{collection: db.Collection("streams")}
+}
+
+func (m mongoStreamStore) Get(ctx context.Context, id string) (Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var stream Stream
+	err := m.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&stream)
+	if err == mongo.ErrNoDocuments {
+		return stream, ErrNotFound
+	}
+	return stream, err
+}
+
+func (m mongoStreamStore) GetMany(ctx context.Context, ids []string) ([]Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cur, err := m.collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var streams []Stream
+	for cur.Next(ctx) {
+		var stream Stream
+		if err := cur.Decode(&stream); err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, cur.Err()
+}
+
+func (m mongoStreamStore) IDs(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	results, err := m.collection.Distinct(ctx, "_id", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, res := range results {
+		ids = append(ids, res.(string))
+	}
+	return ids, nil
+}
+
+func (m mongoStreamStore) List(ctx context.Context, opts ListOptions) ([]Stream, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	findOpts := options.Find().
+		SetSort(mongoSort(opts)).
+		SetLimit(opts.Limit + 1).
+		SetProjection(bson.M{"_id": 1, "streamUrl": 1})
+	cur, err := m.collection.Find(ctx, mongoFilter(opts), findOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var streams []Stream
+	for cur.Next(ctx) {
+		var stream Stream
+		if err := cur.Decode(&stream); err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, cur.Err()
+}
+
+func (m mongoStreamStore) Create(ctx context.Context, stream Stream) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.collection.InsertOne(ctx, stream)
+	if _, ok := err.(mongo.WriteException); ok {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoStreamStore) Replace(ctx context.Context, stream Stream) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.ReplaceOne(ctx, bson.M{"_id": stream.ID}, stream)
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m mongoStreamStore) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	} else if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Builds the mongo filter for the requested filters and the cursor position
+func mongoFilter(o ListOptions) bson.M {
+	var and []bson.M
+
+	formats := captionFormats
+	if o.Captions != "" {
+		formats = []string{o.Captions}
+	}
+	if o.Lang != "" {
+		var or []bson.M
+		for _, format := range formats {
+			or = append(or, bson.M{"captions." + format + "." + o.Lang: bson.M{"$exists": true}})
+		}
+		and = append(and, bson.M{"$or": or})
+	} else if o.Captions != "" {
+		and = append(and, bson.M{"captions." + o.Captions: bson.M{"$exists": true, "$ne": bson.M{}}})
+	}
+
+	if o.Host != "" {
+		pattern := `^https?://` + regexp.QuoteMeta(o.Host) + `(:[0-9]+)?(/|$)`
+		and = append(and, bson.M{"streamUrl": primitive.Regex{Pattern: pattern, Options: "i"}})
+	}
+
+	if o.Cursor != nil {
+		op := "$gt"
+		if strings.HasPrefix(o.Sort, "-") {
+			op = "$lt"
+		}
+		field := sortFields[strings.TrimPrefix(o.Sort, "-")]
+		if field == "_id" {
+			and = append(and, bson.M{"_id": bson.M{op: o.Cursor.ID}})
+		} else {
+			and = append(and, bson.M{"$or": []bson.M{
+				{field: bson.M{op: o.Cursor.Value}},
+				{field: o.Cursor.Value, "_id": bson.M{op: o.Cursor.ID}},
+			}})
+		}
+	}
+
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+func mongoSort(o ListOptions) bson.D {
+	dir := 1
+	if strings.HasPrefix(o.Sort, "-") {
+		dir = -1
+	}
+	field := sortFields[strings.TrimPrefix(o.Sort, "-")]
+	if field == "_id" {
+		return bson.D{{Key: "_id", Value: dir}}
+	}
+	return bson.D{{Key: field, Value: dir}, {Key: "_id", Value: dir}}
+}
@@ -1,63 +1,71 @@
 package api
 
 import (
+	"DiscoveryStreams/ads"
 	"DiscoveryStreams/config"
 	"DiscoveryStreams/internals"
 	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/go-redis/redis"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 )
 
 //Struct to hold Stream data that's set to return to client
 type Stream struct {
-	ID        string `json:"id" bson:"_id"`
-	StreamURL string `json:"streamUrl" bson:"streamUrl"`
-	Captions  struct {
-		Vtt struct {
-			En string `json:"en" bson:"en"`
-		} `json:"vtt" bson:"vtt"`
-		Scc struct {
-			En string `json:"en" bson:"en"`
-		} `json:"scc" bson:"scc"`
-	} `json:"captions" bson:"captions"`
-	Ads json.RawMessage `json:"ads"`
+	ID        string          `json:"id" bson:"_id"`
+	StreamURL string          `json:"streamUrl,omitempty" bson:"streamUrl"`
+	Captions  Captions        `json:"captions" bson:"captions"`
+	Ads       json.RawMessage `json:"ads,omitempty" bson:"-"`
+	//Set to the fallback used when the ad server couldn't be reached
+	AdsDegraded string `json:"adsDegraded,omitempty" bson:"-"`
 }
 
 //Struct to give Stream API endpoints
-//access to mongo, logging, and cache
+//access to the stream store, logging, and cache
 type StreamController struct {
-	streamCollection *mongo.Collection
+	streams     StreamStore
+	adsClient   *ads.Client
+	adsFallback string
+	flight      singleflight.Group
 	*config.Tools
 }
 
-func NewStreamController(mongo *mongo.Database, tools *config.Tools) *StreamController {
-	collection := mongo.Collection("streams")
+func NewStreamController(streams StreamStore, tools *config.Tools) *StreamController {
 	return &StreamController{
-		streamCollection: collection,
-		Tools:            tools,
+		streams: streams,
+		adsClient: ads.NewClient(os.Getenv("ADS_URL"), ads.Options{
+			Timeout:          config.GetDuration("ADS_TIMEOUT", 3*time.Second),
+			Retries:          config.GetInt("ADS_RETRIES", 2),
+			Backoff:          config.GetDuration("ADS_RETRY_BACKOFF", 100*time.Millisecond),
+			FailureThreshold: config.GetInt("ADS_BREAKER_FAILURES", 5),
+			Cooldown:         config.GetDuration("ADS_BREAKER_COOLDOWN", 30*time.Second),
+		}),
+		adsFallback: os.Getenv("ADS_FALLBACK"),
+		Tools:       tools,
 	}
 }
 
+//Lists stream ids. Requests without paging parameters get every id in the
+//original {"ids": [...]} shape so older clients keep working.
 func (s *StreamController) ListStreamIds(w http.ResponseWriter, r *http.Request) {
+	if wantsPaging(r) {
+		s.listStreamPage(w, r)
+		return
+	}
+
 	ctx, _ := context.WithTimeout(r.Context(), 5*time.Second)
-	results, err := s.streamCollection.Distinct(ctx, "_id", bson.D{})
+	results, err := s.streams.IDs(ctx)
 
-	if err == mongo.ErrNoDocuments {
+	if err == ErrNotFound {
 		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoStreamError)
 		return
 	} else if err != nil {
-		s.Logger.Error("mongo returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
 		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
 		return
 	}
@@ -65,9 +73,7 @@ func (s *StreamController) ListStreamIds(w http.ResponseWriter, r *http.Request)
 	var IdWrapper struct {
 		Ids []string `json:"ids"`
 	}
-	for _, res := range results {
-		IdWrapper.Ids = append(IdWrapper.Ids, res.(string))
-	}
+	IdWrapper.Ids = results
 
 	ids, _ := json.Marshal(IdWrapper)
 
@@ -78,74 +84,52 @@ func (s *StreamController) ListStreamIds(w http.ResponseWriter, r *http.Request)
 //Stream Controller's Get method that's responsible for getting stream id
 // data from mongo and ad url endpoint.
 func (s *StreamController) GetStream(w http.ResponseWriter, r *http.Request) {
-	streamID := chi.URLParam(r, "id")
-	hit, e := s.Cache.Get(streamID).Result()
-	if hit != "" {
-		internals.RespondAsJson(w, []byte(hit), http.StatusOK)
+	stream, err := s.streamWithAds(r, chi.URLParam(r, "id"))
+	if err != nil {
+		respondStreamError(w, err)
 		return
-	} else if e != nil && e != redis.Nil {
-		s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
 	}
+	setDegradedHeader(w, stream)
+	internals.RespondAsJson(w, stream.forPrincipal(PrincipalFromContext(r.Context())).toJson(), http.StatusOK)
+}
 
-	var stream Stream
-	ctx, _ := context.WithTimeout(r.Context(), 5*time.Second)
-	err := s.streamCollection.FindOne(ctx, bson.M{"_id": streamID}).Decode(&stream)
-	if err == mongo.ErrNoDocuments {
-		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoStreamError)
-		return
-	} else if err != nil {
-		s.Logger.Error("mongo returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
-		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
-		return
+//The origin url plays without counting against the concurrent stream limit,
+//so only principals who manage streams see it. Players get a url to play
+//from /play, along with their lease.
+func (s Stream) forPrincipal(p *Principal) Stream {
+	if p == nil || !p.Can(PermStreamsWrite) {
+		s.StreamURL = ""
 	}
+	return s
+}
 
-	stream.Ads, err = getAds(os.Getenv("ADS_URL") + streamID)
+//Returns a stream along with its ads. Both are cached on their own and put
+//together per request. Errors are logged and returned as the internals
+//error to show clients.
+func (s *StreamController) streamWithAds(r *http.Request, streamID string) (Stream, error) {
+	stream, err := s.cachedStream(r.Context(), streamID)
 	if err != nil {
-		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
-		internals.RespondAsErrorJson(w, http.StatusServiceUnavailable, internals.AdsError)
-		return
+		return stream, err
 	}
+	stream.Ads, stream.AdsDegraded, err = s.cachedAds(r.Context(), streamID)
+	return stream, err
+}
 
-	streamJson := stream.toJson()
-	err = s.Cache.Set(streamID, []byte(streamJson), 0).Err()
-	if err != nil {
-		s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+//Responds with the status code that goes with an error from streamWithAds
+func respondStreamError(w http.ResponseWriter, err error) {
+	switch err {
+	case internals.NoStreamError:
+		internals.RespondAsErrorJson(w, http.StatusNotFound, err)
+	case internals.AdsError:
+		internals.RespondAsErrorJson(w, http.StatusServiceUnavailable, err)
+	default:
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, err)
 	}
-	internals.RespondAsJson(w, streamJson, http.StatusOK)
 }
 
-//Converts Stream struct to JSON then updates caption's slash(/) to encoded slash(\/).
-//This is done because go's marshalling does not encode / to \/.
+//Converts Stream struct to indented JSON. Caption urls come out with
+//encoded slashes(\/) through CaptionTrack's marshalling.
 func (s Stream) toJson() json.RawMessage {
 	streamJson, _ := json.MarshalIndent(s, "", "  ")
-	streamStr := string(streamJson)
-	idEnd := strings.Index(streamStr, ",")
-	streamUrlEnd := strings.Index(streamStr[idEnd+1:], ",")
-	ads := strings.Index(streamStr, "ads")
-	updatedCaption := strings.Replace(streamStr[idEnd+streamUrlEnd+1:ads], "/", `\/`, -1)
-	return json.RawMessage(streamStr[:idEnd+streamUrlEnd+1] + updatedCaption + streamStr[ads:])
-}
-
-//Uses ads url to fetch ad metadata for a streamID and stores the response
-// as raw json to be used in Streams.
-func getAds(url string) (json.RawMessage, error) {
-	var ads json.RawMessage
-
-	spaceClient := http.Client{
-		Timeout: time.Second * 3,
-	}
-
-	res, getErr := spaceClient.Get(url)
-	if getErr != nil {
-		return ads, getErr
-	} else if res.StatusCode >= 400 {
-		getErr = errors.New(fmt.Sprintf("Returned %d from %s", res.StatusCode, url))
-		return ads, getErr
-	}
-	err := json.NewDecoder(res.Body).Decode(&ads)
-	if err != nil {
-		return ads, err
-	}
-
-	return ads, nil
+	return json.RawMessage(streamJson)
 }
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//Checks the fields of a Stream before it gets written to the store
+func (s *Stream) validate() []error {
+	var errs []error
+	if s.ID == "" {
+		errs = append(errs, errors.New("id is required"))
+	}
+
+	if s.StreamURL == "" {
+		errs = append(errs, errors.New("streamUrl is required"))
+	} else if !isValidURL(s.StreamURL) {
+		errs = append(errs, errors.New("invalid streamUrl format"))
+	}
+
+	errs = append(errs, s.Captions.validate()...)
+	return errs
+}
+
+//Only absolute http(s) urls are playable by clients
+func isValidURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+//Creates a new stream document in the store
+func (s *StreamController) CreateStream(w http.ResponseWriter, r *http.Request) {
+	var stream Stream
+	if err := json.NewDecoder(r.Body).Decode(&stream); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	stream.Ads = nil
+
+	errs := stream.validate()
+	if len(errs) != 0 {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := s.streams.Create(ctx, stream)
+	if err == ErrDuplicate {
+		internals.RespondAsErrorJson(w, http.StatusConflict, internals.DuplicateStreamError)
+		return
+	} else if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	internals.RespondAsJson(w, stream.toJson(), http.StatusCreated)
+}
+
+//Replaces an existing stream document with the one in the request body
+func (s *StreamController) ReplaceStream(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "id")
+
+	var stream Stream
+	if err := json.NewDecoder(r.Body).Decode(&stream); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	stream.Ads = nil
+
+	s.saveStream(w, r, streamID, stream)
+}
+
+//Applies a JSON merge patch from the request body to an existing stream document
+func (s *StreamController) UpdateStream(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "id")
+
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	existing, err := s.streams.Get(ctx, streamID)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoStreamError)
+		return
+	} else if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	existingJson, _ := json.Marshal(existing)
+	patched, err := internals.MergePatch(existingJson, patch)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+
+	var stream Stream
+	if err := json.Unmarshal(patched, &stream); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	stream.Ads = nil
+
+	s.saveStream(w, r, streamID, stream)
+}
+
+//Removes a stream document from the store along with its cached response
+func (s *StreamController) DeleteStream(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "id")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := s.streams.Delete(ctx, streamID)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoStreamError)
+		return
+	} else if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	s.evictStream(r, streamID)
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
+
+//Validates and writes over an existing stream document shared by PUT and PATCH
+func (s *StreamController) saveStream(w http.ResponseWriter, r *http.Request, streamID string, stream Stream) {
+	if stream.ID == "" {
+		stream.ID = streamID
+	} else if stream.ID != streamID {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.StreamIDMismatchError)
+		return
+	}
+
+	errs := stream.validate()
+	if len(errs) != 0 {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := s.streams.Replace(ctx, stream)
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoStreamError)
+		return
+	} else if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	s.evictStream(r, streamID)
+	internals.RespondAsJson(w, stream.toJson(), http.StatusOK)
+}
+
+//Removes the response GetStream cached for a stream, and any captions converted
+//for it, so edits are served right away
+func (s *StreamController) evictStream(r *http.Request, streamID string) {
+	//older versions cached the stream with its ads under the bare id
+	if err := s.Cache.Del(streamCacheKey(streamID), streamID); err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+	if err := s.Cache.DelPrefix("captions:" + streamID + ":"); err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"DiscoveryStreams/ads"
+	"DiscoveryStreams/internals"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//Content type VMAP and VAST documents are served with
+const xmlContentType = "application/xml; charset=utf-8"
+
+//Serves a stream's ad breaks as a VMAP playlist whose breaks link to GetVAST
+func (s *StreamController) GetVMAP(w http.ResponseWriter, r *http.Request) {
+	res, ok := s.streamAds(w, r)
+	if !ok {
+		return
+	}
+
+	base := strings.TrimSuffix(r.URL.Path, "ads.vmap")
+	out := ads.VMAP(res.Breaks, func(b ads.Break) string {
+		return apiURL(r, base+"ads/"+url.PathEscape(b.BreakID)+"/vast.xml")
+	})
+	internals.Respond(w, out, xmlContentType, http.StatusOK)
+}
+
+//Serves one of a stream's ad breaks as a VAST ad pod
+func (s *StreamController) GetVAST(w http.ResponseWriter, r *http.Request) {
+	res, ok := s.streamAds(w, r)
+	if !ok {
+		return
+	}
+
+	b, found := res.Break(chi.URLParam(r, "breakId"))
+	if !found {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoAdBreakError)
+		return
+	}
+	internals.Respond(w, ads.VAST(b, creativeURL), xmlContentType, http.StatusOK)
+}
+
+//Gets the typed ads of the stream in the url, responding with an error
+//when they can't be had
+func (s *StreamController) streamAds(w http.ResponseWriter, r *http.Request) (ads.Response, bool) {
+	stream, err := s.streamWithAds(r, chi.URLParam(r, "id"))
+	if err != nil {
+		respondStreamError(w, err)
+		return ads.Response{}, false
+	}
+	setDegradedHeader(w, stream)
+
+	res, err := ads.Parse(stream.Ads)
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusServiceUnavailable, internals.AdsError)
+		return res, false
+	}
+	return res, true
+}
+
+//Builds an absolute url to a path on this API for documents that players
+//follow links from. The jwt query parameter is carried over since players
+//can't add headers to those requests.
+func apiURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	uri := scheme + "://" + r.Host + path
+	if jwt := r.URL.Query().Get("jwt"); jwt != "" {
+		uri += "?" + url.Values{"jwt": {jwt}}.Encode()
+	}
+	return uri
+}
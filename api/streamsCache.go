@@ -0,0 +1,203 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+//Ads as they are kept in the cache along with when they were fetched
+type cachedAdsEntry struct {
+	FetchedAt time.Time       `json:"fetchedAt"`
+	Ads       json.RawMessage `json:"ads"`
+}
+
+//Ads along with the fallback they came from, if any
+type adsResult struct {
+	ads      json.RawMessage
+	degraded string
+}
+
+//Stream ids whose ads are being refreshed in the background
+var refreshingAds sync.Map
+
+func streamCacheKey(streamID string) string {
+	return "stream:" + streamID
+}
+
+func adsCacheKey(streamID string) string {
+	return "ads:" + streamID
+}
+
+//Gets a stream's mongo document from the cache, or from mongo when it isn't
+//cached. Documents are kept for STREAM_CACHE_TTL (default 5m).
+func (s *StreamController) cachedStream(ctx context.Context, streamID string) (Stream, error) {
+	if stream, ok := s.readStream(ctx, streamID); ok {
+		return stream, nil
+	}
+
+	v, err := s.loadOnce(ctx, "stream", streamCacheKey(streamID),
+		func(ctx context.Context) (interface{}, bool) { return s.readStream(ctx, streamID) },
+		func(ctx context.Context) (interface{}, error) { return s.loadStream(ctx, streamID) })
+	if err != nil {
+		return Stream{}, err
+	}
+	return v.(Stream), nil
+}
+
+func (s *StreamController) readStream(ctx context.Context, streamID string) (Stream, bool) {
+	var stream Stream
+	hit, e := s.Cache.Get(streamCacheKey(streamID))
+	if e == nil {
+		if err := json.Unmarshal(hit, &stream); err == nil {
+			return stream, true
+		}
+	} else if e != cache.ErrMiss {
+		s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+	return stream, false
+}
+
+func (s *StreamController) loadStream(ctx context.Context, streamID string) (Stream, error) {
+	cacheMetrics.Add("stream_fetches", 1)
+
+	stream, err := s.streams.Get(ctx, streamID)
+	if err == ErrNotFound {
+		return stream, internals.NoStreamError
+	} else if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+		return stream, internals.DBError
+	}
+
+	s.cacheStream(ctx, stream)
+	return stream, nil
+}
+
+func (s *StreamController) cacheStream(ctx context.Context, stream Stream) {
+	doc, _ := json.Marshal(stream)
+	err := s.Cache.Set(streamCacheKey(stream.ID), doc, config.GetDuration("STREAM_CACHE_TTL", 5*time.Minute))
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+}
+
+//Gets many streams' mongo documents keyed by id like cachedStream does, with
+//the ones that aren't cached read from mongo at once. Streams that don't
+//exist are left out.
+func (s *StreamController) cachedStreams(ctx context.Context, streamIDs []string) (map[string]Stream, error) {
+	streams := map[string]Stream{}
+	var missing []string
+	for _, id := range streamIDs {
+		if stream, ok := s.readStream(ctx, id); ok {
+			streams[id] = stream
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return streams, nil
+	}
+
+	cacheMetrics.Add("stream_fetches", 1)
+	loaded, err := s.streams.GetMany(ctx, missing)
+	if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+		return nil, internals.DBError
+	}
+	for _, stream := range loaded {
+		s.cacheStream(ctx, stream)
+		streams[stream.ID] = stream
+	}
+	return streams, nil
+}
+
+//Gets a stream's ads from the cache, or from the ad server when they aren't
+//cached. Ads are fresh for ADS_CACHE_TTL (default 1m) and are then served
+//stale for up to ADS_STALE_TTL (default 10m) while they are refreshed in the
+//background.
+func (s *StreamController) cachedAds(ctx context.Context, streamID string) (json.RawMessage, string, error) {
+	entry, ok := s.readAds(ctx, streamID)
+	if ok {
+		age := time.Since(entry.FetchedAt)
+		if age < config.GetDuration("ADS_CACHE_TTL", time.Minute) {
+			return entry.Ads, "", nil
+		}
+		//entries are only kept in the cache for as long as they can be served stale
+		s.refreshAdsInBackground(ctx, streamID)
+		return entry.Ads, "", nil
+	}
+
+	res, err := s.loadAds(ctx, streamID)
+	return res.ads, res.degraded, err
+}
+
+func (s *StreamController) readAds(ctx context.Context, streamID string) (cachedAdsEntry, bool) {
+	var entry cachedAdsEntry
+	hit, e := s.Cache.Get(adsCacheKey(streamID))
+	if e == nil {
+		if err := json.Unmarshal(hit, &entry); err == nil {
+			return entry, true
+		}
+	} else if e != cache.ErrMiss {
+		s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+	return entry, false
+}
+
+//Fetches a stream's ads once for every request that wants them at the same time
+func (s *StreamController) loadAds(ctx context.Context, streamID string) (adsResult, error) {
+	v, err := s.loadOnce(ctx, "ads", adsCacheKey(streamID),
+		func(ctx context.Context) (interface{}, bool) {
+			entry, ok := s.readAds(ctx, streamID)
+			if !ok || time.Since(entry.FetchedAt) >= config.GetDuration("ADS_CACHE_TTL", time.Minute) {
+				return nil, false
+			}
+			return adsResult{ads: entry.Ads}, true
+		},
+		func(ctx context.Context) (interface{}, error) { return s.refreshAds(ctx, streamID) })
+	if err != nil {
+		return adsResult{}, err
+	}
+	return v.(adsResult), nil
+}
+
+//Fetches a stream's ads and caches them unless they came from a fallback,
+//so the next request tries the ad server again
+func (s *StreamController) refreshAds(ctx context.Context, streamID string) (adsResult, error) {
+	cacheMetrics.Add("ads_fetches", 1)
+
+	ads, degraded, err := s.fetchAds(ctx, streamID)
+	if err != nil || degraded != "" {
+		return adsResult{ads, degraded}, err
+	}
+
+	ttl := config.GetDuration("ADS_CACHE_TTL", time.Minute) + config.GetDuration("ADS_STALE_TTL", 10*time.Minute)
+	entry, _ := json.Marshal(cachedAdsEntry{FetchedAt: time.Now(), Ads: ads})
+	if err := s.Cache.Set(adsCacheKey(streamID), entry, ttl); err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(ctx)))
+	}
+	return adsResult{ads: ads}, nil
+}
+
+//Refreshes a stream's ads once the request serving the stale copy is done.
+//Only one refresh per stream runs at a time in this process.
+func (s *StreamController) refreshAdsInBackground(ctx context.Context, streamID string) {
+	if _, running := refreshingAds.LoadOrStore(streamID, true); running {
+		return
+	}
+
+	//the request's context ends with the response so only its id is kept
+	bg := detachedContext(ctx)
+	go func() {
+		defer refreshingAds.Delete(streamID)
+		bg, cancel := context.WithTimeout(bg, sharedLoadTimeout)
+		defer cancel()
+		s.loadAds(bg, streamID)
+	}()
+}
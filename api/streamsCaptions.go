@@ -0,0 +1,87 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/captions"
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Caption files larger than this are not converted
+const maxCaptionSize = 5 << 20
+
+//Serves a stream's captions for a language in the requested format. The stored
+//caption is converted when it is in another format and the result is cached.
+func (s *StreamController) GetCaptions(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "id")
+	lang := chi.URLParam(r, "lang")
+	format := strings.ToLower(chi.URLParam(r, "format"))
+
+	if !captions.CanWrite(format) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.CaptionFormatError)
+		return
+	}
+	if !languageTagRegex.MatchString(lang) {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidLanguageError)
+		return
+	}
+
+	key := captionsCacheKey(streamID, lang, format)
+	hit, e := s.Cache.Get(key)
+	if e == nil {
+		internals.Respond(w, hit, captions.ContentType(format), http.StatusOK)
+		return
+	} else if e != cache.ErrMiss {
+		s.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+
+	stream, err := s.cachedStream(r.Context(), streamID)
+	if err != nil {
+		respondStreamError(w, err)
+		return
+	}
+
+	//dfxp is served from captions stored as ttml
+	storedFormat := format
+	if format == "dfxp" {
+		storedFormat = "ttml"
+	}
+
+	track, sourceFormat, ok := stream.Captions.find(lang, storedFormat)
+	if !ok {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoCaptionsError)
+		return
+	}
+
+	out, err := fetchURL(r.Context(), track.URL, maxCaptionSize)
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.CaptionsSourceError)
+		return
+	}
+
+	if sourceFormat != storedFormat {
+		out, err = captions.Convert(out, sourceFormat, format, lang)
+		if err != nil {
+			s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.CaptionsConvertError)
+			return
+		}
+	}
+
+	err = s.Cache.Set(key, out, config.GetDuration("CAPTIONS_CACHE_TTL", 24*time.Hour))
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+	internals.Respond(w, out, captions.ContentType(format), http.StatusOK)
+}
+
+func captionsCacheKey(streamID string, lang string, format string) string {
+	return "captions:" + streamID + ":" + strings.ToLower(lang) + "." + format
+}
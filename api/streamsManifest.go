@@ -0,0 +1,166 @@
+package api
+
+import (
+	"DiscoveryStreams/ads"
+	"DiscoveryStreams/hls"
+	"DiscoveryStreams/internals"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Content type HLS playlists are served with
+const m3u8ContentType = "application/vnd.apple.mpegurl"
+
+//Playlists larger than this are not rewritten
+const maxPlaylistSize = 2 << 20
+
+//Serves a stream's HLS playlist with its ad breaks spliced in. Variants of a
+//master playlist are pointed back here as ?variant=<n> so every media
+//playlist gets the same breaks, with subtitles leaving gaps for them. It is only served to players holding a lease
+//for the stream from /play, passed as ?lease=<id>, so the concurrent stream
+//limit can't be skipped.
+func (s *StreamController) GetManifest(w http.ResponseWriter, r *http.Request) {
+	_, err := s.leaseFor(emailFromContext(r.Context()), r.URL.Query().Get("lease"), chi.URLParam(r, "id"))
+	if err == internals.NoPlaybackError {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.LeaseRequiredError)
+		return
+	} else if err != nil {
+		s.respondPlaybackRedisError(w, r, err)
+		return
+	}
+
+	stream, err := s.streamWithAds(r, chi.URLParam(r, "id"))
+	if err != nil {
+		respondStreamError(w, err)
+		return
+	}
+	setDegradedHeader(w, stream)
+
+	playlistURL := stream.StreamURL
+	playlist, err := fetchURL(r.Context(), playlistURL, maxPlaylistSize)
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.ManifestSourceError)
+		return
+	}
+
+	breaks := hlsBreaks(stream.Ads)
+	insert := hls.InsertBreaks
+	if hls.IsMaster(playlist) {
+		variant := r.URL.Query().Get("variant")
+		if variant == "" {
+			out, err := hls.RewriteMaster(playlist, func(i int) string { return variantURL(r, i) })
+			if err != nil {
+				s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+				internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.ManifestSourceError)
+				return
+			}
+			internals.Respond(w, out, m3u8ContentType, http.StatusOK)
+			return
+		}
+
+		variants, err := hls.Variants(playlist)
+		if err != nil {
+			s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.ManifestSourceError)
+			return
+		}
+		i, err := strconv.Atoi(variant)
+		if err != nil || i < 0 || i >= len(variants) {
+			internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoVariantError)
+			return
+		}
+
+		for _, v := range variants {
+			if v.Type == "AUDIO" {
+				//there are no audio creatives to splice into demuxed audio,
+				//which would drift from the video after every break, so
+				//the stream plays without ads
+				breaks = nil
+			}
+		}
+		playlistURL = resolveURL(playlistURL, variants[i].URI)
+		if variants[i].TakesGaps() {
+			insert = hls.InsertGaps
+		} else if !variants[i].TakesAds() {
+			breaks = nil
+		}
+		playlist, err = fetchURL(r.Context(), playlistURL, maxPlaylistSize)
+		if err != nil {
+			s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.ManifestSourceError)
+			return
+		}
+	}
+
+	base, _ := url.Parse(playlistURL)
+	out, err := insert(playlist, base, breaks)
+	if err == hls.ErrLivePlaylist {
+		//live streams play without ads rather than with breaks that move
+		//on every reload
+		out, err = insert(playlist, base, nil)
+	}
+	if err != nil {
+		s.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusBadGateway, internals.ManifestSourceError)
+		return
+	}
+	internals.Respond(w, out, m3u8ContentType, http.StatusOK)
+}
+
+//Builds the uri of a master playlist variant served by GetManifest. The jwt
+//and lease query parameters are carried over since players can't add headers
+//to the playlist requests they make.
+func variantURL(r *http.Request, i int) string {
+	query := url.Values{}
+	query.Set("variant", strconv.Itoa(i))
+	query.Set("lease", r.URL.Query().Get("lease"))
+	if jwt := r.URL.Query().Get("jwt"); jwt != "" {
+		query.Set("jwt", jwt)
+	}
+	return "manifest.m3u8?" + query.Encode()
+}
+
+func resolveURL(base string, ref string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return b.ResolveReference(r).String()
+}
+
+//Converts the ad server response to hls breaks. A response that can't be
+//read leaves the content without ads rather than failing playback.
+func hlsBreaks(raw json.RawMessage) []hls.Break {
+	res, err := ads.Parse(raw)
+	if err != nil {
+		return nil
+	}
+
+	var breaks []hls.Break
+	for _, b := range res.Breaks {
+		brk := hls.Break{ID: b.BreakID, Offset: b.TimeOffset}
+		for _, ad := range b.Ads {
+			brk.Ads = append(brk.Ads, hls.Ad{URI: creativeURL(ad), Duration: ad.Duration})
+		}
+		breaks = append(breaks, brk)
+	}
+	return breaks
+}
+
+//Builds the uri of an ad creative from AD_CREATIVE_URL by replacing
+//{creative} with the creative id
+func creativeURL(ad ads.Ad) string {
+	return strings.Replace(os.Getenv("AD_CREATIVE_URL"), "{creative}", url.PathEscape(ad.Creative), -1)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"DiscoveryStreams/internals"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-chi/chi/middleware"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultPageLimit = 50
+const maxPageLimit = 100
+
+//Query parameters that switch ListStreamIds from the legacy full listing to pages
+var pagingParams = []string{"limit", "cursor", "sort", "captions", "lang", "host"}
+
+//Sort options clients can pass in ?sort= mapped to their mongo field
+var sortFields = map[string]string{
+	"id":        "_id",
+	"streamUrl": "streamUrl",
+}
+
+//Position of the last stream returned in a page. It is handed to clients
+//as an opaque base64 token in ?cursor=
+type StreamCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+//Parsed query parameters for a paginated ListStreamIds request. Streams
+//are ordered by the sort field and then by id so positions are stable even
+//when several streams share the same sort value.
+type ListOptions struct {
+	Limit    int64
+	Sort     string
+	Cursor   *StreamCursor
+	Captions string
+	Lang     string
+	Host     string
+}
+
+//Returns true when a request asks for any paging, sorting or filtering
+func wantsPaging(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, p := range pagingParams {
+		if _, ok := query[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	query := r.URL.Query()
+	opts := ListOptions{Limit: defaultPageLimit, Sort: "id"}
+
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return opts, internals.InvalidLimitError
+		}
+		opts.Limit = limit
+	}
+
+	if s := query.Get("sort"); s != "" {
+		if _, ok := sortFields[strings.TrimPrefix(s, "-")]; !ok {
+			return opts, internals.InvalidSortError
+		}
+		opts.Sort = s
+	}
+
+	if c := query.Get("cursor"); c != "" {
+		cursor, err := decodeCursor(c)
+		if err != nil || cursor.Sort != opts.Sort {
+			return opts, internals.InvalidCursorError
+		}
+		opts.Cursor = cursor
+	}
+
+	if c := query.Get("captions"); c != "" {
+		if !isCaptionFormat(c) {
+			return opts, internals.InvalidCaptionFilterError
+		}
+		opts.Captions = c
+	}
+
+	if l := query.Get("lang"); l != "" {
+		if !languageTagRegex.MatchString(l) {
+			return opts, internals.InvalidLanguageError
+		}
+		opts.Lang = l
+	}
+
+	opts.Host = query.Get("host")
+	return opts, nil
+}
+
+func encodeCursor(c StreamCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (*StreamCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var c StreamCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+//Serves one page of stream ids along with a link to the next page
+func (s *StreamController) listStreamPage(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseListOptions(r)
+	if err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, err)
+		return
+	}
+
+	streams, err := s.streams.List(r.Context(), opts)
+	if err != nil {
+		s.Logger.Error("stream store returned "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+		return
+	}
+
+	var page struct {
+		Ids  []string `json:"ids"`
+		Next string   `json:"next,omitempty"`
+	}
+	page.Ids = []string{}
+
+	hasMore := int64(len(streams)) > opts.Limit
+	if hasMore {
+		streams = streams[:opts.Limit]
+	}
+	for _, stream := range streams {
+		page.Ids = append(page.Ids, stream.ID)
+	}
+
+	if hasMore {
+		last := streams[len(streams)-1]
+		cursor := StreamCursor{Sort: opts.Sort, ID: last.ID}
+		if sortFields[strings.TrimPrefix(opts.Sort, "-")] == "streamUrl" {
+			cursor.Value = last.StreamURL
+		}
+
+		query := r.URL.Query()
+		query.Set("cursor", encodeCursor(cursor))
+		query.Set("limit", strconv.FormatInt(opts.Limit, 10))
+		page.Next = r.URL.Path + "?" + query.Encode()
+	}
+
+	pageJson, _ := json.Marshal(page)
+	internals.RespondAsJson(w, pageJson, http.StatusOK)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"DiscoveryStreams/cache"
+	"github.com/dgrijalva/jwt-go"
+	"strconv"
+	"strings"
+)
+
+//Every access token and refresh token family carries the version its user's
+//tokens were at when it was issued. Raising the version revokes all of them
+//at once, without having to know what they are.
+func tokenVersionKey(email string) string {
+	return "tokenversion:" + strings.ToLower(email)
+}
+
+//Current token version of the user with email. Users whose tokens were
+//never revoked are at version 0.
+func tokenVersion(c cache.Cache, email string) (int64, error) {
+	raw, err := c.Get(tokenVersionKey(email))
+	if err == cache.ErrMiss {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+//Revokes every token the user with email has been issued and signs out all
+//their sessions. The version is kept for as long as any of the tokens could
+//still be used.
+func (u *UsersController) revokeAllTokens(email string) error {
+	version, err := u.Cache.Incr(tokenVersionKey(email), 0)
+	if err != nil {
+		return err
+	}
+	if err := u.Cache.Set(tokenVersionKey(email), []byte(strconv.FormatInt(version, 10)), refreshTTL()); err != nil {
+		return err
+	}
+	return u.Cache.DelPrefix(sessionsPrefix(email))
+}
+
+//Reports whether an access token's claims were issued at its user's current
+//token version. Tokens issued before versions existed are at version 0.
+func isCurrentTokenVersion(c cache.Cache, claims jwt.MapClaims) (bool, error) {
+	email, _ := claims["email"].(string)
+	issued, _ := claims["ver"].(float64)
+	current, err := tokenVersion(c, email)
+	if err != nil {
+		return false, err
+	}
+	return int64(issued) == current, nil
+}
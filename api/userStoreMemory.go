@@ -0,0 +1,188 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+//UserStore kept in process memory, for tests and running without mongo
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryUserStore(users ...User) UserStore {
+	m := &memoryUserStore{users: map[string]User{}}
+	for _, user := range users {
+		m.Create(context.Background(), user)
+	}
+	return m
+}
+
+func (m *memoryUserStore) Create(ctx context.Context, user User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.Email]; ok {
+		return ErrDuplicate
+	}
+	m.users[user.Email] = user
+	return nil
+}
+
+func (m *memoryUserStore) FindByEmail(ctx context.Context, email string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	user, ok := m.users[email]
+	if !ok {
+		return user, ErrNotFound
+	}
+	return user, nil
+}
+
+func (m *memoryUserStore) UpdatePassword(ctx context.Context, email string, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Password = hash
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) UpdateRole(ctx context.Context, email string, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Role = role
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) UpdatePlan(ctx context.Context, email string, plan string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Plan = plan
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) MarkVerified(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Unverified = false
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) UpdateName(ctx context.Context, email string, firstName string, lastName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.FirstName, user.LastName = firstName, lastName
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) SetPendingEmail(ctx context.Context, email string, pending string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.PendingEmail = pending
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) ChangeEmail(ctx context.Context, email string, newEmail string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, taken := m.users[newEmail]; taken {
+		return ErrDuplicate
+	}
+	delete(m.users, email)
+	user.Email, user.PendingEmail, user.Unverified = newEmail, "", false
+	m.users[newEmail] = user
+	return nil
+}
+
+func (m *memoryUserStore) FindByIdentity(ctx context.Context, identity Identity) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, user := range m.users {
+		for _, linked := range user.Identities {
+			if linked == identity {
+				return user, nil
+			}
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (m *memoryUserStore) LinkIdentity(ctx context.Context, email string, identity Identity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, linked := range user.Identities {
+		if linked == identity {
+			return nil
+		}
+	}
+	user.Identities = append(user.Identities[:len(user.Identities):len(user.Identities)], identity)
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) SetTOTP(ctx context.Context, email string, secret string, enabled bool, recoveryCodes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TOTPSecret, user.TOTPEnabled, user.RecoveryCodes = secret, enabled, recoveryCodes
+	m.users[email] = user
+	return nil
+}
+
+func (m *memoryUserStore) UseRecoveryCode(ctx context.Context, email string, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[email]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, code := range user.RecoveryCodes {
+		if code == hash {
+			remaining := append([]string{}, user.RecoveryCodes[:i]...)
+			user.RecoveryCodes = append(remaining, user.RecoveryCodes[i+1:]...)
+			m.users[email] = user
+			return nil
+		}
+	}
+	return ErrNotFound
+}
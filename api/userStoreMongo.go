@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"time"
+)
+
+//UserStore backed by the mongo users collection, which has a unique index on email
+type mongoUserStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoUserStore(db *mongo.Database) UserStore {
+	return mongoUserStore{collection: db.Collection("users")}
+}
+
+func (m mongoUserStore) Create(ctx context.Context, user User) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := m.collection.InsertOne(ctx, user)
+	if _, ok := err.(mongo.WriteException); ok {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoUserStore) FindByEmail(ctx context.Context, email string) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user User
+	err := m.collection.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (m mongoUserStore) UpdatePassword(ctx context.Context, email string, hash string) error {
+	return m.set(ctx, email, bson.M{"password": hash})
+}
+
+func (m mongoUserStore) UpdateRole(ctx context.Context, email string, role string) error {
+	return m.set(ctx, email, bson.M{"role": role})
+}
+
+func (m mongoUserStore) UpdatePlan(ctx context.Context, email string, plan string) error {
+	return m.set(ctx, email, bson.M{"plan": plan})
+}
+
+func (m mongoUserStore) MarkVerified(ctx context.Context, email string) error {
+	return m.set(ctx, email, bson.M{"unverified": false})
+}
+
+func (m mongoUserStore) UpdateName(ctx context.Context, email string, firstName string, lastName string) error {
+	return m.set(ctx, email, bson.M{"firstname": firstName, "lastname": lastName})
+}
+
+func (m mongoUserStore) SetPendingEmail(ctx context.Context, email string, pending string) error {
+	return m.set(ctx, email, bson.M{"pendingEmail": pending})
+}
+
+func (m mongoUserStore) ChangeEmail(ctx context.Context, email string, newEmail string) error {
+	err := m.set(ctx, email, bson.M{"email": newEmail, "pendingEmail": "", "unverified": false})
+	if _, ok := err.(mongo.WriteException); ok {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoUserStore) FindByIdentity(ctx context.Context, identity Identity) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var user User
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": identity.Issuer, "subject": identity.Subject}}}
+	err := m.collection.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (m mongoUserStore) LinkIdentity(ctx context.Context, email string, identity Identity) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$addToSet": bson.M{"identities": identity}})
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m mongoUserStore) SetTOTP(ctx context.Context, email string, secret string, enabled bool, recoveryCodes []string) error {
+	return m.set(ctx, email, bson.M{"totpSecret": secret, "totpEnabled": enabled, "recoveryCodes": recoveryCodes})
+}
+
+//The code is matched in the filter so two requests can't both use it
+func (m mongoUserStore) UseRecoveryCode(ctx context.Context, email string, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.UpdateOne(ctx, bson.M{"email": email, "recoveryCodes": hash}, bson.M{"$pull": bson.M{"recoveryCodes": hash}})
+	if err != nil {
+		return err
+	} else if res.ModifiedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//Sets fields on the user with email
+func (m mongoUserStore) set(ctx context.Context, email string, fields bson.M) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": fields})
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
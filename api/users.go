@@ -3,17 +3,13 @@ package api
 import (
 	"DiscoveryStreams/config"
 	"DiscoveryStreams/internals"
+	"DiscoveryStreams/passwords"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/middleware"
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
@@ -26,18 +22,81 @@ type User struct {
 	FirstName string `json:"firstname" bson:"firstname"`
 	LastName  string `json:"lastname" bson:"lastname"`
 	Password  string `json:"password" bson:"password"`
+	//One of viewer, editor or admin
+	Role string `json:"-" bson:"role,omitempty"`
+	//Set on signup until the email address is verified. Accounts made
+	//before verification existed don't have it and count as verified.
+	Unverified bool `json:"-" bson:"unverified,omitempty"`
+	//Address the user asked to change their email to, until it is verified
+	PendingEmail string `json:"-" bson:"pendingEmail,omitempty"`
+	//Accounts at identity providers the user can sign in with
+	Identities []Identity `json:"-" bson:"identities,omitempty"`
+	//Base32 TOTP secret, kept from when enrolment starts
+	TOTPSecret string `json:"-" bson:"totpSecret,omitempty"`
+	//Set once a code from TOTPSecret was confirmed, after which logins need one
+	TOTPEnabled bool `json:"-" bson:"totpEnabled,omitempty"`
+	//SHA-256 hashes of the recovery codes that haven't been used
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes,omitempty"`
+	//Set for accounts made for machine clients, which only use API keys
+	ServiceAccount bool `json:"-" bson:"serviceAccount,omitempty"`
+	//Plan the user is on, which picks their rate limits. Empty means free.
+	Plan string `json:"-" bson:"plan,omitempty"`
+}
+
+//An account at an OpenID provider, which is identified by its issuer and
+//the subject the provider gave it
+type Identity struct {
+	Issuer  string `json:"issuer" bson:"issuer"`
+	Subject string `json:"subject" bson:"subject"`
 }
 
 type UsersController struct {
-	userCollection *mongo.Collection
+	users  UserStore
+	hasher passwords.Hasher
+	//Key email verification and password reset tokens are signed with
+	emailSecret []byte
+	//Whether Login refuses accounts that haven't verified their email
+	requireVerified bool
+	//Identity providers users can sign in with, by the name used in their urls
+	providers map[string]identityProvider
+	//Hash of a random password that logins without one are checked against,
+	//so they take as long to refuse as a wrong password
+	dummyHash string
+	//Move what other stores keep under a user's email when it changes
+	emailChangeHooks []EmailChangeHook
 	*config.Tools
 }
 
-func NewUsersController(mongo *mongo.Database, tools *config.Tools) *UsersController {
-	collection := mongo.Collection("users")
+//Moves data kept under a user's email to the address they changed it to
+type EmailChangeHook func(ctx context.Context, email string, newEmail string) error
+
+//Registers a hook that runs after a user's email changed
+func (u *UsersController) OnEmailChange(hook EmailChangeHook) {
+	u.emailChangeHooks = append(u.emailChangeHooks, hook)
+}
+
+func NewUsersController(users UserStore, tools *config.Tools) *UsersController {
+	hasher := passwords.NewHasher()
+	if algorithm := os.Getenv("PASSWORD_HASH"); algorithm != "" {
+		hasher.Algorithm = algorithm
+	}
+	hasher.Argon2.Memory = uint32(config.GetInt("ARGON2_MEMORY", int(hasher.Argon2.Memory)))
+	hasher.Argon2.Time = uint32(config.GetInt("ARGON2_TIME", int(hasher.Argon2.Time)))
+	hasher.Argon2.Threads = uint8(config.GetInt("ARGON2_THREADS", int(hasher.Argon2.Threads)))
+	hasher.BcryptCost = config.GetInt("BCRYPT_COST", hasher.BcryptCost)
+	dummyHash, err := hasher.Hash(uuid.New().String())
+	if err != nil {
+		tools.Logger.Error("hashing the dummy password failed: " + err.Error())
+	}
+
 	return &UsersController{
-		userCollection: collection,
-		Tools:          tools,
+		users:           users,
+		hasher:          hasher,
+		dummyHash:       dummyHash,
+		emailSecret:     emailTokenSecret(tools),
+		requireVerified: os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true",
+		providers:       oidcProviders(tools),
+		Tools:           tools,
 	}
 }
 func (u *User) validate() []error {
@@ -57,14 +116,20 @@ func (u *User) validate() []error {
 		error = append(error, errors.New("last name is required"))
 	}
 
-	if u.Password == "" {
-		error = append(error, errors.New("password is required"))
-	} else if len(u.Password) < 5 {
-		error = append(error, errors.New("password needs to be more than 6 characters"))
+	if err := validatePassword(u.Password); err != nil {
+		error = append(error, err)
 	}
 
 	return error
 }
+func validatePassword(password string) error {
+	if password == "" {
+		return errors.New("password is required")
+	} else if len(password) < 5 {
+		return errors.New("password needs to be more than 6 characters")
+	}
+	return nil
+}
 func (u *UsersController) Signup(w http.ResponseWriter, r *http.Request) {
 	var user User
 	_ = json.NewDecoder(r.Body).Decode(&user)
@@ -75,10 +140,18 @@ func (u *UsersController) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.Password = hashPassword(user.Password)
+	hash, err := u.hasher.Hash(user.Password)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.PasswordHashError)
+		return
+	}
+	user.Password = hash
+	user.Role = RoleViewer
+	user.Unverified = true
 	ctx, _ := context.WithTimeout(r.Context(), 5*time.Second)
-	_, err := u.userCollection.InsertOne(ctx, user)
-	if _, ok := err.(mongo.WriteException); ok {
+	err = u.users.Create(ctx, user)
+	if err == ErrDuplicate {
 		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DuplicateError)
 		return
 	} else if err != nil {
@@ -87,77 +160,137 @@ func (u *UsersController) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//The account exists either way, so a failed email is only logged
+	if err := u.sendVerificationEmail(r.Context(), user); err != nil {
+		u.Logger.Error("verification email to "+user.Email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	}
+
 	internals.RespondAsJson(w, nil, http.StatusCreated)
 }
 
 func (u *UsersController) Login(w http.ResponseWriter, r *http.Request) {
 
-	var user User
-	_ = json.NewDecoder(r.Body).Decode(&user)
-	user.Password = hashPassword(user.Password)
+	var creds User
+	_ = json.NewDecoder(r.Body).Decode(&creds)
 
-	ctx, _ := context.WithTimeout(r.Context(), 5*time.Second)
-	err := u.userCollection.FindOne(ctx, bson.M{"email": user.Email, "password": user.Password}).Decode(&user)
-	if err == mongo.ErrNoDocuments {
-		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.LoginError)
+	email, ip := lockoutEmailID(creds.Email), clientIP(r)
+	wait, err := u.loginRetryAfter(email, ip)
+	if err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
 		return
-	} else if err != nil {
+	} else if wait > 0 {
+		respondLocked(w, wait)
+		return
+	}
+
+	ctx, _ := context.WithTimeout(r.Context(), 5*time.Second)
+	user, err := u.users.FindByEmail(ctx, creds.Email)
+	if err != nil && err != ErrNotFound {
 		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
 		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
 		return
 	}
-
-	tokenAuth, err := u.generateToken(user)
-	if err != nil {
+	ok := false
+	//accounts made by signing in with an identity provider have no password.
+	//They and unknown emails are checked against the dummy hash, so they are
+	//refused as slowly as a wrong password.
+	if err == nil && user.Password != "" {
+		ok, err = u.hasher.Verify(creds.Password, user.Password)
+		if err != nil {
+			u.Logger.Error("password of "+user.Email+" can't be verified: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		}
+	} else {
+		u.hasher.Verify(creds.Password, u.dummyHash)
+	}
+	if !ok {
+		//unknown emails count too, so failures don't reveal which exist
+		if err := u.recordLoginFailure(r, email, ip); err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		}
+		internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.LoginError)
+		return
+	}
+	if err := u.clearLoginFailures(email); err != nil {
 		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
-		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.TokenGenError)
+	}
+	if u.requireVerified && user.Unverified {
+		internals.RespondAsErrorJson(w, http.StatusForbidden, internals.EmailNotVerifiedError)
 		return
 	}
-	w.Header().Set("Authorization", fmt.Sprintf("Bearer %s", tokenAuth))
-
-	internals.RespondAsJson(w, nil, http.StatusOK)
-
+	if u.hasher.NeedsRehash(user.Password) {
+		u.rehashPassword(r, user.Email, creds.Password)
+	}
+	u.completeLogin(w, r, user)
 }
 
 func (u *UsersController) Logout(w http.ResponseWriter, r *http.Request) {
-	tkn := r.Context().Value("Token").(*jwt.Token)
-	claims := &jwt.StandardClaims{}
-	jwtKey := []byte(os.Getenv("TOKEN_SECRET"))
-	_, _ = jwt.ParseWithClaims(tkn.Raw, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	tkn := PrincipalFromContext(r.Context()).Token
+	claims := &sessionClaims{}
+	_, _ = jwt.ParseWithClaims(tkn.Raw, claims, u.Keys.Keyfunc)
 
 	timeLeft := time.Unix(claims.ExpiresAt, 0).Sub(time.Unix(time.Now().Unix(), 0))
 
-	//Adding jwt to redis blacklist
-	u.Cache.Set(tkn.Raw, true, timeLeft).Result()
+	//Adding the jwt's id to the blacklist
+	if err := u.Blacklist.Revoke(claims.Id, timeLeft); err != nil {
+		u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+		internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+		return
+	}
+
+	//Ending its session, which revokes the refresh tokens issued along with it
+	if claims.SessionID != "" {
+		if err := u.revokeSession(claims.Email, claims.SessionID); err != nil {
+			u.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+			internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
+			return
+		}
+	}
 	internals.RespondAsJson(w, nil, http.StatusOK)
 
 }
-func (u *UsersController) generateToken(user User) (string, error) {
+//How long access tokens are good for
+const accessTokenTTL = time.Hour
+
+//Claims of an access token that tie it to the session it was issued for
+type sessionClaims struct {
+	jwt.StandardClaims
+	Email     string `json:"email"`
+	SessionID string `json:"sid,omitempty"`
+}
+
+func (u *UsersController) generateToken(user User, session refreshSession) (string, error) {
 	jti, err := uuid.NewRandom()
 	if err != nil {
 		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"exp":       time.Now().Add(time.Hour * 1).Unix(),
+	return u.Keys.Sign(jwt.MapClaims{
+		"exp":       time.Now().Add(accessTokenTTL).Unix(),
 		"iat":       time.Now().Unix(),
 		"email":     user.Email,
 		"firstname": user.FirstName,
 		"lastname":  user.LastName,
 		"wholename": user.FirstName + " " + user.LastName,
 		"jti":       jti.String(),
+		"sid":       session.Family,
+		"ver":       session.Version,
+		"role":      user.role(),
+		"mfa":       session.MFA,
+		"plan":      user.plan(),
 	})
+}
 
-	tokenString, err := token.SignedString([]byte(os.Getenv("TOKEN_SECRET")))
+//Replaces a password hash made with a legacy algorithm or weaker parameters
+//once the password is known from a successful login. Failures are only
+//logged since the old hash still works.
+func (u *UsersController) rehashPassword(r *http.Request, email string, password string) {
+	hash, err := u.hasher.Hash(password)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		err = u.users.UpdatePassword(ctx, email, hash)
+	}
 	if err != nil {
-		return "", err
+		u.Logger.Error("rehashing password of "+email+" failed: "+err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
 	}
-	return tokenString, nil
-}
-func hashPassword(password string) string {
-	h := sha1.New()
-	h.Write([]byte(password))
-	sha1Hash := hex.EncodeToString(h.Sum(nil))
-	return sha1Hash
 }
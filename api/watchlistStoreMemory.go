@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+//WatchlistStore kept in process memory, for tests and running without mongo
+type memoryWatchlistStore struct {
+	mu    sync.RWMutex
+	lists map[string]Watchlist
+}
+
+func NewMemoryWatchlistStore(lists ...Watchlist) WatchlistStore {
+	m := &memoryWatchlistStore{lists: map[string]Watchlist{}}
+	for _, list := range lists {
+		m.Create(context.Background(), list)
+	}
+	return m
+}
+
+func (m *memoryWatchlistStore) Create(ctx context.Context, list Watchlist) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list.Key = watchlistKey(list.Owner, list.ID)
+	if _, ok := m.lists[list.Key]; ok {
+		return ErrDuplicate
+	}
+	list.Items = append([]string{}, list.Items...)
+	m.lists[list.Key] = list
+	return nil
+}
+
+func (m *memoryWatchlistStore) Get(ctx context.Context, owner string, id string) (Watchlist, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list, ok := m.lists[watchlistKey(owner, id)]
+	if !ok {
+		return list, ErrNotFound
+	}
+	list.Items = append([]string{}, list.Items...)
+	return list, nil
+}
+
+func (m *memoryWatchlistStore) List(ctx context.Context, owner string) ([]Watchlist, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var lists []Watchlist
+	for _, list := range m.lists {
+		if list.Owner == owner {
+			list.Items = append([]string{}, list.Items...)
+			lists = append(lists, list)
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return lists[i].CreatedAt.Before(lists[j].CreatedAt) })
+	return lists, nil
+}
+
+func (m *memoryWatchlistStore) Replace(ctx context.Context, list Watchlist) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list.Key = watchlistKey(list.Owner, list.ID)
+	if _, ok := m.lists[list.Key]; !ok {
+		return ErrNotFound
+	}
+	list.Items = append([]string{}, list.Items...)
+	m.lists[list.Key] = list
+	return nil
+}
+
+func (m *memoryWatchlistStore) Delete(ctx context.Context, owner string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := watchlistKey(owner, id)
+	if _, ok := m.lists[key]; !ok {
+		return ErrNotFound
+	}
+	delete(m.lists, key)
+	return nil
+}
+
+func (m *memoryWatchlistStore) ChangeOwner(ctx context.Context, owner string, newOwner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, list := range m.lists {
+		if list.Owner != owner {
+			continue
+		}
+		delete(m.lists, key)
+		list.Owner = newOwner
+		list.Key = watchlistKey(newOwner, list.ID)
+		if _, ok := m.lists[list.Key]; !ok {
+			m.lists[list.Key] = list
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+//WatchlistStore backed by the mongo watchlists collection, which has an index
+//on owner. Documents are keyed by their owner and id together.
+type mongoWatchlistStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoWatchlistStore(db *mongo.Database) WatchlistStore {
+	return mongoWatchlistStore{collection: db.Collection("watchlists")}
+}
+
+func (m mongoWatchlistStore) Create(ctx context.Context, list Watchlist) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	list.Key = watchlistKey(list.Owner, list.ID)
+	_, err := m.collection.InsertOne(ctx, list)
+	if _, ok := err.(mongo.WriteException); ok {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (m mongoWatchlistStore) Get(ctx context.Context, owner string, id string) (Watchlist, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var list Watchlist
+	err := m.collection.FindOne(ctx, bson.M{"_id": watchlistKey(owner, id)}).Decode(&list)
+	if err == mongo.ErrNoDocuments {
+		return list, ErrNotFound
+	}
+	return list, err
+}
+
+func (m mongoWatchlistStore) List(ctx context.Context, owner string) ([]Watchlist, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	cur, err := m.collection.Find(ctx, bson.M{"owner": owner}, options.Find().SetSort(bson.M{"createdAt": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var lists []Watchlist
+	for cur.Next(ctx) {
+		var list Watchlist
+		if err := cur.Decode(&list); err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	return lists, cur.Err()
+}
+
+func (m mongoWatchlistStore) Replace(ctx context.Context, list Watchlist) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	list.Key = watchlistKey(list.Owner, list.ID)
+	res, err := m.collection.ReplaceOne(ctx, bson.M{"_id": list.Key}, list)
+	if err != nil {
+		return err
+	} else if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m mongoWatchlistStore) Delete(ctx context.Context, owner string, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	res, err := m.collection.DeleteOne(ctx, bson.M{"_id": watchlistKey(owner, id)})
+	if err != nil {
+		return err
+	} else if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//The id of each document has the owner in it, so lists are stored again under
+//the new owner before the old ones are deleted
+func (m mongoWatchlistStore) ChangeOwner(ctx context.Context, owner string, newOwner string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	lists, err := m.List(ctx, owner)
+	if err != nil {
+		return err
+	}
+	for _, list := range lists {
+		list.Owner = newOwner
+		if err := m.Create(ctx, list); err != nil && err != ErrDuplicate {
+			return err
+		}
+	}
+	_, err = m.collection.DeleteMany(ctx, bson.M{"owner": owner})
+	return err
+}
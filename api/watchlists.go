@@ -0,0 +1,370 @@
+package api
+
+import (
+	"DiscoveryStreams/config"
+	"DiscoveryStreams/internals"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Id every user's default list goes by. It only gets stored once something
+//is added to it.
+const favoritesListID = "favorites"
+
+//An ordered list of streams a user saved
+type Watchlist struct {
+	Key     string `json:"-" bson:"_id"`
+	ID      string `json:"id" bson:"id"`
+	Owner   string `json:"-" bson:"owner"`
+	Name    string `json:"name" bson:"name"`
+	Default bool   `json:"default" bson:"default"`
+	//Stream ids in the order the user put them in
+	Items     []string  `json:"-" bson:"items"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+func watchlistKey(owner string, id string) string {
+	return owner + ":" + id
+}
+
+func favoritesList(owner string) Watchlist {
+	now := time.Now()
+	return Watchlist{ID: favoritesListID, Owner: owner, Name: "Favorites", Default: true, Items: []string{}, CreatedAt: now, UpdatedAt: now}
+}
+
+//Struct to give watchlist endpoints access to where lists are stored, the
+//streams in them, and logging
+type WatchlistsController struct {
+	lists   WatchlistStore
+	streams *StreamController
+	//How many streams a list can hold, WATCHLIST_MAX_ITEMS (default 500)
+	maxItems int
+	*config.Tools
+}
+
+func NewWatchlistsController(lists WatchlistStore, streams *StreamController, tools *config.Tools) *WatchlistsController {
+	return &WatchlistsController{
+		lists:    lists,
+		streams:  streams,
+		maxItems: config.GetInt("WATCHLIST_MAX_ITEMS", 500),
+		Tools:    tools,
+	}
+}
+
+func (c *WatchlistsController) respondDBError(w http.ResponseWriter, r *http.Request, err error) {
+	c.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+	internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+}
+
+//Finds the signed in user's list in the url. The favorites list is made up
+//when it hasn't been stored yet. It responds with an error and returns
+//false when there is no such list.
+func (c *WatchlistsController) listFromURL(w http.ResponseWriter, r *http.Request) (Watchlist, bool) {
+	owner := emailFromContext(r.Context())
+	id := chi.URLParam(r, "listId")
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	list, err := c.lists.Get(ctx, owner, id)
+	if err == ErrNotFound && id == favoritesListID {
+		return favoritesList(owner), true
+	} else if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoListError)
+		return list, false
+	} else if err != nil {
+		c.respondDBError(w, r, err)
+		return list, false
+	}
+	return list, true
+}
+
+//Stores a changed list, storing the favorites list the first time it changes
+func (c *WatchlistsController) saveList(ctx context.Context, list Watchlist) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	list.UpdatedAt = time.Now()
+	err := c.lists.Replace(ctx, list)
+	if err == ErrNotFound && list.Default {
+		err = c.lists.Create(ctx, list)
+		if err == ErrDuplicate {
+			//another request stored the favorites list first
+			err = c.lists.Replace(ctx, list)
+		}
+	}
+	return err
+}
+
+//A list as it is listed, without its streams
+type watchlistSummary struct {
+	Watchlist
+	ItemCount int `json:"itemCount"`
+}
+
+//Responds with a list and its streams. The streams are read from the cache
+//without their ads, which players get when they open one. Streams that were
+//deleted are left out.
+func (c *WatchlistsController) respondWithStreams(w http.ResponseWriter, r *http.Request, list Watchlist, status int) {
+	byID, err := c.streams.cachedStreams(r.Context(), list.Items)
+	if err != nil {
+		respondStreamError(w, err)
+		return
+	}
+	streams := []Stream{}
+	for _, id := range list.Items {
+		if stream, ok := byID[id]; ok {
+			streams = append(streams, stream.forPrincipal(PrincipalFromContext(r.Context())))
+		}
+	}
+
+	res, _ := json.Marshal(struct {
+		Watchlist
+		Items []Stream `json:"items"`
+	}{list, streams})
+	internals.RespondAsJson(w, res, status)
+}
+
+//Lists the signed in user's lists, favorites first, without their streams
+func (c *WatchlistsController) ListWatchlists(w http.ResponseWriter, r *http.Request) {
+	owner := emailFromContext(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	lists, err := c.lists.List(ctx, owner)
+	if err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+
+	summaries := []watchlistSummary{summarize(favoritesList(owner))}
+	for _, list := range lists {
+		if list.Default {
+			summaries[0] = summarize(list)
+		} else {
+			summaries = append(summaries, summarize(list))
+		}
+	}
+	res, _ := json.Marshal(summaries)
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+func summarize(list Watchlist) watchlistSummary {
+	return watchlistSummary{Watchlist: list, ItemCount: len(list.Items)}
+}
+
+//Reads {"name"} from a request body, responding with an error and returning
+//false when it isn't a valid list name
+func listName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return "", false
+	}
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > 100 {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.ListNameError)
+		return "", false
+	}
+	return name, true
+}
+
+//Makes a named list from {"name"}
+func (c *WatchlistsController) CreateWatchlist(w http.ResponseWriter, r *http.Request) {
+	name, ok := listName(w, r)
+	if !ok {
+		return
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	now := time.Now()
+	list := Watchlist{ID: id.String(), Owner: emailFromContext(r.Context()), Name: name, Items: []string{}, CreatedAt: now, UpdatedAt: now}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := c.lists.Create(ctx, list); err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(summarize(list))
+	internals.RespondAsJson(w, res, http.StatusCreated)
+}
+
+//Returns the list in the url with its streams in order
+func (c *WatchlistsController) GetWatchlist(w http.ResponseWriter, r *http.Request) {
+	list, ok := c.listFromURL(w, r)
+	if !ok {
+		return
+	}
+	c.respondWithStreams(w, r, list, http.StatusOK)
+}
+
+//Renames the list in the url with {"name"}. The favorites list keeps its name.
+func (c *WatchlistsController) RenameWatchlist(w http.ResponseWriter, r *http.Request) {
+	list, ok := c.listFromURL(w, r)
+	if !ok {
+		return
+	}
+	if list.Default {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DefaultListError)
+		return
+	}
+	if list.Name, ok = listName(w, r); !ok {
+		return
+	}
+	if err := c.saveList(r.Context(), list); err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	res, _ := json.Marshal(summarize(list))
+	internals.RespondAsJson(w, res, http.StatusOK)
+}
+
+//Deletes the list in the url. The favorites list can't be deleted.
+func (c *WatchlistsController) DeleteWatchlist(w http.ResponseWriter, r *http.Request) {
+	if chi.URLParam(r, "listId") == favoritesListID {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.DefaultListError)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	err := c.lists.Delete(ctx, emailFromContext(r.Context()), chi.URLParam(r, "listId"))
+	if err == ErrNotFound {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoListError)
+		return
+	} else if err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
+
+//Adds {"streamId"} to the list in the url, at the end or at the 0 based
+//"position" given. Full lists give a 409.
+func (c *WatchlistsController) AddWatchlistItem(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		StreamID string `json:"streamId"`
+		Position *int   `json:"position"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	list, ok := c.listFromURL(w, r)
+	if !ok {
+		return
+	}
+	if len(list.Items) >= c.maxItems {
+		internals.RespondAsErrorJson(w, http.StatusConflict, internals.ListFullError)
+		return
+	}
+	position := len(list.Items)
+	if body.Position != nil {
+		if *body.Position < 0 || *body.Position > len(list.Items) {
+			internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.ListPositionError)
+			return
+		}
+		position = *body.Position
+	}
+	for _, item := range list.Items {
+		if item == body.StreamID {
+			internals.RespondAsErrorJson(w, http.StatusConflict, internals.DuplicateListItemError)
+			return
+		}
+	}
+	if _, err := c.streams.cachedStream(r.Context(), body.StreamID); err != nil {
+		respondStreamError(w, err)
+		return
+	}
+
+	list.Items = append(list.Items[:position], append([]string{body.StreamID}, list.Items[position:]...)...)
+	if err := c.saveList(r.Context(), list); err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	c.respondWithStreams(w, r, list, http.StatusOK)
+}
+
+//Removes the stream in the url from the list in the url
+func (c *WatchlistsController) RemoveWatchlistItem(w http.ResponseWriter, r *http.Request) {
+	list, ok := c.listFromURL(w, r)
+	if !ok {
+		return
+	}
+	streamID := chi.URLParam(r, "streamId")
+	items := []string{}
+	for _, item := range list.Items {
+		if item != streamID {
+			items = append(items, item)
+		}
+	}
+	if len(items) == len(list.Items) {
+		internals.RespondAsErrorJson(w, http.StatusNotFound, internals.NoListItemError)
+		return
+	}
+
+	list.Items = items
+	if err := c.saveList(r.Context(), list); err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	internals.RespondAsJson(w, nil, http.StatusNoContent)
+}
+
+//Reorders the list in the url to {"items": [<stream ids>]}. The ids have to
+//be in the list, each once. Ones left out, like deleted streams that aren't
+//shown, keep their order after them.
+func (c *WatchlistsController) ReorderWatchlist(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Items []string `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.InvalidBodyError)
+		return
+	}
+	list, ok := c.listFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	left := map[string]bool{}
+	for _, item := range list.Items {
+		left[item] = true
+	}
+	for _, item := range body.Items {
+		if !left[item] {
+			internals.RespondAsErrorJson(w, http.StatusBadRequest, internals.ListOrderError)
+			return
+		}
+		delete(left, item)
+	}
+	items := append([]string{}, body.Items...)
+	for _, item := range list.Items {
+		if left[item] {
+			items = append(items, item)
+		}
+	}
+
+	list.Items = items
+	if err := c.saveList(r.Context(), list); err != nil {
+		c.respondDBError(w, r, err)
+		return
+	}
+	c.respondWithStreams(w, r, list, http.StatusOK)
+}
+
+//Keeps a user's lists after their email changes. It is registered with
+//UsersController.OnEmailChange.
+func (c *WatchlistsController) ChangeOwner(ctx context.Context, email string, newEmail string) error {
+	return c.lists.ChangeOwner(ctx, email, newEmail)
+}
@@ -1,4 +1,7 @@
 #!/bin/bash
 mongoimport --db discovery --file /docker-entrypoint-initdb.d/streams.json --jsonArray
 mongoimport --db discovery --file /docker-entrypoint-initdb.d/users.json --jsonArray
-mongo discovery --eval "db.users.createIndex( { email: 1 }, { unique: true } )"
\ No newline at end of file
+mongo discovery --eval "db.users.createIndex( { email: 1 }, { unique: true } )"
+mongo discovery --eval "db.apikeys.createIndex( { owner: 1 } )"
+mongo discovery --eval "db.progress.createIndex( { email: 1, updatedAt: -1 } )"
+mongo discovery --eval "db.watchlists.createIndex( { owner: 1 } )"
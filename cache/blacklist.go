@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"time"
+)
+
+//Tokens revoked before they expire, such as on logout, by their jti claim
+type TokenBlacklist interface {
+	//Revokes the token with jti for ttl, which should be the time it has left
+	Revoke(jti string, ttl time.Duration) error
+	IsRevoked(jti string) (bool, error)
+}
+
+//Blacklist that keeps revoked token ids as keys in a Cache
+type cacheBlacklist struct {
+	cache Cache
+}
+
+func NewTokenBlacklist(c Cache) TokenBlacklist {
+	return cacheBlacklist{cache: c}
+}
+
+func revokedKey(jti string) string {
+	return "revoked:" + jti
+}
+
+func (b cacheBlacklist) Revoke(jti string, ttl time.Duration) error {
+	return b.cache.Set(revokedKey(jti), []byte("true"), ttl)
+}
+
+func (b cacheBlacklist) IsRevoked(jti string) (bool, error) {
+	return b.cache.Exists(revokedKey(jti))
+}
@@ -0,0 +1,33 @@
+//Package cache defines the key value cache the API keeps responses, ads,
+//locks and revoked tokens in, with redis and in-memory implementations.
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+//Returned by Get when a key doesn't exist or has expired
+var ErrMiss = errors.New("cache miss")
+
+//Key value cache with expiring keys. A ttl of 0 keeps a key until it is deleted.
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	//Sets key only if it doesn't exist yet and returns whether it did
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	Del(keys ...string) error
+	//Deletes key only if it still holds value and returns whether it did
+	DelIfEqual(key string, value []byte) (bool, error)
+	Exists(key string) (bool, error)
+	//Increments the integer at key, setting ttl when the key is created
+	Incr(key string, ttl time.Duration) (int64, error)
+	//Returns how long until key expires, or a negative duration if it
+	//doesn't exist or never expires
+	TTL(key string) (time.Duration, error)
+	//Lists every key starting with prefix
+	Keys(prefix string) ([]string, error)
+	//Deletes every key starting with prefix
+	DelPrefix(prefix string) error
+	Close() error
+}
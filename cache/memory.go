@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+//Cache kept in process memory, for tests and running without redis.
+//Expired keys are dropped when they are next looked at.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{entries: map[string]memoryEntry{}, now: time.Now}
+}
+
+//Returns the live entry at key. The caller must hold m.mu.
+func (m *Memory) lookup(key string) (memoryEntry, bool) {
+	e, ok := m.entries[key]
+	if ok && e.expired(m.now()) {
+		delete(m.entries, key)
+		return e, false
+	}
+	return e, ok
+}
+
+func (m *Memory) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return m.now().Add(ttl)
+}
+
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lookup(key)
+	if !ok {
+		return nil, ErrMiss
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = memoryEntry{value: append([]byte(nil), value...), expires: m.expiry(ttl)}
+	return nil
+}
+
+func (m *Memory) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookup(key); ok {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{value: append([]byte(nil), value...), expires: m.expiry(ttl)}
+	return true, nil
+}
+
+func (m *Memory) Del(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+func (m *Memory) DelIfEqual(key string, value []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.lookup(key); !ok || string(e.value) != string(value) {
+		return false, nil
+	}
+	delete(m.entries, key)
+	return true, nil
+}
+
+func (m *Memory) Exists(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.lookup(key)
+	return ok, nil
+}
+
+func (m *Memory) Incr(key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lookup(key)
+	if !ok {
+		e = memoryEntry{value: []byte("0"), expires: m.expiry(ttl)}
+	}
+	n, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	m.entries[key] = e
+	return n, nil
+}
+
+func (m *Memory) TTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.lookup(key)
+	if !ok || e.expires.IsZero() {
+		return -1, nil
+	}
+	return e.expires.Sub(m.now()), nil
+}
+
+func (m *Memory) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.entries {
+		if _, ok := m.lookup(key); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (m *Memory) DelPrefix(prefix string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.entries, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory_Expiry(t *testing.T) {
+	now := time.Now()
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	m.Set("a", []byte("1"), time.Second)
+	m.Set("b", []byte("2"), 0)
+	if v, err := m.Get("a"); err != nil || string(v) != "1" {
+		t.Fatalf("got %s, %v", v, err)
+	}
+	if ttl, _ := m.TTL("a"); ttl != time.Second {
+		t.Fatalf("ttl was %s instead of 1s", ttl)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := m.Get("a"); err != ErrMiss {
+		t.Fatalf("expected ErrMiss for an expired key instead of %v", err)
+	}
+	if ok, _ := m.Exists("b"); !ok {
+		t.Fatal("a key without a ttl expired")
+	}
+	if ttl, _ := m.TTL("b"); ttl >= 0 {
+		t.Fatalf("ttl of a key without one was %s", ttl)
+	}
+}
+
+func TestMemory_SetNX(t *testing.T) {
+	m := NewMemory()
+	if ok, _ := m.SetNX("lock", []byte("a"), time.Minute); !ok {
+		t.Fatal("SetNX didn't set a missing key")
+	}
+	if ok, _ := m.SetNX("lock", []byte("b"), time.Minute); ok {
+		t.Fatal("SetNX overwrote an existing key")
+	}
+	if v, _ := m.Get("lock"); string(v) != "a" {
+		t.Fatalf("lock holds %s instead of a", v)
+	}
+}
+
+func TestMemory_DelIfEqual(t *testing.T) {
+	m := NewMemory()
+	m.Set("key", []byte("old"), 0)
+	m.Set("key", []byte("new"), 0)
+
+	if deleted, err := m.DelIfEqual("key", []byte("old")); err != nil || deleted {
+		t.Fatalf("a key holding another value was deleted: %v", err)
+	}
+	if deleted, err := m.DelIfEqual("key", []byte("new")); err != nil || !deleted {
+		t.Fatalf("a key holding the value wasn't deleted: %v", err)
+	}
+	if _, err := m.Get("key"); err != ErrMiss {
+		t.Fatalf("got %v instead of a miss after deleting", err)
+	}
+}
+
+func TestMemory_Incr(t *testing.T) {
+	now := time.Now()
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	for i := int64(1); i <= 3; i++ {
+		if n, err := m.Incr("count", time.Minute); err != nil || n != i {
+			t.Fatalf("got %d, %v instead of %d", n, err, i)
+		}
+		now = now.Add(10 * time.Second)
+	}
+
+	//the ttl is only set when the counter is created
+	if ttl, _ := m.TTL("count"); ttl != 30*time.Second {
+		t.Fatalf("ttl was %s instead of 30s", ttl)
+	}
+}
+
+func TestMemory_KeysAndDelPrefix(t *testing.T) {
+	m := NewMemory()
+	m.Set("captions:a:en.vtt", []byte("x"), 0)
+	m.Set("captions:a:fr.vtt", []byte("x"), 0)
+	m.Set("captions:ab:en.vtt", []byte("x"), 0)
+
+	if keys, _ := m.Keys("captions:a"); len(keys) != 3 {
+		t.Fatalf("%v were listed instead of 3 keys", keys)
+	}
+	m.DelPrefix("captions:a:")
+	if keys, _ := m.Keys("captions:a"); len(keys) != 1 || keys[0] != "captions:ab:en.vtt" {
+		t.Fatalf("%v were listed instead of captions:ab:en.vtt", keys)
+	}
+
+	for key, want := range map[string]bool{"captions:a:en.vtt": false, "captions:a:fr.vtt": false, "captions:ab:en.vtt": true} {
+		if ok, _ := m.Exists(key); ok != want {
+			t.Fatalf("%s exists is %t instead of %t", key, ok, want)
+		}
+	}
+}
+
+func TestTokenBlacklist(t *testing.T) {
+	b := NewTokenBlacklist(NewMemory())
+	if revoked, _ := b.IsRevoked("tkn"); revoked {
+		t.Fatal("a token was revoked before Revoke")
+	}
+	b.Revoke("tkn", time.Minute)
+	if revoked, _ := b.IsRevoked("tkn"); !revoked {
+		t.Fatal("a revoked token wasn't revoked")
+	}
+}
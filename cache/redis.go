@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"github.com/go-redis/redis"
+	"strings"
+	"time"
+)
+
+//Escapes characters that redis treats as wildcards in SCAN patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+//Deletes KEYS[1] if it holds ARGV[1], in one step so a value set in between
+//isn't lost
+var delIfEqualScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+//Increments KEYS[1] and sets its ttl to ARGV[1] milliseconds when it is
+//created, in one step so a counter can't be left without one
+var incrScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n`)
+
+//Cache backed by redis
+type Redis struct {
+	client *redis.Client
+}
+
+func NewRedis(client *redis.Client) *Redis {
+	return &Redis{client: client}
+}
+
+func (r *Redis) Get(key string) ([]byte, error) {
+	val, err := r.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrMiss
+	}
+	return val, err
+}
+
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	return r.client.Set(key, value, ttl).Err()
+}
+
+func (r *Redis) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(key, value, ttl).Result()
+}
+
+func (r *Redis) Del(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.client.Del(keys...).Err()
+}
+
+func (r *Redis) DelIfEqual(key string, value []byte) (bool, error) {
+	n, err := delIfEqualScript.Run(r.client, []string{key}, value).Int64()
+	return n == 1, err
+}
+
+func (r *Redis) Exists(key string) (bool, error) {
+	n, err := r.client.Exists(key).Result()
+	return n == 1, err
+}
+
+func (r *Redis) Incr(key string, ttl time.Duration) (int64, error) {
+	return incrScript.Run(r.client, []string{key}, int64(ttl/time.Millisecond)).Int64()
+}
+
+func (r *Redis) TTL(key string) (time.Duration, error) {
+	return r.client.PTTL(key).Result()
+}
+
+func (r *Redis) Keys(prefix string) ([]string, error) {
+	var all []string
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, globEscaper.Replace(prefix)+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, keys...)
+		if cursor = next; cursor == 0 {
+			return all, nil
+		}
+	}
+}
+
+func (r *Redis) DelPrefix(prefix string) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, globEscaper.Replace(prefix)+"*", 100).Result()
+		if err != nil {
+			return err
+		}
+		if err := r.Del(keys...); err != nil {
+			return err
+		}
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,186 @@
+//Package captions parses and writes caption files so a caption stored in one
+//format can be served in another. SCC (CEA-608), SRT, TTML/DFXP and WebVTT can
+//be read and WebVTT, SRT and TTML can be written.
+package captions
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//A single caption shown on screen from Start until End.
+//Text holds plain text with lines separated by \n.
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+var ErrUnsupportedFormat = errors.New("unsupported caption format")
+var ErrInvalidCaptions = errors.New("invalid caption data")
+
+//Formats that can be parsed
+var readable = map[string]func([]byte) ([]Cue, error){
+	"vtt":  ParseVTT,
+	"srt":  ParseSRT,
+	"ttml": ParseTTML,
+	"dfxp": ParseTTML,
+	"scc":  ParseSCC,
+}
+
+//Formats that can be written
+var writable = map[string]func([]Cue, string) []byte{
+	"vtt":  WriteVTT,
+	"srt":  WriteSRT,
+	"ttml": WriteTTML,
+	"dfxp": WriteTTML,
+}
+
+var contentTypes = map[string]string{
+	"vtt":  "text/vtt; charset=utf-8",
+	"srt":  "application/x-subrip; charset=utf-8",
+	"ttml": "application/ttml+xml; charset=utf-8",
+	"dfxp": "application/ttml+xml; charset=utf-8",
+	"scc":  "text/plain; charset=utf-8",
+}
+
+//Returns true if captions can be parsed from the format
+func CanRead(format string) bool {
+	_, ok := readable[format]
+	return ok
+}
+
+//Returns true if captions can be written in the format
+func CanWrite(format string) bool {
+	_, ok := writable[format]
+	return ok
+}
+
+//Returns the http Content-Type for a caption format
+func ContentType(format string) string {
+	return contentTypes[format]
+}
+
+//Parses caption data in the given format into cues ordered by start time.
+//Cues starting together keep the order they are in the file.
+func Parse(format string, data []byte) ([]Cue, error) {
+	parse, ok := readable[format]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	cues, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+	return cues, nil
+}
+
+//Writes cues in the given format. lang is a BCP-47 tag used by formats
+//that carry the caption language and may be empty.
+func Write(format string, cues []Cue, lang string) ([]byte, error) {
+	write, ok := writable[format]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	return write(cues, lang), nil
+}
+
+//Parses data in the from format and writes it in the to format
+func Convert(data []byte, from string, to string, lang string) ([]byte, error) {
+	cues, err := Parse(from, data)
+	if err != nil {
+		return nil, err
+	}
+	return Write(to, cues, lang)
+}
+
+//Normalizes line endings and drops a leading byte order mark
+func normalize(data []byte) string {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	return strings.Replace(text, "\r", "\n", -1)
+}
+
+//Splits text into blocks separated by blank lines
+func blocks(text string) [][]string {
+	var out [][]string
+	var current []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			if len(current) != 0 {
+				out = append(out, current)
+				current = nil
+			}
+			continue
+		}
+		current = append(current, line)
+	}
+	if len(current) != 0 {
+		out = append(out, current)
+	}
+	return out
+}
+
+//Parses hh:mm:ss.ttt or mm:ss.ttt timestamps. SRT's comma separator is also accepted.
+func parseTimestamp(ts string) (time.Duration, error) {
+	ts = strings.Replace(strings.TrimSpace(ts), ",", ".", 1)
+	parts := strings.Split(ts, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("%s: bad timestamp %q", ErrInvalidCaptions, ts)
+	}
+
+	var hours, minutes int
+	var seconds float64
+	var err error
+	if len(parts) == 3 {
+		if _, err = fmt.Sscanf(parts[0], "%d", &hours); err != nil {
+			return 0, fmt.Errorf("%s: bad timestamp %q", ErrInvalidCaptions, ts)
+		}
+		parts = parts[1:]
+	}
+	if _, err = fmt.Sscanf(parts[0], "%d", &minutes); err != nil {
+		return 0, fmt.Errorf("%s: bad timestamp %q", ErrInvalidCaptions, ts)
+	}
+	if _, err = fmt.Sscanf(parts[1], "%f", &seconds); err != nil {
+		return 0, fmt.Errorf("%s: bad timestamp %q", ErrInvalidCaptions, ts)
+	}
+
+	return time.Duration(hours)*time.Hour +
+		time.Duration(minutes)*time.Minute +
+		time.Duration(seconds*float64(time.Second)+0.5), nil
+}
+
+//Parses the "start --> end" line shared by WebVTT and SRT. Anything after
+//the end timestamp, such as WebVTT cue settings, is ignored.
+func parseTiming(line string) (time.Duration, time.Duration, error) {
+	parts := strings.SplitN(line, "-->", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%s: bad timing line %q", ErrInvalidCaptions, line)
+	}
+	start, err := parseTimestamp(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(parts[1])
+	if len(fields) == 0 {
+		return 0, 0, fmt.Errorf("%s: bad timing line %q", ErrInvalidCaptions, line)
+	}
+	end, err := parseTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+//Formats a duration as hh:mm:ss<sep>mmm
+func formatTimestamp(d time.Duration, sep string) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := int64(d / time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
@@ -0,0 +1,131 @@
+package captions
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParse_Fixtures(t *testing.T) {
+	fixtures := []struct {
+		file   string
+		format string
+		want   []Cue
+	}{
+		{"sample.vtt", "vtt", []Cue{
+			{Start: 1 * time.Second, End: 4 * time.Second, Text: "Hello,\nworld"},
+			{Start: 5500 * time.Millisecond, End: 7250 * time.Millisecond, Text: "Second & last"},
+		}},
+		{"sample.srt", "srt", []Cue{
+			{Start: 1 * time.Second, End: 4 * time.Second, Text: "Hello,\nworld"},
+			{Start: 5500 * time.Millisecond, End: 7250 * time.Millisecond, Text: "Second & last"},
+		}},
+		{"sample.ttml", "ttml", []Cue{
+			{Start: 1 * time.Second, End: 4 * time.Second, Text: "Hello,\nworld"},
+			{Start: 5500 * time.Millisecond, End: 7250 * time.Millisecond, Text: "Second & last"},
+		}},
+		{"sample.scc", "scc", []Cue{
+			{Start: 44 * sccFrame, End: 120 * sccFrame, Text: "Hello,\nworld"},
+			{Start: 161 * sccFrame, End: 210 * sccFrame, Text: "♪ la la"},
+		}},
+	}
+
+	for _, f := range fixtures {
+		cues, err := Parse(f.format, readFixture(t, f.file))
+		if err != nil {
+			t.Fatalf("%s: %s", f.file, err)
+		}
+		if len(cues) != len(f.want) {
+			t.Fatalf("%s: got %d cues instead of %d: %+v", f.file, len(cues), len(f.want), cues)
+		}
+		for i := range cues {
+			if cues[i] != f.want[i] {
+				t.Fatalf("%s: cue %d was %+v instead of %+v", f.file, i, cues[i], f.want[i])
+			}
+		}
+	}
+}
+
+func TestParse_OrdersByStart(t *testing.T) {
+	srt := "1\n00:00:05,000 --> 00:00:06,000\nLater\n\n2\n00:00:01,000 --> 00:00:02,000\nFirst\n\n" +
+		"3\n00:00:05,000 --> 00:00:07,000\nAlso later\n"
+	cues, err := Parse("srt", []byte(srt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cues) != 3 || cues[0].Text != "First" || cues[1].Text != "Later" || cues[2].Text != "Also later" {
+		t.Fatalf("cues weren't ordered by start time: %+v", cues)
+	}
+}
+
+func TestConvert_SRTToVTT(t *testing.T) {
+	out, err := Convert(readFixture(t, "sample.srt"), "srt", "vtt", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `WEBVTT
+
+1
+00:00:01.000 --> 00:00:04.000
+Hello,
+world
+
+2
+00:00:05.500 --> 00:00:07.250
+Second &amp; last
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestConvert_RoundTrips(t *testing.T) {
+	source, err := Parse("scc", readFixture(t, "sample.scc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"vtt", "srt", "ttml"} {
+		out, err := Write(format, source, "en")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cues, err := Parse(format, out)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", format, err, out)
+		}
+		if len(cues) != len(source) {
+			t.Fatalf("%s: got %d cues instead of %d", format, len(cues), len(source))
+		}
+		for i := range cues {
+			//written timestamps only keep milliseconds
+			if cues[i].Text != source[i].Text || cues[i].Start != source[i].Start.Truncate(time.Millisecond) {
+				t.Fatalf("%s: cue %d was %+v instead of %+v", format, i, cues[i], source[i])
+			}
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	if _, err := Parse("vtt", []byte("not captions")); err == nil {
+		t.Fatal("expected an error for vtt without a header")
+	}
+	if _, err := Parse("scc", []byte("Scenarist_SCC V1.0\n\nnot a timecode")); err == nil {
+		t.Fatal("expected an error for a bad scc line")
+	}
+	if _, err := Parse("ttml", []byte("<html></html>")); err == nil {
+		t.Fatal("expected an error for ttml without a tt root")
+	}
+	if _, err := Write("scc", nil, "en"); err != ErrUnsupportedFormat {
+		t.Fatalf("expected ErrUnsupportedFormat instead of %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package captions
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//SCC timecodes count frames at 29.97 frames per second
+const sccFrame = time.Second * 1001 / 30000
+
+//How long a caption still on screen at the end of the file stays up
+const sccTrailingCue = 3 * time.Second
+
+var sccLineRegex = regexp.MustCompile(`^(\d{2}):(\d{2}):(\d{2})([:;.,])(\d{2})\s+(.*)$`)
+
+//CEA-608 caption modes
+const (
+	popOn = iota
+	rollUp
+	paintOn
+)
+
+//Characters in the basic set that differ from ASCII
+var sccBasicChars = map[byte]rune{
+	0x2a: 'á', 0x5c: 'é', 0x5e: 'í', 0x5f: 'ó', 0x60: 'ú',
+	0x7b: 'ç', 0x7c: '÷', 0x7d: 'Ñ', 0x7e: 'ñ', 0x7f: '█',
+}
+
+//Special characters sent as 0x11 0x30-0x3f
+var sccSpecialChars = []rune{
+	'®', '°', '½', '¿', '™', '¢', '£', '♪', 'à', ' ', 'è', 'â', 'ê', 'î', 'ô', 'û',
+}
+
+//Extended characters sent as 0x12 0x20-0x3f
+var sccExtendedChars12 = []rune{
+	'Á', 'É', 'Ó', 'Ú', 'Ü', 'ü', '‘', '¡', '*', '\'', '—', '©', '℠', '•', '“', '”',
+	'À', 'Â', 'Ç', 'È', 'Ê', 'Ë', 'ë', 'Î', 'Ï', 'ï', 'Ô', 'Ù', 'ù', 'Û', '«', '»',
+}
+
+//Extended characters sent as 0x13 0x20-0x3f
+var sccExtendedChars13 = []rune{
+	'Ã', 'ã', 'Í', 'Ì', 'ì', 'Ò', 'ò', 'Õ', 'õ', '{', '}', '\\', '^', '_', '|', '~',
+	'Ä', 'ä', 'Ö', 'ö', 'ß', '¥', '¤', '│', 'Å', 'å', 'Ø', 'ø', '┌', '┐', '└', '┘',
+}
+
+//Caption memory is kept as text per screen row
+type sccMemory map[int][]rune
+
+func (m sccMemory) text() string {
+	rows := make([]int, 0, len(m))
+	for row := range m {
+		rows = append(rows, row)
+	}
+	sort.Ints(rows)
+
+	var lines []string
+	for _, row := range rows {
+		if line := strings.TrimSpace(string(m[row])); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Decodes the CEA-608 byte pairs of channel CC1
+type sccDecoder struct {
+	mode      int
+	rollRows  int
+	row       int
+	channel   int
+	displayed sccMemory
+	buffer    sccMemory
+	lastCtrl  [2]byte
+	shown     string
+	shownAt   time.Duration
+	cues      []Cue
+}
+
+//Parses Scenarist SCC files holding CEA-608 captions. Pop-on, roll-up and
+//paint-on captions on channel CC1 are decoded.
+func ParseSCC(data []byte) ([]Cue, error) {
+	text := normalize(data)
+	if !strings.HasPrefix(text, "Scenarist_SCC") {
+		return nil, fmt.Errorf("%s: missing Scenarist_SCC header", ErrInvalidCaptions)
+	}
+
+	d := &sccDecoder{row: 15, channel: 1, displayed: sccMemory{}, buffer: sccMemory{}}
+	var last time.Duration
+	for _, line := range strings.Split(text, "\n")[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		m := sccLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s: bad scc line %q", ErrInvalidCaptions, line)
+		}
+		at := sccTimecode(m[1], m[2], m[3], m[4], m[5])
+
+		for _, word := range strings.Fields(m[6]) {
+			pair, err := hex.DecodeString(word)
+			if err != nil || len(pair) != 2 {
+				return nil, fmt.Errorf("%s: bad scc word %q", ErrInvalidCaptions, word)
+			}
+			d.decode(pair[0]&0x7f, pair[1]&0x7f, at)
+			at += sccFrame
+		}
+
+		//roll-up and paint-on captions show up as they are sent
+		if d.mode != popOn {
+			d.show(d.displayed.text(), at)
+		}
+		last = at
+	}
+
+	if d.shown != "" {
+		end := last
+		if end <= d.shownAt {
+			end = d.shownAt + sccTrailingCue
+		}
+		d.show("", end)
+	}
+	return d.cues, nil
+}
+
+//Converts an SCC timecode to time. Timecodes using ; are drop frame.
+func sccTimecode(hh, mm, ss, sep, ff string) time.Duration {
+	h, _ := strconv.Atoi(hh)
+	m, _ := strconv.Atoi(mm)
+	s, _ := strconv.Atoi(ss)
+	f, _ := strconv.Atoi(ff)
+
+	frames := ((h*60+m)*60+s)*30 + f
+	if sep == ";" || sep == "," {
+		minutes := h*60 + m
+		frames -= 2 * (minutes - minutes/10)
+	}
+	return time.Duration(frames) * sccFrame
+}
+
+//Replaces what is on screen, closing the cue that was showing
+func (d *sccDecoder) show(text string, at time.Duration) {
+	if text == d.shown {
+		return
+	}
+	if d.shown != "" && at > d.shownAt {
+		d.cues = append(d.cues, Cue{Start: d.shownAt, End: at, Text: d.shown})
+	}
+	d.shown = text
+	d.shownAt = at
+}
+
+//Memory that characters are written to in the current mode
+func (d *sccDecoder) target() sccMemory {
+	if d.mode == popOn {
+		return d.buffer
+	}
+	return d.displayed
+}
+
+func (d *sccDecoder) write(r rune) {
+	if d.channel != 1 {
+		return
+	}
+	mem := d.target()
+	mem[d.row] = append(mem[d.row], r)
+}
+
+func (d *sccDecoder) backspace() {
+	if d.channel != 1 {
+		return
+	}
+	mem := d.target()
+	if line := mem[d.row]; len(line) != 0 {
+		mem[d.row] = line[:len(line)-1]
+	}
+}
+
+func (d *sccDecoder) decode(b1 byte, b2 byte, at time.Duration) {
+	//padding
+	if b1 == 0 && b2 == 0 {
+		return
+	}
+
+	if b1 < 0x10 {
+		//extended data services aren't captions
+		d.lastCtrl = [2]byte{}
+		return
+	}
+
+	if b1 >= 0x20 {
+		d.lastCtrl = [2]byte{}
+		d.writeBasic(b1)
+		if b2 >= 0x20 {
+			d.writeBasic(b2)
+		}
+		return
+	}
+
+	//control codes are sent twice, the repeat is skipped
+	if d.lastCtrl == [2]byte{b1, b2} {
+		d.lastCtrl = [2]byte{}
+		return
+	}
+	d.lastCtrl = [2]byte{b1, b2}
+
+	//bit 0x08 of the first byte selects the second channel of a field
+	if b1&0x08 != 0 {
+		d.channel = 2
+	} else {
+		d.channel = 1
+	}
+	b1 &^= 0x08
+
+	switch {
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		if d.channel == 1 {
+			d.control(b2, at)
+		}
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		//tab offsets move the cursor right
+		for i := byte(0); i < b2-0x20; i++ {
+			d.write(' ')
+		}
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.write(sccSpecialChars[b2-0x30])
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		//mid-row style codes take up a space on screen
+		d.write(' ')
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		//extended characters replace the standard character sent before them
+		d.backspace()
+		if b1 == 0x12 {
+			d.write(sccExtendedChars12[b2-0x20])
+		} else {
+			d.write(sccExtendedChars13[b2-0x20])
+		}
+	case b1 >= 0x10 && b1 <= 0x17 && b2 >= 0x40:
+		d.preamble(b1, b2)
+	}
+}
+
+func (d *sccDecoder) writeBasic(b byte) {
+	if r, ok := sccBasicChars[b]; ok {
+		d.write(r)
+		return
+	}
+	d.write(rune(b))
+}
+
+//Preamble address codes move the cursor to a row
+var sccPreambleRows = map[byte][2]int{
+	0x11: {1, 2}, 0x12: {3, 4}, 0x15: {5, 6}, 0x16: {7, 8},
+	0x17: {9, 10}, 0x10: {11, 11}, 0x13: {12, 13}, 0x14: {14, 15},
+}
+
+func (d *sccDecoder) preamble(b1 byte, b2 byte) {
+	if d.channel != 1 {
+		return
+	}
+	rows, ok := sccPreambleRows[b1]
+	if !ok {
+		return
+	}
+	row := rows[0]
+	if b2&0x20 != 0 {
+		row = rows[1]
+	}
+
+	//roll-up captions always write on the base row
+	if d.mode == rollUp {
+		return
+	}
+	d.row = row
+}
+
+func (d *sccDecoder) control(code byte, at time.Duration) {
+	switch code {
+	case 0x20: //resume caption loading
+		d.mode = popOn
+	case 0x21: //backspace
+		d.backspace()
+	case 0x24: //delete to end of row
+		d.target()[d.row] = nil
+	case 0x25, 0x26, 0x27: //roll-up with 2, 3 or 4 rows
+		if d.mode != rollUp {
+			d.displayed = sccMemory{}
+			d.show("", at)
+		}
+		d.mode = rollUp
+		d.rollRows = int(code-0x25) + 2
+		d.row = 15
+	case 0x29: //resume direct captioning
+		d.mode = paintOn
+	case 0x2c: //erase displayed memory
+		d.displayed = sccMemory{}
+		d.show("", at)
+	case 0x2d: //carriage return
+		if d.mode == rollUp {
+			d.roll()
+			d.show(d.displayed.text(), at)
+		}
+	case 0x2e: //erase non-displayed memory
+		d.buffer = sccMemory{}
+	case 0x2f: //end of caption, swaps displayed and non-displayed memory
+		d.displayed, d.buffer = d.buffer, d.displayed
+		d.mode = popOn
+		d.show(d.displayed.text(), at)
+	}
+}
+
+//Moves roll-up rows up one, dropping rows above the roll-up window
+func (d *sccDecoder) roll() {
+	rolled := sccMemory{}
+	for row, line := range d.displayed {
+		if row-1 > d.row-d.rollRows {
+			rolled[row-1] = line
+		}
+	}
+	d.displayed = rolled
+}
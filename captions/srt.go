@@ -0,0 +1,55 @@
+package captions
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//SSA style overrides such as {\an8} that some SRT files carry
+var srtOverrideRegex = regexp.MustCompile(`\{\\[^}]*\}`)
+
+//Parses SubRip (SRT). Formatting tags such as <i> are dropped.
+func ParseSRT(data []byte) ([]Cue, error) {
+	var cues []Cue
+	for _, block := range blocks(normalize(data)) {
+		//the cue counter before the timing line is optional in practice
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			timing = 1
+		}
+		if timing >= len(block) {
+			return nil, fmt.Errorf("%s: cue %q has no timing line", ErrInvalidCaptions, block[0])
+		}
+
+		start, end, err := parseTiming(block[timing])
+		if err != nil {
+			return nil, err
+		}
+
+		var lines []string
+		for _, line := range block[timing+1:] {
+			line = srtOverrideRegex.ReplaceAllString(line, "")
+			lines = append(lines, tagRegex.ReplaceAllString(line, ""))
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: strings.Join(lines, "\n")})
+	}
+	return cues, nil
+}
+
+//Writes cues as SubRip (SRT)
+func WriteSRT(cues []Cue, lang string) []byte {
+	var buf bytes.Buffer
+	for i, cue := range cues {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%d\n%s --> %s\n%s\n",
+			i+1,
+			formatTimestamp(cue.Start, ","),
+			formatTimestamp(cue.End, ","),
+			cue.Text)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,243 @@
+package captions
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var clockTimeRegex = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})(?:(\.\d+)|:(\d+)(?:\.(\d+))?)?$`)
+var offsetTimeRegex = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|m|s|ms|f|t)$`)
+var whitespaceRegex = regexp.MustCompile(`\s+`)
+
+//Frame and tick rates from the <tt> element used to read time expressions
+type ttmlClock struct {
+	frameRate float64
+	tickRate  float64
+}
+
+//Parses a TTML time expression, either clock time (00:00:01.5 or 00:00:01:15)
+//or offset time (1.5s, 1500ms, 45f, 10000000t).
+func (c ttmlClock) parse(expr string) (time.Duration, error) {
+	expr = strings.TrimSpace(expr)
+	if m := clockTimeRegex.FindStringSubmatch(expr); m != nil {
+		hours, _ := strconv.Atoi(m[1])
+		minutes, _ := strconv.Atoi(m[2])
+		seconds, _ := strconv.ParseFloat(m[3]+m[4], 64)
+		if m[5] != "" {
+			frames, _ := strconv.ParseFloat(m[5], 64)
+			seconds += frames / c.frameRate
+		}
+		return time.Duration(hours)*time.Hour +
+			time.Duration(minutes)*time.Minute +
+			time.Duration(seconds*float64(time.Second)+0.5), nil
+	}
+
+	if m := offsetTimeRegex.FindStringSubmatch(expr); m != nil {
+		value, _ := strconv.ParseFloat(m[1], 64)
+		var seconds float64
+		switch m[2] {
+		case "h":
+			seconds = value * 3600
+		case "m":
+			seconds = value * 60
+		case "s":
+			seconds = value
+		case "ms":
+			seconds = value / 1000
+		case "f":
+			seconds = value / c.frameRate
+		case "t":
+			seconds = value / c.tickRate
+		}
+		return time.Duration(seconds*float64(time.Second) + 0.5), nil
+	}
+
+	return 0, fmt.Errorf("%s: bad time expression %q", ErrInvalidCaptions, expr)
+}
+
+func newTTMLClock(tt xml.StartElement) ttmlClock {
+	clock := ttmlClock{frameRate: 30, tickRate: 1}
+	var multiplier = 1.0
+	var tickRate string
+	frameRateSet := false
+	for _, attr := range tt.Attr {
+		switch attr.Name.Local {
+		case "frameRate":
+			if v, err := strconv.ParseFloat(attr.Value, 64); err == nil && v > 0 {
+				clock.frameRate = v
+				frameRateSet = true
+			}
+		case "frameRateMultiplier":
+			var num, den float64
+			if _, err := fmt.Sscanf(attr.Value, "%g %g", &num, &den); err == nil && num > 0 && den > 0 {
+				multiplier = num / den
+			}
+		case "tickRate":
+			tickRate = attr.Value
+		}
+	}
+	clock.frameRate *= multiplier
+
+	if v, err := strconv.ParseFloat(tickRate, 64); err == nil && v > 0 {
+		clock.tickRate = v
+	} else if frameRateSet {
+		clock.tickRate = clock.frameRate
+	}
+	return clock
+}
+
+func attrValue(el xml.StartElement, name string) string {
+	for _, attr := range el.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+//Parses TTML and DFXP. Timing on <body> and <div> elements offsets the
+//<p> elements they contain. Styling and layout are dropped.
+func ParseTTML(data []byte) ([]Cue, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	clock := ttmlClock{frameRate: 30, tickRate: 1}
+
+	var cues []Cue
+	var offsets []time.Duration
+	var current *Cue
+	var text bytes.Buffer
+	depth := 0
+	seenRoot := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", ErrInvalidCaptions, err.Error())
+		}
+
+		switch el := token.(type) {
+		case xml.StartElement:
+			if !seenRoot {
+				if el.Name.Local != "tt" {
+					return nil, fmt.Errorf("%s: missing tt root element", ErrInvalidCaptions)
+				}
+				clock = newTTMLClock(el)
+				seenRoot = true
+			}
+
+			if current != nil {
+				depth++
+				if el.Name.Local == "br" {
+					text.WriteString("\n")
+				}
+				continue
+			}
+
+			parent := time.Duration(0)
+			if len(offsets) != 0 {
+				parent = offsets[len(offsets)-1]
+			}
+			begin := parent
+			if b := attrValue(el, "begin"); b != "" {
+				offset, err := clock.parse(b)
+				if err != nil {
+					return nil, err
+				}
+				begin += offset
+			}
+
+			if el.Name.Local != "p" {
+				offsets = append(offsets, begin)
+				continue
+			}
+
+			cue := Cue{Start: begin, End: -1}
+			if e := attrValue(el, "end"); e != "" {
+				end, err := clock.parse(e)
+				if err != nil {
+					return nil, err
+				}
+				cue.End = parent + end
+			} else if d := attrValue(el, "dur"); d != "" {
+				dur, err := clock.parse(d)
+				if err != nil {
+					return nil, err
+				}
+				cue.End = begin + dur
+			}
+			current = &cue
+			text.Reset()
+		case xml.CharData:
+			//line breaks in the source are only whitespace, <br/> breaks lines
+			if current != nil {
+				text.WriteString(whitespaceRegex.ReplaceAllString(string(el), " "))
+			}
+		case xml.EndElement:
+			if current == nil {
+				if len(offsets) != 0 {
+					offsets = offsets[:len(offsets)-1]
+				}
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			//cues without an end or duration can't be placed on a timeline
+			if current.End >= 0 {
+				current.Text = collapseTTMLText(text.String())
+				cues = append(cues, *current)
+			}
+			current = nil
+		}
+	}
+
+	if !seenRoot {
+		return nil, fmt.Errorf("%s: missing tt root element", ErrInvalidCaptions)
+	}
+	return cues, nil
+}
+
+//Collapses xml whitespace within each line the way TTML renders it
+func collapseTTMLText(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(whitespaceRegex.ReplaceAllString(line, " ")); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//Writes cues as TTML
+func WriteTTML(cues []Cue, lang string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<tt xmlns="http://www.w3.org/ns/ttml"`)
+	if lang != "" {
+		buf.WriteString(` xml:lang="`)
+		xml.EscapeText(&buf, []byte(lang))
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">\n  <body>\n    <div>\n")
+	for _, cue := range cues {
+		fmt.Fprintf(&buf, `      <p begin="%s" end="%s">`, formatTimestamp(cue.Start, "."), formatTimestamp(cue.End, "."))
+		for i, line := range strings.Split(cue.Text, "\n") {
+			if i > 0 {
+				buf.WriteString("<br/>")
+			}
+			xml.EscapeText(&buf, []byte(line))
+		}
+		buf.WriteString("</p>\n")
+	}
+	buf.WriteString("    </div>\n  </body>\n</tt>\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,80 @@
+package captions
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var tagRegex = regexp.MustCompile(`<[^>]*>`)
+
+var vttEntities = strings.NewReplacer(
+	"&amp;", "&",
+	"&lt;", "<",
+	"&gt;", ">",
+	"&nbsp;", " ",
+	"&lrm;", "",
+	"&rlm;", "",
+)
+
+var vttEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+//Parses WebVTT. Cue markup such as <i> or <v Speaker> is dropped.
+func ParseVTT(data []byte) ([]Cue, error) {
+	text := normalize(data)
+	if !strings.HasPrefix(text, "WEBVTT") {
+		return nil, fmt.Errorf("%s: missing WEBVTT header", ErrInvalidCaptions)
+	}
+
+	var cues []Cue
+	for i, block := range blocks(text) {
+		//first block is the WEBVTT header
+		if i == 0 {
+			continue
+		}
+		first := strings.TrimSpace(block[0])
+		if strings.HasPrefix(first, "NOTE") || first == "STYLE" || first == "REGION" {
+			continue
+		}
+
+		//an optional cue identifier can come before the timing line
+		timing := 0
+		if !strings.Contains(block[0], "-->") {
+			timing = 1
+		}
+		if timing >= len(block) {
+			continue
+		}
+
+		start, end, err := parseTiming(block[timing])
+		if err != nil {
+			return nil, err
+		}
+
+		var lines []string
+		for _, line := range block[timing+1:] {
+			lines = append(lines, vttEntities.Replace(tagRegex.ReplaceAllString(line, "")))
+		}
+		cues = append(cues, Cue{Start: start, End: end, Text: strings.Join(lines, "\n")})
+	}
+	return cues, nil
+}
+
+//Writes cues as WebVTT
+func WriteVTT(cues []Cue, lang string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("WEBVTT\n")
+	for i, cue := range cues {
+		fmt.Fprintf(&buf, "\n%d\n%s --> %s\n%s\n",
+			i+1,
+			formatTimestamp(cue.Start, "."),
+			formatTimestamp(cue.End, "."),
+			vttEscaper.Replace(cue.Text))
+	}
+	return buf.Bytes()
+}
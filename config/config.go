@@ -1,6 +1,9 @@
 package config
 
 import (
+	"DiscoveryStreams/cache"
+	"DiscoveryStreams/mail"
+	"DiscoveryStreams/signing"
 	"context"
 	"github.com/go-redis/redis"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -8,12 +11,16 @@ import (
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"os"
+	"strings"
 	"time"
 )
 
 type Tools struct {
-	Cache  *redis.Client
-	Logger *zap.Logger
+	Cache     cache.Cache
+	Blacklist cache.TokenBlacklist
+	Keys      *signing.KeySet
+	Mailer    mail.Mailer
+	Logger    *zap.Logger
 }
 
 var logger *zap.Logger
@@ -21,9 +28,9 @@ var logger *zap.Logger
 func SetupLoggerAndCacheAndMongo() (*mongo.Client, *Tools) {
 	logger, _ = setUpLogger()
 	mongoClient := setUpMongo()
-	redisCache := setUpRedis()
+	redisCache := cache.NewRedis(setUpRedis())
 
-	return mongoClient, &Tools{redisCache, logger}
+	return mongoClient, &Tools{redisCache, cache.NewTokenBlacklist(redisCache), setUpKeys(), setUpMailer(), logger}
 }
 func setUpLogger() (*zap.Logger, error) {
 	//Logger Config
@@ -58,6 +65,44 @@ func setUpMongo() *mongo.Client {
 
 	return client
 }
+func setUpKeys() *signing.KeySet {
+	//Tokens are signed with HS256 and TOKEN_SECRET unless a PEM key is given
+	signingKey := os.Getenv("JWT_SIGNING_KEY")
+	if signingKey == "" {
+		return signing.NewHMAC([]byte(os.Getenv("TOKEN_SECRET")))
+	}
+
+	var verifyKeys []string
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFY_KEYS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			verifyKeys = append(verifyKeys, path)
+		}
+	}
+	keys, err := signing.Load(signingKey, verifyKeys, os.Getenv("TOKEN_SECRET"))
+	if err != nil {
+		logger.Fatal("jwt keys gave " + err.Error())
+	}
+	return keys
+}
+func setUpMailer() mail.Mailer {
+	//Mail is sent through SMTP_ADDRESS when it is set, otherwise it is
+	//written to MAIL_FILE or stdout for running locally
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@discoverystreams.local"
+	}
+	if addr := os.Getenv("SMTP_ADDRESS"); addr != "" {
+		return mail.NewSMTP(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			logger.Fatal("mail file gave " + err.Error())
+		}
+		return mail.NewWriter(file, from)
+	}
+	return mail.NewWriter(os.Stdout, from)
+}
 func setUpRedis() *redis.Client {
 	//Redis client setup
 	cache := redis.NewClient(&redis.Options{
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+//Reads a duration such as "90s" or "24h" from an environment variable.
+//The fallback is used when the variable is unset or invalid.
+func GetDuration(key string, fallback time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return d
+}
+
+//Reads an integer from an environment variable.
+//The fallback is used when the variable is unset or invalid.
+func GetInt(key string, fallback int) int {
+	i, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return i
+}
@@ -0,0 +1,425 @@
+//Package hls rewrites HLS playlists to splice ad breaks into media playlists
+//and to point master playlist variants back at the API.
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid m3u8 playlist")
+
+//Returned for live playlists, whose sliding window has no fixed start to
+//measure break offsets from
+var ErrLivePlaylist = errors.New("ad breaks can't be spliced into a live playlist")
+
+//Ads starting this close to a segment boundary are placed on it
+const boundarySlack = 0.001
+
+//Used as the program date of the first segment when the origin has none so
+//EXT-X-DATERANGE tags have a timeline to refer to
+var epoch = time.Unix(0, 0).UTC()
+
+var uriAttrRegex = regexp.MustCompile(`URI="([^"]*)"`)
+
+//Tags that describe the whole media playlist rather than the next segment
+var playlistTags = []string{
+	"#EXTM3U",
+	"#EXT-X-VERSION",
+	"#EXT-X-TARGETDURATION",
+	"#EXT-X-MEDIA-SEQUENCE",
+	"#EXT-X-DISCONTINUITY-SEQUENCE",
+	"#EXT-X-PLAYLIST-TYPE",
+	"#EXT-X-INDEPENDENT-SEGMENTS",
+	"#EXT-X-START",
+	"#EXT-X-ALLOW-CACHE",
+	"#EXT-X-I-FRAMES-ONLY",
+}
+
+//An ad break spliced in at Offset seconds into the content
+type Break struct {
+	ID     string
+	Offset float64
+	Ads    []Ad
+}
+
+//A single ad creative played as one segment
+type Ad struct {
+	URI      string
+	Duration float64
+}
+
+func (b Break) duration() float64 {
+	total := 0.0
+	for _, ad := range b.Ads {
+		total += ad.Duration
+	}
+	return total
+}
+
+func lines(playlist []byte) ([]string, error) {
+	text := strings.Replace(string(playlist), "\r\n", "\n", -1)
+	all := strings.Split(text, "\n")
+	if len(all) == 0 || strings.TrimSpace(all[0]) != "#EXTM3U" {
+		return nil, ErrInvalidPlaylist
+	}
+
+	var out []string
+	for _, line := range all {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+//Returns true if the playlist lists variant streams instead of segments
+func IsMaster(playlist []byte) bool {
+	return strings.Contains(string(playlist), "#EXT-X-STREAM-INF")
+}
+
+//A media playlist listed in a master playlist
+type Variant struct {
+	URI string
+	//VIDEO for variant streams, or the TYPE of an EXT-X-MEDIA rendition
+	Type string
+}
+
+//Reports whether ads can be spliced into the variant. Audio and subtitle
+//renditions can't take the video segments ads are made of.
+func (v Variant) TakesAds() bool {
+	return v.Type == "VIDEO"
+}
+
+//Reports whether the variant can stay in step with ads spliced into the video
+//by leaving gaps for them. Subtitles simply show nothing during a break, but
+//audio would play silence over the ads.
+func (v Variant) TakesGaps() bool {
+	return v.Type == "SUBTITLES"
+}
+
+var typeAttrRegex = regexp.MustCompile(`[:,]TYPE=([A-Z\-]+)`)
+
+//Lists the media playlists in a master playlist in the order RewriteMaster
+//numbers them
+func Variants(master []byte) ([]Variant, error) {
+	var variants []Variant
+	_, err := eachVariant(master, func(i int, v Variant) string {
+		variants = append(variants, v)
+		return v.URI
+	})
+	return variants, err
+}
+
+//Replaces every media playlist uri in a master playlist with rewrite(i) where
+//i is the uri's index in Variants. I-frame playlists are dropped because
+//their byte ranges can't line up with spliced in ads.
+func RewriteMaster(master []byte, rewrite func(i int) string) ([]byte, error) {
+	return eachVariant(master, func(i int, v Variant) string {
+		return rewrite(i)
+	})
+}
+
+func eachVariant(master []byte, fn func(i int, v Variant) string) ([]byte, error) {
+	all, err := lines(master)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	i := 0
+	nextIsVariant := false
+	for _, line := range all {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF"):
+			continue
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			nextIsVariant = true
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:") && uriAttrRegex.MatchString(line):
+			v := Variant{URI: uriAttrRegex.FindStringSubmatch(line)[1]}
+			if match := typeAttrRegex.FindStringSubmatch(line); match != nil {
+				v.Type = match[1]
+			}
+			line = uriAttrRegex.ReplaceAllLiteralString(line, `URI="`+fn(i, v)+`"`)
+			i++
+		case !strings.HasPrefix(line, "#") && nextIsVariant:
+			line = fn(i, Variant{URI: line, Type: "VIDEO"})
+			i++
+			nextIsVariant = false
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\n") + "\n"), nil
+}
+
+//Splices ad breaks into a media playlist. Each break goes in at the first
+//segment boundary at or after its offset, and breaks past the end of a VOD
+//playlist play as post-rolls. Breaks are wrapped in EXT-X-DISCONTINUITY tags
+//and marked with EXT-X-DATERANGE and EXT-X-CUE-OUT/EXT-X-CUE-IN. Relative
+//uris are resolved against base since the playlist is served from the API.
+func InsertBreaks(media []byte, base *url.URL, breaks []Break) ([]byte, error) {
+	return insertBreaks(media, base, breaks, false)
+}
+
+//Splices ad breaks into a rendition as EXT-X-GAP segments, so it keeps the
+//timeline of the video InsertBreaks spliced the same breaks into. It relies
+//on the rendition being cut at the same boundaries as the video around each
+//break.
+func InsertGaps(media []byte, base *url.URL, breaks []Break) ([]byte, error) {
+	return insertBreaks(media, base, breaks, true)
+}
+
+func insertBreaks(media []byte, base *url.URL, breaks []Break, gaps bool) ([]byte, error) {
+	all, err := lines(media)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Break
+	longestAd := 0.0
+	for _, b := range breaks {
+		if len(b.Ads) == 0 {
+			continue
+		}
+		pending = append(pending, b)
+		for _, ad := range b.Ads {
+			longestAd = math.Max(longestAd, ad.Duration)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Offset < pending[j].Offset })
+	if len(pending) != 0 && isLive(all) {
+		return nil, ErrLivePlaylist
+	}
+
+	s := splicer{base: base, pending: pending, clock: epoch, gaps: gaps}
+	var segment []string
+	for _, line := range all {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-VERSION:") && gaps && len(pending) != 0:
+			version, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:"))
+			if err != nil {
+				return nil, ErrInvalidPlaylist
+			}
+			//EXT-X-GAP needs version 8
+			if version < 8 {
+				version = 8
+			}
+			s.out = append(s.out, "#EXT-X-VERSION:"+strconv.Itoa(version))
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			target, err := strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+			if err != nil {
+				return nil, ErrInvalidPlaylist
+			}
+			s.out = append(s.out, fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(math.Max(target, math.Ceil(longestAd)))))
+		case isPlaylistTag(line):
+			s.out = append(s.out, line)
+		case line == "#EXT-X-ENDLIST":
+			s.flushTags(segment)
+			segment = nil
+			//whatever is left plays after the content
+			s.insertDue(math.Inf(1), time.Time{}, false)
+			s.out = append(s.out, line)
+		case strings.HasPrefix(line, "#"):
+			segment = append(segment, line)
+		default:
+			if err := s.writeSegment(append(segment, line)); err != nil {
+				return nil, err
+			}
+			segment = nil
+		}
+	}
+	s.flushTags(segment)
+
+	return []byte(strings.Join(s.out, "\n") + "\n"), nil
+}
+
+//Reports whether segments drop off the start of the playlist as it is
+//reloaded. VOD playlists are complete and event playlists only grow, so
+//offsets into them always land on the same segment.
+func isLive(all []string) bool {
+	for _, line := range all {
+		if line == "#EXT-X-ENDLIST" || line == "#EXT-X-PLAYLIST-TYPE:EVENT" || line == "#EXT-X-PLAYLIST-TYPE:VOD" {
+			return false
+		}
+	}
+	return true
+}
+
+func isPlaylistTag(line string) bool {
+	for _, tag := range playlistTags {
+		if line == tag || strings.HasPrefix(line, tag+":") {
+			return true
+		}
+	}
+	return false
+}
+
+//State kept while walking a media playlist
+type splicer struct {
+	base     *url.URL
+	pending  []Break
+	out      []string
+	elapsed  float64
+	clock    time.Time
+	clockSet bool
+	lastKey  string
+	lastMap  string
+	//breaks are written as gaps instead of ads
+	gaps bool
+}
+
+//Writes a content segment, which is its tags followed by its uri, after
+//any ad breaks that are due before it
+func (s *splicer) writeSegment(segment []string) error {
+	duration := 0.0
+	var pdt time.Time
+	hasPDT := false
+	for _, line := range segment {
+		if strings.HasPrefix(line, "#EXTINF:") {
+			value := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			d, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return ErrInvalidPlaylist
+			}
+			duration = d
+		} else if strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:") {
+			t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"))
+			if err == nil {
+				pdt = t
+				hasPDT = true
+			}
+		}
+	}
+
+	s.insertDue(s.elapsed+boundarySlack, pdt, hasPDT)
+
+	for i, line := range segment {
+		if i == len(segment)-1 {
+			line = s.resolve(line)
+		} else {
+			line = s.resolveAttr(line)
+		}
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			s.lastKey = line
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			s.lastMap = line
+		}
+		s.out = append(s.out, line)
+	}
+
+	if hasPDT {
+		s.clock = pdt
+		s.clockSet = true
+	}
+	s.clock = s.clock.Add(seconds(duration))
+	s.elapsed += duration
+	return nil
+}
+
+//Writes tags that have no segment after them
+func (s *splicer) flushTags(tags []string) {
+	for _, line := range tags {
+		s.out = append(s.out, s.resolveAttr(line))
+	}
+}
+
+//Writes every pending break with an offset up to until. next is the program
+//date of the segment that follows, if it has one.
+func (s *splicer) insertDue(until float64, next time.Time, hasNext bool) {
+	var due []Break
+	for len(s.pending) != 0 && s.pending[0].Offset <= until {
+		due = append(due, s.pending[0])
+		s.pending = s.pending[1:]
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	if !s.clockSet {
+		//DATERANGE needs a program date, so the first break gets one on the
+		//timeline of the segment after it or, when the origin has none,
+		//counted from the epoch
+		if hasNext {
+			total := 0.0
+			for _, b := range due {
+				total += b.duration()
+			}
+			s.clock = next.Add(-seconds(total))
+		}
+		s.out = append(s.out, "#EXT-X-PROGRAM-DATE-TIME:"+formatDate(s.clock))
+		s.clockSet = true
+	}
+
+	for _, b := range due {
+		s.writeBreak(b)
+	}
+}
+
+func (s *splicer) writeBreak(b Break) {
+	duration := strconv.FormatFloat(b.duration(), 'f', 3, 64)
+
+	s.out = append(s.out, "#EXT-X-DISCONTINUITY")
+	if s.lastKey != "" {
+		s.out = append(s.out, "#EXT-X-KEY:METHOD=NONE")
+	}
+	s.out = append(s.out,
+		fmt.Sprintf(`#EXT-X-DATERANGE:ID="%s",START-DATE="%s",PLANNED-DURATION=%s`, dateRangeID(b.ID), formatDate(s.clock), duration),
+		"#EXT-X-CUE-OUT:DURATION="+duration)
+	for _, ad := range b.Ads {
+		if s.gaps {
+			s.out = append(s.out, "#EXT-X-GAP")
+		}
+		s.out = append(s.out, "#EXTINF:"+strconv.FormatFloat(ad.Duration, 'f', 3, 64)+",", ad.URI)
+		s.clock = s.clock.Add(seconds(ad.Duration))
+	}
+	s.out = append(s.out, "#EXT-X-CUE-IN", "#EXT-X-DISCONTINUITY")
+
+	//content picks its encryption and init segment back up after the ads
+	if s.lastKey != "" {
+		s.out = append(s.out, s.lastKey)
+	}
+	if s.lastMap != "" {
+		s.out = append(s.out, s.lastMap)
+	}
+}
+
+//Quoted strings in a playlist can't hold quotes or line breaks and have no
+//way to escape them, so the ad server's break id is percent-encoded
+func dateRangeID(id string) string {
+	return url.PathEscape(id)
+}
+
+func (s *splicer) resolve(uri string) string {
+	if s.base == nil {
+		return uri
+	}
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return s.base.ResolveReference(ref).String()
+}
+
+func (s *splicer) resolveAttr(line string) string {
+	m := uriAttrRegex.FindStringSubmatch(line)
+	if m == nil {
+		return line
+	}
+	return uriAttrRegex.ReplaceAllLiteralString(line, `URI="`+s.resolve(m[1])+`"`)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
@@ -0,0 +1,312 @@
+package hls
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const master = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="subs/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO="aac"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,AUDIO="aac"
+https://cdn.example.com/high/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100000,URI="low/iframe.m3u8"
+`
+
+const media = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:10.000,
+seg0.ts
+#EXTINF:10.000,
+seg1.ts
+#EXTINF:10.000,
+seg2.ts
+#EXTINF:10.000,
+seg3.ts
+#EXT-X-ENDLIST
+`
+
+func TestVariants(t *testing.T) {
+	variants, err := Variants([]byte(master))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Variant{
+		{URI: "audio/en.m3u8", Type: "AUDIO"},
+		{URI: "subs/en.m3u8", Type: "SUBTITLES"},
+		{URI: "low/index.m3u8", Type: "VIDEO"},
+		{URI: "https://cdn.example.com/high/index.m3u8", Type: "VIDEO"},
+	}
+	if len(variants) != len(want) {
+		t.Fatalf("got %v instead of %v", variants, want)
+	}
+	for i := range want {
+		if variants[i] != want[i] {
+			t.Fatalf("got %v instead of %v", variants, want)
+		}
+	}
+	if variants[0].TakesAds() || variants[1].TakesAds() || !variants[2].TakesAds() {
+		t.Fatal("only video variants should take ads")
+	}
+	if variants[0].TakesGaps() || !variants[1].TakesGaps() || variants[2].TakesGaps() {
+		t.Fatal("only subtitle renditions should take gaps")
+	}
+}
+
+func TestRewriteMaster(t *testing.T) {
+	out, err := RewriteMaster([]byte(master), func(i int) string {
+		return "manifest.m3u8?variant=" + string(rune('0'+i))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="manifest.m3u8?variant=0"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="manifest.m3u8?variant=1"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO="aac"
+manifest.m3u8?variant=2
+#EXT-X-STREAM-INF:BANDWIDTH=1600000,AUDIO="aac"
+manifest.m3u8?variant=3
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestInsertBreaks(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/low/index.m3u8")
+	breaks := []Break{
+		{ID: "mid0", Offset: 15, Ads: []Ad{{URI: "https://ads.example.com/a.ts", Duration: 15}, {URI: "https://ads.example.com/b.ts", Duration: 5}}},
+		{ID: "pre", Offset: 0, Ads: []Ad{{URI: "https://ads.example.com/c.ts", Duration: 5}}},
+		{ID: "empty", Offset: 30},
+		{ID: "post", Offset: 600, Ads: []Ad{{URI: "https://ads.example.com/d.ts", Duration: 10}}},
+	}
+
+	out, err := InsertBreaks([]byte(media), base, breaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:15
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-PROGRAM-DATE-TIME:1970-01-01T00:00:00.000Z
+#EXT-X-DISCONTINUITY
+#EXT-X-DATERANGE:ID="pre",START-DATE="1970-01-01T00:00:00.000Z",PLANNED-DURATION=5.000
+#EXT-X-CUE-OUT:DURATION=5.000
+#EXTINF:5.000,
+https://ads.example.com/c.ts
+#EXT-X-CUE-IN
+#EXT-X-DISCONTINUITY
+#EXTINF:10.000,
+https://cdn.example.com/low/seg0.ts
+#EXTINF:10.000,
+https://cdn.example.com/low/seg1.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-DATERANGE:ID="mid0",START-DATE="1970-01-01T00:00:25.000Z",PLANNED-DURATION=20.000
+#EXT-X-CUE-OUT:DURATION=20.000
+#EXTINF:15.000,
+https://ads.example.com/a.ts
+#EXTINF:5.000,
+https://ads.example.com/b.ts
+#EXT-X-CUE-IN
+#EXT-X-DISCONTINUITY
+#EXTINF:10.000,
+https://cdn.example.com/low/seg2.ts
+#EXTINF:10.000,
+https://cdn.example.com/low/seg3.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-DATERANGE:ID="post",START-DATE="1970-01-01T00:01:05.000Z",PLANNED-DURATION=10.000
+#EXT-X-CUE-OUT:DURATION=10.000
+#EXTINF:10.000,
+https://ads.example.com/d.ts
+#EXT-X-CUE-IN
+#EXT-X-DISCONTINUITY
+#EXT-X-ENDLIST
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestInsertBreaks_NoBreaks(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/audio/en.m3u8")
+	out, err := InsertBreaks([]byte(media), base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:10
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:10.000,
+https://cdn.example.com/audio/seg0.ts
+#EXTINF:10.000,
+https://cdn.example.com/audio/seg1.ts
+#EXTINF:10.000,
+https://cdn.example.com/audio/seg2.ts
+#EXTINF:10.000,
+https://cdn.example.com/audio/seg3.ts
+#EXT-X-ENDLIST
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestInsertBreaks_Encrypted(t *testing.T) {
+	encrypted := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:10.000,
+seg0.ts
+#EXTINF:10.000,
+seg1.ts
+#EXT-X-ENDLIST
+`
+	base, _ := url.Parse("https://cdn.example.com/index.m3u8")
+	breaks := []Break{{ID: "mid", Offset: 10, Ads: []Ad{{URI: "https://ads.example.com/a.ts", Duration: 5}}}}
+
+	out, err := InsertBreaks([]byte(encrypted), base, breaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-KEY:METHOD=AES-128,URI="https://cdn.example.com/key.bin"
+#EXTINF:10.000,
+https://cdn.example.com/seg0.ts
+#EXT-X-PROGRAM-DATE-TIME:1970-01-01T00:00:10.000Z
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXT-X-DATERANGE:ID="mid",START-DATE="1970-01-01T00:00:10.000Z",PLANNED-DURATION=5.000
+#EXT-X-CUE-OUT:DURATION=5.000
+#EXTINF:5.000,
+https://ads.example.com/a.ts
+#EXT-X-CUE-IN
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=AES-128,URI="https://cdn.example.com/key.bin"
+#EXTINF:10.000,
+https://cdn.example.com/seg1.ts
+#EXT-X-ENDLIST
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestInsertBreaks_EscapesBreakID(t *testing.T) {
+	breaks := []Break{{ID: "mid\",X=\"1\n", Offset: 10, Ads: []Ad{{URI: "https://ads.example.com/a.ts", Duration: 5}}}}
+	out, err := InsertBreaks([]byte(media), nil, breaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `#EXT-X-DATERANGE:ID="mid%22%2CX=%221%0A",START-DATE=`) {
+		t.Fatal(string(out))
+	}
+}
+
+func TestInsertBreaks_Live(t *testing.T) {
+	live := `#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXT-X-MEDIA-SEQUENCE:120
+#EXTINF:10.000,
+seg120.ts
+#EXTINF:10.000,
+seg121.ts
+`
+	breaks := []Break{{ID: "mid", Offset: 10, Ads: []Ad{{URI: "https://ads.example.com/a.ts", Duration: 5}}}}
+	if _, err := InsertBreaks([]byte(live), nil, breaks); err != ErrLivePlaylist {
+		t.Fatalf("expected ErrLivePlaylist instead of %v", err)
+	}
+	if _, err := InsertBreaks([]byte(live), nil, nil); err != nil {
+		t.Fatalf("a live playlist without breaks failed with %v", err)
+	}
+
+	//event playlists keep every segment from the start, so breaks stay put
+	event := strings.Replace(live, "#EXT-X-MEDIA-SEQUENCE:120", "#EXT-X-PLAYLIST-TYPE:EVENT", 1)
+	if out, err := InsertBreaks([]byte(event), nil, breaks); err != nil || !strings.Contains(string(out), "https://ads.example.com/a.ts") {
+		t.Fatalf("got %s with %v instead of the break in an event playlist", out, err)
+	}
+}
+
+func TestInsertGaps(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/subs/en.m3u8")
+	breaks := []Break{{ID: "mid0", Offset: 10, Ads: []Ad{{URI: "https://ads.example.com/a.ts", Duration: 15}, {URI: "https://ads.example.com/b.ts", Duration: 5}}}}
+
+	out, err := InsertGaps([]byte(media), base, breaks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `#EXTM3U
+#EXT-X-VERSION:8
+#EXT-X-TARGETDURATION:15
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:10.000,
+https://cdn.example.com/subs/seg0.ts
+#EXT-X-PROGRAM-DATE-TIME:1970-01-01T00:00:10.000Z
+#EXT-X-DISCONTINUITY
+#EXT-X-DATERANGE:ID="mid0",START-DATE="1970-01-01T00:00:10.000Z",PLANNED-DURATION=20.000
+#EXT-X-CUE-OUT:DURATION=20.000
+#EXT-X-GAP
+#EXTINF:15.000,
+https://ads.example.com/a.ts
+#EXT-X-GAP
+#EXTINF:5.000,
+https://ads.example.com/b.ts
+#EXT-X-CUE-IN
+#EXT-X-DISCONTINUITY
+#EXTINF:10.000,
+https://cdn.example.com/subs/seg1.ts
+#EXTINF:10.000,
+https://cdn.example.com/subs/seg2.ts
+#EXTINF:10.000,
+https://cdn.example.com/subs/seg3.ts
+#EXT-X-ENDLIST
+`
+	if string(out) != want {
+		t.Fatalf("got\n%s\nwant\n%s", out, want)
+	}
+
+	//the video gets the same breaks at the same times
+	video, _ := InsertBreaks([]byte(media), base, breaks)
+	if duration(t, video) != duration(t, out) {
+		t.Fatalf("the gaps last %v instead of the %v the video does", duration(t, out), duration(t, video))
+	}
+}
+
+//Adds up the EXTINF durations of a media playlist
+func duration(t *testing.T, playlist []byte) float64 {
+	all, err := lines(playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0.0
+	for _, line := range all {
+		if strings.HasPrefix(line, "#EXTINF:") {
+			d, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(line, "#EXTINF:"), ","), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += d
+		}
+	}
+	return total
+}
+
+func TestInsertBreaks_NotAPlaylist(t *testing.T) {
+	if _, err := InsertBreaks([]byte("<html></html>"), nil, nil); err != ErrInvalidPlaylist {
+		t.Fatalf("expected ErrInvalidPlaylist instead of %v", err)
+	}
+}
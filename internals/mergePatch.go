@@ -0,0 +1,44 @@
+package internals
+
+import (
+	"encoding/json"
+)
+
+//Applies a JSON merge patch (RFC 7386) to a json document and returns the
+//patched document. Keys set to null in the patch are removed from the document.
+func MergePatch(doc []byte, patch []byte) ([]byte, error) {
+	var target interface{}
+	if len(doc) != 0 {
+		if err := json.Unmarshal(doc, &target); err != nil {
+			return nil, err
+		}
+	}
+
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergeValue(target, p))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
+		}
+		targetObj[k] = mergeValue(targetObj[k], v)
+	}
+	return targetObj
+}
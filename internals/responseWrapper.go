@@ -16,6 +16,64 @@ var DuplicateError = errors.New("email already in use")
 var LoginError = errors.New("email or password was incorrect")
 var TokenGenError = errors.New("failed to generate token")
 var TokenNotValidError = errors.New("token no longer valid")
+var InvalidBodyError = errors.New("request body is not valid json")
+var DuplicateStreamError = errors.New("stream id already exists")
+var StreamIDMismatchError = errors.New("stream id in body does not match url")
+var InvalidCursorError = errors.New("cursor is not valid")
+var InvalidLimitError = errors.New("limit must be a number between 1 and 100")
+var InvalidSortError = errors.New("sort must be one of id, -id, streamUrl, -streamUrl")
+var InvalidCaptionFilterError = errors.New("captions filter must be one of vtt, scc, srt, ttml")
+var InvalidLanguageError = errors.New("lang must be a BCP-47 language tag")
+var NoCaptionsError = errors.New("no captions exist for that language")
+var CaptionFormatError = errors.New("captions can only be served as vtt, srt, ttml or dfxp")
+var CaptionsSourceError = errors.New("caption source could not be fetched")
+var CaptionsConvertError = errors.New("caption source could not be converted")
+var ManifestSourceError = errors.New("stream playlist could not be fetched")
+var NoVariantError = errors.New("no such variant exists")
+var NoAdBreakError = errors.New("no such ad break exists")
+var PasswordHashError = errors.New("failed to hash password")
+var RefreshTokenError = errors.New("refresh token is not valid")
+var ForbiddenError = errors.New("your role does not allow this")
+var InvalidRoleError = errors.New("role must be one of viewer, editor, admin")
+var OwnAdminRoleError = errors.New("admins can not remove their own admin role")
+var NoUserError = errors.New("no such user exists")
+var EmailTokenError = errors.New("token is not valid, has expired or was already used")
+var EmailNotVerifiedError = errors.New("email address has not been verified")
+var LoginLockedError = errors.New("too many failed logins, try again later")
+var InvalidIPError = errors.New("ip is not a valid IP address")
+var CurrentPasswordError = errors.New("current password was incorrect")
+var NoSessionError = errors.New("no such session exists")
+var NoOIDCProviderError = errors.New("no such identity provider exists")
+var OIDCProviderError = errors.New("identity provider could not be reached")
+var OIDCError = errors.New("sign in with the identity provider failed")
+var OIDCEmailError = errors.New("identity provider did not give a verified email address")
+var OIDCLinkError = errors.New("an account with this email already exists, sign in to it with its password instead")
+var MFAChallengeError = errors.New("mfa token is not valid, has expired or was already used")
+var MFACodeError = errors.New("authentication code is not valid")
+var MFAEnabledError = errors.New("two-factor authentication is already on")
+var MFANotEnabledError = errors.New("two-factor authentication has not been set up")
+var MFARequiredError = errors.New("your role requires two-factor authentication")
+var APIKeyError = errors.New("api key is not valid, has expired or was revoked")
+var APIKeyNotAllowedError = errors.New("api keys can not be used for this, sign in instead")
+var NoAPIKeyError = errors.New("no such api key exists")
+var InvalidScopeError = errors.New("scopes must be permissions the key's owner has")
+var InvalidExpiryError = errors.New("expiresAt must be in the future")
+var ServiceAccountNameError = errors.New("name must be lowercase letters, digits and dashes")
+var RateLimitError = errors.New("too many requests, try again later")
+var InvalidPlanError = errors.New("plan must be lowercase letters, digits and dashes")
+var ConcurrentStreamsError = errors.New("your plan does not allow playing more streams at once, stop one to start another")
+var NoPlaybackError = errors.New("no such playback session exists, it may have expired or been stopped")
+var LeaseRequiredError = errors.New("start playing the stream with /play and pass the lease id as lease")
+var InvalidProgressError = errors.New("position and duration must be seconds, with position between 0 and duration")
+var NoProgressError = errors.New("no progress was recorded for that stream")
+var NoListError = errors.New("no such list exists")
+var ListNameError = errors.New("name must be between 1 and 100 characters")
+var DefaultListError = errors.New("the favorites list can not be renamed or deleted")
+var DuplicateListItemError = errors.New("stream is already in the list")
+var ListFullError = errors.New("the list is full, remove a stream from it first")
+var NoListItemError = errors.New("stream is not in the list")
+var ListPositionError = errors.New("position must be between 0 and the number of items in the list")
+var ListOrderError = errors.New("items must be stream ids in the list, each only once")
 
 //Converts error array to json by
 // returning {"error":[{"message": <error_message>}, {"message": <error_message>}]}
@@ -53,7 +111,12 @@ func RespondAsErrorJson(w http.ResponseWriter, statusCode int, errors ...interfa
 
 //Returns json to clients
 func RespondAsJson(w http.ResponseWriter, json []byte, statusCode int) {
-	w.Header().Set("Content-Type", "application/json")
+	Respond(w, json, "application/json", statusCode)
+}
+
+//Returns a body of any content type to clients
+func Respond(w http.ResponseWriter, body []byte, contentType string, statusCode int) {
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(statusCode)
-	w.Write(json)
+	w.Write(body)
 }
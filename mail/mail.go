@@ -0,0 +1,90 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//Sends email to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+//Formats a message with the headers mail servers expect. Line breaks are
+//taken out of header values so they can't add headers of their own.
+func format(from string, msg Message, date time.Time) []byte {
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+//Mailer that sends through an SMTP server, using STARTTLS when the server
+//offers it
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+//Mailer for the server at addr (host:port). Without a username mail is sent
+//unauthenticated.
+func NewSMTP(addr string, from string, username string, password string) *SMTP {
+	s := &SMTP{addr: addr, from: from}
+	if username != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	//net/smtp has no context support, so a cancelled request only stops
+	//mail that hasn't started sending
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, format(s.from, msg, time.Now()))
+}
+
+//Mailer that writes every message to w instead of sending it, for running
+//locally without a mail server
+type Writer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func NewWriter(w io.Writer, from string) *Writer {
+	return &Writer{w: w, from: from}
+}
+
+func (m *Writer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.w.Write(append(format(m.from, msg, time.Now()), "\r\n"...))
+	return err
+}
@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWriter_Send(t *testing.T) {
+	var out bytes.Buffer
+	m := NewWriter(&out, "streams@example.com")
+
+	err := m.Send(context.Background(), Message{
+		To:      "user@example.com\r\nBcc: everyone@example.com",
+		Subject: "Verify your email",
+		Body:    "line one\nline two",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"From: streams@example.com\r\n",
+		"To: user@example.comBcc: everyone@example.com\r\n",
+		"Subject: Verify your email\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nline one\r\nline two\r\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("%q is missing from\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "\r\nBcc:") {
+		t.Fatalf("a header was injected through the recipient:\n%s", got)
+	}
+}
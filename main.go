@@ -5,12 +5,13 @@ import (
 	"DiscoveryStreams/config"
 	"DiscoveryStreams/internals"
 	"context"
+	"expvar"
+	"flag"
 	"fmt"
 	_ "github.com/dimiro1/banner/autoload"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/jwtauth"
-	"github.com/go-redis/redis"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
@@ -18,12 +19,48 @@ import (
 )
 
 func main() {
-	tokenAuth := jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)
 	port := fmt.Sprintf(":%s", os.Getenv("PORT"))
+	migrateCaptions := flag.Bool("migrate-captions", false, "rewrite legacy caption urls in mongo to caption tracks and exit")
+	bootstrapAdmin := flag.Bool("bootstrap-admin", false, "make ADMIN_EMAIL an admin, creating it with ADMIN_PASSWORD if it doesn't exist, and exit")
+	flag.Parse()
+
 	//set up routes
 	mongo, tools := config.SetupLoggerAndCacheAndMongo()
-	streamController := api.NewStreamController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	db := mongo.Database(os.Getenv("MONGO_DB_NAME"))
+	if *migrateCaptions {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		migrated, err := api.MigrateCaptions(ctx, db)
+		if err != nil {
+			tools.Logger.Fatal(err.Error())
+		}
+		tools.Logger.Info(fmt.Sprintf("Migrated captions on %d streams", migrated))
+		return
+	}
+	streamController := api.NewStreamController(api.NewMongoStreamStore(db), tools)
+	users := api.NewMongoUserStore(db)
+	usersController := api.NewUsersController(users, tools)
+	apiKeysController := api.NewAPIKeysController(api.NewMongoAPIKeyStore(db), users, tools)
+	usersController.OnEmailChange(apiKeysController.ChangeOwner)
+	progressController := api.NewProgressController(api.NewMongoProgressStore(db), streamController, tools)
+	usersController.OnEmailChange(progressController.ChangeOwner)
+	watchlistsController := api.NewWatchlistsController(api.NewMongoWatchlistStore(db), streamController, tools)
+	usersController.OnEmailChange(watchlistsController.ChangeOwner)
+	if *bootstrapAdmin {
+		email := os.Getenv("ADMIN_EMAIL")
+		created, err := usersController.BootstrapAdmin(context.Background(), email, os.Getenv("ADMIN_PASSWORD"))
+		if err != nil {
+			tools.Logger.Fatal(err.Error())
+		}
+		if created {
+			tools.Logger.Info("Created admin " + email)
+		} else {
+			tools.Logger.Info("Made " + email + " an admin")
+		}
+		return
+	}
+
+	go progressController.FlushEvery(context.Background())
 
 	r := chi.NewRouter()
 
@@ -33,20 +70,98 @@ func main() {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	r.Post("/login", usersController.Login)
-	r.Post("/signup", usersController.Signup)
+	//Public routes, rate limited by IP
+	r.Group(func(public chi.Router) {
+		public.Use(api.RateLimit(tools, "auth", api.Limit{Requests: 20, Window: time.Minute}))
+		public.Post("/login", usersController.Login)
+		public.Post("/login/mfa", usersController.LoginMFA)
+		public.Post("/signup", usersController.Signup)
+		public.Post("/token/refresh", usersController.RefreshToken)
+		public.Post("/verify-email", usersController.VerifyEmail)
+		public.Post("/password/forgot", usersController.ForgotPassword)
+		public.Post("/password/reset", usersController.ResetPassword)
+		public.Get("/oidc/{provider}/login", usersController.OIDCLogin)
+		public.Get("/oidc/{provider}/callback", usersController.OIDCCallback)
+	})
+	r.Get("/.well-known/jwks.json", usersController.GetJWKS)
 
-	//JWT protected routes
+	//JWT protected routes, rate limited by IP before the credentials are
+	//checked and by principal after
 	r.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, tokenAuth))
-		guarded.Delete("/logout", usersController.Logout)
+		guarded.Use(api.RateLimit(tools, "ip", api.Limit{Requests: 600, Window: time.Minute}))
+		guarded.Use(Authenticate(tools, apiKeysController))
+		guarded.Use(api.RateLimit(tools, "api", api.Limit{Requests: 300, Window: time.Minute}))
+		guarded.With(api.RequireToken).Delete("/logout", usersController.Logout)
+		guarded.With(api.RequirePermission(api.PermMetricsRead)).Handle("/debug/vars", expvar.Handler())
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
+				s.Use(api.RequirePermission(api.PermStreamsRead))
+				s.Use(api.RateLimit(tools, "streams", api.Limit{Requests: 120, Window: time.Minute}))
+				editor := s.With(api.RequirePermission(api.PermStreamsWrite))
 				s.Get("/", streamController.ListStreamIds)
+				editor.Post("/", streamController.CreateStream)
 				s.Route("/{id}", func(sid chi.Router) {
+					editor := sid.With(api.RequirePermission(api.PermStreamsWrite))
 					sid.Get("/", streamController.GetStream)
+					editor.Put("/", streamController.ReplaceStream)
+					editor.Patch("/", streamController.UpdateStream)
+					editor.Delete("/", streamController.DeleteStream)
+					sid.Get("/captions/{lang}.{format}", streamController.GetCaptions)
+					sid.Get("/manifest.m3u8", streamController.GetManifest)
+					sid.Get("/ads.vmap", streamController.GetVMAP)
+					sid.Get("/ads/{breakId}/vast.xml", streamController.GetVAST)
+					sid.Post("/play", streamController.PlayStream)
+					sid.Put("/play/{leaseId}", streamController.PlaybackHeartbeat)
+					sid.Delete("/play/{leaseId}", streamController.StopPlayback)
+				})
+			})
+			v1.Route("/me", func(me chi.Router) {
+				me.Use(api.RequireToken)
+				me.Get("/", usersController.GetMe)
+				me.Patch("/", usersController.UpdateMe)
+				me.Post("/password", usersController.ChangePassword)
+				me.Get("/sessions", usersController.ListSessions)
+				me.Delete("/sessions", usersController.RevokeAllSessions)
+				me.Delete("/sessions/{id}", usersController.RevokeSession)
+				me.Post("/mfa/totp", usersController.StartTOTP)
+				me.Post("/mfa/totp/confirm", usersController.ConfirmTOTP)
+				me.Delete("/mfa/totp", usersController.DisableTOTP)
+				me.Post("/mfa/recovery-codes", usersController.RegenerateRecoveryCodes)
+				me.Get("/keys", apiKeysController.ListAPIKeys)
+				me.Post("/keys", apiKeysController.CreateAPIKey)
+				me.Post("/keys/{id}/rotate", apiKeysController.RotateAPIKey)
+				me.Delete("/keys/{id}", apiKeysController.RevokeAPIKey)
+				me.Get("/playback", streamController.ListPlayback)
+				me.Delete("/playback/{leaseId}", streamController.StopPlayback)
+				me.Get("/progress/{streamId}", progressController.GetProgress)
+				me.Put("/progress/{streamId}", progressController.SaveProgress)
+				me.Get("/continue-watching", progressController.ContinueWatching)
+				me.Route("/lists", func(lists chi.Router) {
+					lists.Get("/", watchlistsController.ListWatchlists)
+					lists.Post("/", watchlistsController.CreateWatchlist)
+					lists.Route("/{listId}", func(list chi.Router) {
+						list.Get("/", watchlistsController.GetWatchlist)
+						list.Patch("/", watchlistsController.RenameWatchlist)
+						list.Delete("/", watchlistsController.DeleteWatchlist)
+						list.Post("/items", watchlistsController.AddWatchlistItem)
+						list.Put("/items", watchlistsController.ReorderWatchlist)
+						list.Delete("/items/{streamId}", watchlistsController.RemoveWatchlistItem)
+					})
 				})
 			})
+			v1.Route("/users", func(u chi.Router) {
+				u.Use(api.RequirePermission(api.PermUsersManage))
+				u.Put("/{email}/role", usersController.UpdateRole)
+				u.Put("/{email}/plan", usersController.UpdatePlan)
+				u.Delete("/{email}/lockout", usersController.UnlockUser)
+				u.Delete("/{email}/mfa", usersController.ResetMFA)
+				u.Get("/{email}/keys", apiKeysController.ListAPIKeys)
+				u.Post("/{email}/keys", apiKeysController.CreateAPIKey)
+				u.Post("/{email}/keys/{id}/rotate", apiKeysController.RotateAPIKey)
+				u.Delete("/{email}/keys/{id}", apiKeysController.RevokeAPIKey)
+			})
+			v1.With(api.RequirePermission(api.PermUsersManage)).Delete("/lockouts/ips/{ip}", usersController.UnlockIP)
+			v1.With(api.RequirePermission(api.PermUsersManage)).Post("/service-accounts", apiKeysController.CreateServiceAccount)
 		})
 	})
 
@@ -60,29 +175,50 @@ func main() {
 	}
 }
 
-func VerifyJWT(tools *config.Tools, token *jwtauth.JWTAuth) func(next http.Handler) http.Handler {
+//Checks the request's token against the key named by its kid and that its
+//session is still signed in
+func VerifyJWT(tools *config.Tools) func(next http.Handler) http.Handler {
+	return Authenticate(tools, nil)
+}
+
+//Puts the principal the request is made by in its context. Requests with an
+//X-API-Key header are checked against apiKeys, when it is given, and all
+//others need a valid access token.
+func Authenticate(tools *config.Tools, apiKeys *api.APIKeysController) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
+			if key := r.Header.Get("X-API-Key"); key != "" && apiKeys != nil {
+				p, err := apiKeys.Authenticate(r.Context(), key)
+				if err == internals.APIKeyError {
+					internals.RespondAsErrorJson(w, http.StatusUnauthorized, err)
+					return
+				} else if err != nil {
+					tools.Logger.Error(err.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
+					internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.DBError)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(api.WithPrincipal(r.Context(), p)))
+				return
+			}
 
-			tkn, err := jwtauth.VerifyRequest(token, r, jwtauth.TokenFromHeader, jwtauth.TokenFromQuery, jwtauth.TokenFromCookie)
+			tkn, err := tools.Keys.VerifyRequest(r, jwtauth.TokenFromHeader, jwtauth.TokenFromQuery, jwtauth.TokenFromCookie)
 			if err != nil {
-				//Removed the word 'jwtauth: ' from error string
-				internals.RespondAsErrorJson(w, http.StatusUnauthorized, err.Error()[9:])
+				internals.RespondAsErrorJson(w, http.StatusUnauthorized, err)
 				return
 			}
 
-			//check redis blacklist
-			exists, e := tools.Cache.Exists(tkn.Raw).Result()
-			if exists == 1 {
-				internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.TokenNotValidError)
-				return
-			} else if e != nil && e != redis.Nil {
+			//check the token wasn't logged out or revoked along with its session or user
+			active, e := api.IsTokenActive(tools, tkn)
+			if e != nil {
 				tools.Logger.Error(e.Error(), zap.String("reqId", middleware.GetReqID(r.Context())))
 				internals.RespondAsErrorJson(w, http.StatusInternalServerError, internals.RedisError)
 				return
+			} else if !active {
+				internals.RespondAsErrorJson(w, http.StatusUnauthorized, internals.TokenNotValidError)
+				return
 			}
 
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "Token", tkn)))
+			next.ServeHTTP(w, r.WithContext(api.WithPrincipal(r.Context(), api.PrincipalFromToken(tkn))))
 		}
 		return http.HandlerFunc(fn)
 	}
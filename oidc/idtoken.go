@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"DiscoveryStreams/signing"
+	"context"
+	"encoding/json"
+	"github.com/dgrijalva/jwt-go"
+	"time"
+)
+
+//How far the provider's clock may be from ours
+const clockSkew = time.Minute
+
+//Returned by VerifyIDToken for tokens that can't be trusted
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return "id_token is not valid: " + e.Reason
+}
+
+func invalid(reason string) error {
+	return &ValidationError{Reason: reason}
+}
+
+//Claims of an id_token (OpenID Connect Core 1.0 section 2) along with the
+//standard profile claims used to set up an account
+type IDToken struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         int64    `json:"exp"`
+	IssuedAt        int64    `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	EmailVerified   boolish  `json:"email_verified"`
+	Name            string   `json:"name"`
+	GivenName       string   `json:"given_name"`
+	FamilyName      string   `json:"family_name"`
+}
+
+//Checks are made in VerifyIDToken, which knows what to compare them with
+func (t *IDToken) Valid() error {
+	return nil
+}
+
+//aud is a string when there is one audience and an array otherwise
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	err := json.Unmarshal(b, &many)
+	*a = many
+	return err
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+//Some providers send email_verified as the string "true"
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(raw []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*b = boolish(v)
+	case string:
+		*b = v == "true"
+	}
+	return nil
+}
+
+//Checks an id_token's signature against the provider's keys and its claims
+//against OpenID Connect Core 1.0 section 3.1.3.7: it has to be from the
+//provider, for our client, unexpired and carry the nonce it was asked for.
+//Tokens that fail are rejected with a *ValidationError.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw string, nonce string) (IDToken, error) {
+	var claims IDToken
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return claims, err
+	}
+	keys, err := p.signingKeys(ctx, meta, false)
+	if err != nil {
+		return claims, err
+	}
+
+	_, err = jwt.ParseWithClaims(raw, &claims, keys.Keyfunc)
+	if verr, ok := err.(*jwt.ValidationError); ok && verr.Inner == signing.ErrUnknownKey {
+		//the provider may have rotated to a key we haven't fetched yet
+		if keys, err = p.signingKeys(ctx, meta, true); err != nil {
+			return claims, err
+		}
+		claims = IDToken{}
+		_, err = jwt.ParseWithClaims(raw, &claims, keys.Keyfunc)
+	}
+	if err != nil {
+		return claims, invalid(err.Error())
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != meta.Issuer:
+		return claims, invalid("issued by " + claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return claims, invalid("not issued for this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return claims, invalid("azp is not this client")
+	case claims.Subject == "":
+		return claims, invalid("no subject")
+	case !now.Before(time.Unix(claims.Expires, 0).Add(clockSkew)):
+		return claims, invalid("expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(clockSkew)):
+		return claims, invalid("issued in the future")
+	case claims.Nonce != nonce:
+		return claims, invalid("nonce does not match")
+	}
+	return claims, nil
+}
@@ -0,0 +1,33 @@
+package oidc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestIDToken_Unmarshal(t *testing.T) {
+	for raw, want := range map[string]IDToken{
+		`{"aud":"client","email_verified":true}`:               {Audience: audience{"client"}, EmailVerified: true},
+		`{"aud":["client","other"],"email_verified":"true"}`:   {Audience: audience{"client", "other"}, EmailVerified: true},
+		`{"aud":["other"],"email_verified":"false"}`:           {Audience: audience{"other"}},
+		`{"aud":"client","email_verified":false,"sub":"1234"}`: {Audience: audience{"client"}, Subject: "1234"},
+	} {
+		var got IDToken
+		if err := json.Unmarshal([]byte(raw), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.EmailVerified != want.EmailVerified || got.Subject != want.Subject || len(got.Audience) != len(want.Audience) {
+			t.Fatalf("%s was read as %+v", raw, got)
+		}
+		if got.Audience.contains("client") != want.Audience.contains("client") {
+			t.Fatalf("%s was read with the audience %v", raw, got.Audience)
+		}
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	//example from RFC 7636 appendix B
+	if got := CodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("%s was returned", got)
+	}
+}
@@ -0,0 +1,202 @@
+//Package oidc is an OpenID Connect relying party: it discovers a provider,
+//sends users to it with the authorization code flow and PKCE, and checks the
+//id_token it gets back.
+package oidc
+
+import (
+	"DiscoveryStreams/signing"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Settings for signing in with one identity provider
+type Config struct {
+	//Issuer url the discovery document is found under
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	//Where the provider sends users back to with a code
+	RedirectURL string
+	//Defaults to openid, email and profile
+	Scopes []string
+}
+
+//The parts of the discovery document the authorization code flow needs
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//Identity provider users can sign in with. Its discovery document and keys
+//are fetched the first time they are needed, so a provider that is down
+//only breaks signing in with it.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *metadata
+	keys        *signing.KeySet
+	keysFetched time.Time
+}
+
+func NewProvider(config Config, client *http.Client) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{config: config, client: client}
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+//Gets a json document, failing on anything but a 200
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.New(u + " returned " + res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+//Fetches the provider's discovery document once it is first needed. Failures
+//aren't kept, so the next sign in tries again.
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return *p.meta, nil
+	}
+
+	var meta metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return meta, err
+	}
+	//OpenID Connect Discovery 1.0 section 4.3
+	if meta.Issuer != p.config.Issuer {
+		return meta, errors.New("discovery document is for " + meta.Issuer + " instead of " + p.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return meta, errors.New("discovery document of " + p.config.Issuer + " is missing endpoints")
+	}
+	p.meta = &meta
+	return meta, nil
+}
+
+//The provider's signing keys. They are fetched again when a token names a
+//key that isn't known yet, since that's how providers rotate, but at most
+//once a minute.
+func (p *Provider) signingKeys(ctx context.Context, meta metadata, refresh bool) (*signing.KeySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil && (!refresh || time.Since(p.keysFetched) < time.Minute) {
+		return p.keys, nil
+	}
+
+	var jwks signing.JWKS
+	if err := p.getJSON(ctx, meta.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	p.keys, p.keysFetched = signing.FromJWKS(jwks), time.Now()
+	return p.keys, nil
+}
+
+//PKCE S256 code challenge for a code verifier (RFC 7636)
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//Url to send users to the provider to sign in. state comes back with the
+//code, nonce comes back in the id_token and verifier has to be given to
+//Exchange with the code.
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {CodeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+//Swaps an authorization code for the id_token the provider issued with it
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	meta, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", errors.New("token endpoint returned " + res.Status)
+	}
+	if res.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", errors.New("token endpoint returned " + res.Status + " " + tokens.Error + " " + tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return tokens.IDToken, nil
+}
@@ -0,0 +1,149 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"regexp"
+	"strings"
+)
+
+//Algorithms a Hasher can hash new passwords with
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+//Returned when a stored hash isn't in a format any algorithm recognizes
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+//Unsalted SHA-1 hex that passwords were stored as before hashes were versioned
+var legacySHA1 = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+//Cost parameters for argon2id. They are kept in every hash so they can be
+//raised without breaking stored passwords.
+type Argon2Params struct {
+	Memory  uint32 //KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+//Hashes passwords with Algorithm and verifies hashes made by any supported
+//algorithm, including legacy SHA-1
+type Hasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+}
+
+//Hasher with the OWASP recommended minimums for argon2id
+func NewHasher() Hasher {
+	return Hasher{
+		Algorithm:  Argon2id,
+		Argon2:     Argon2Params{Memory: 19 * 1024, Time: 2, Threads: 1, SaltLen: 16, KeyLen: 32},
+		BcryptCost: bcrypt.DefaultCost,
+	}
+}
+
+//Hashes a password into a string holding the algorithm, its parameters and salt
+func (h Hasher) Hash(password string) (string, error) {
+	switch h.Algorithm {
+	case Argon2id:
+		salt := make([]byte, h.Argon2.SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		p := h.Argon2
+		key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Time, p.Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+	return "", fmt.Errorf("unknown password hash algorithm %q", h.Algorithm)
+}
+
+//Checks a password against a stored hash in constant time
+func (h Hasher) Verify(password string, encoded string) (bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		p, salt, key, err := decodeArgon2(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	case isBcrypt(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case legacySHA1.MatchString(encoded):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(encoded)) == 1, nil
+	}
+	return false, ErrUnknownHash
+}
+
+//Reports whether a stored hash was made with another algorithm or weaker
+//parameters than the Hasher's, so it should be replaced after a login
+func (h Hasher) NeedsRehash(encoded string) bool {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		if h.Algorithm != Argon2id {
+			return true
+		}
+		p, _, key, err := decodeArgon2(encoded)
+		return err != nil || p.Memory < h.Argon2.Memory || p.Time < h.Argon2.Time ||
+			p.Threads < h.Argon2.Threads || uint32(len(key)) < h.Argon2.KeyLen
+	case isBcrypt(encoded):
+		if h.Algorithm != Bcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return err != nil || cost < h.BcryptCost
+	}
+	return true
+}
+
+func isBcrypt(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+//Reads $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+func decodeArgon2(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrUnknownHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrUnknownHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return p, nil, nil, ErrUnknownHash
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	return p, salt, key, nil
+}
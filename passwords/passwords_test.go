@@ -0,0 +1,73 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHasher_HashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{Argon2id, Bcrypt} {
+		h := NewHasher()
+		h.Algorithm = algorithm
+		h.BcryptCost = 4
+
+		hash, err := h.Hash("hunter22")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, _ := h.Hash("hunter22"); other == hash {
+			t.Fatalf("%s hashes aren't salted: %s", algorithm, hash)
+		}
+
+		if ok, err := h.Verify("hunter22", hash); !ok || err != nil {
+			t.Fatalf("%s didn't verify its own hash %s: %v", algorithm, hash, err)
+		}
+		if ok, _ := h.Verify("hunter23", hash); ok {
+			t.Fatalf("%s verified the wrong password", algorithm)
+		}
+		if h.NeedsRehash(hash) {
+			t.Fatalf("%s wants to rehash a current hash %s", algorithm, hash)
+		}
+	}
+}
+
+func TestHasher_Argon2ParamsInHash(t *testing.T) {
+	h := NewHasher()
+	h.Argon2.Memory, h.Argon2.Time = 8*1024, 1
+	hash, _ := h.Hash("hunter22")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=8192,t=1,p=1$") {
+		t.Fatal(hash)
+	}
+
+	//hashes made with older parameters still verify but get upgraded
+	h.Argon2.Memory = 16 * 1024
+	if ok, _ := h.Verify("hunter22", hash); !ok {
+		t.Fatal("hash stopped verifying when the parameters changed")
+	}
+	if !h.NeedsRehash(hash) {
+		t.Fatal("hash with less memory than configured wasn't marked for rehash")
+	}
+
+	h.Algorithm = Bcrypt
+	if !h.NeedsRehash(hash) {
+		t.Fatal("argon2id hash wasn't marked for rehash after switching to bcrypt")
+	}
+}
+
+func TestHasher_LegacySHA1(t *testing.T) {
+	h := NewHasher()
+	legacy := "4ff1a33e188b7b86123d6e3be2722a23514a83b4" //sha1 of "test12"
+	if ok, err := h.Verify("test12", legacy); !ok || err != nil {
+		t.Fatalf("legacy hash didn't verify: %v", err)
+	}
+	if ok, _ := h.Verify("test13", legacy); ok {
+		t.Fatal("legacy hash verified the wrong password")
+	}
+	if !h.NeedsRehash(legacy) {
+		t.Fatal("legacy hash wasn't marked for rehash")
+	}
+
+	if _, err := h.Verify("test12", "plaintext"); err != ErrUnknownHash {
+		t.Fatalf("%v was returned instead of ErrUnknownHash", err)
+	}
+}
@@ -0,0 +1,184 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+	"math/big"
+)
+
+//Public key as a JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+//JSON Web Key Set served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+//Public keys of the key set, starting with the signing key. HMAC secrets
+//are never published.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.order {
+		if key.ID == "" {
+			continue
+		}
+		jwk := key.jwk()
+		jwk.Kid, jwk.Use, jwk.Alg = key.ID, "sig", key.Method.Alg()
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+//The members of a key's JWK that identify it
+func (key *Key) jwk() JWK {
+	switch public := key.verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: b64(public.N.Bytes()), E: b64(big.NewInt(int64(public.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		return JWK{Kty: "EC", Crv: public.Curve.Params().Name, X: b64(pad(public.X.Bytes(), size)), Y: b64(pad(public.Y.Bytes(), size))}
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(public)}
+	}
+	return JWK{}
+}
+
+//JWK thumbprint from RFC 7638: the sha256 of the required members in
+//lexicographic order. Struct fields are marshalled in order, so each key
+//type gets its own struct.
+func thumbprint(jwk JWK) string {
+	var doc []byte
+	switch jwk.Kty {
+	case "RSA":
+		doc, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case "EC":
+		doc, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y})
+	case "OKP":
+		doc, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	default:
+		return ""
+	}
+	sum := sha256.Sum256(doc)
+	return b64(sum[:])
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//Left pads a big-endian number to size bytes
+func pad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+//Verify-only key set made from keys another issuer publishes, such as an
+//OpenID provider's, for checking the tokens it signs. Keys are found by the
+//issuer's own kid, and encryption keys and key types that aren't supported
+//are left out.
+func FromJWKS(jwks JWKS) *KeySet {
+	ks := &KeySet{keys: map[string]*Key{}}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			continue
+		}
+		ks.add(key)
+	}
+	return ks
+}
+
+//Public key a JWK describes, verifying with its alg when it names one
+func (jwk JWK) key() (*Key, error) {
+	var public interface{}
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		public = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("only Ed25519 OKP keys are supported")
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return nil, errors.New("unsupported key type " + jwk.Kty)
+	}
+
+	key, err := newKey(public)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.Kid
+	if jwk.Alg != "" && jwk.Alg != key.Method.Alg() {
+		//RSA keys can also verify RS384 and RS512
+		method := jwt.GetSigningMethod(jwk.Alg)
+		if _, ok := method.(*jwt.SigningMethodRSA); !ok || jwk.Kty != "RSA" {
+			return nil, errors.New(jwk.Alg + " can't be used with a " + jwk.Kty + " key")
+		}
+		key.Method = method
+	}
+	return key, nil
+}
+
+var curves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
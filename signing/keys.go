@@ -0,0 +1,192 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+	"net/http"
+)
+
+//Errors from VerifyRequest
+var (
+	ErrNoTokenFound = errors.New("no token found")
+	ErrUnauthorized = errors.New("token is unauthorized")
+	ErrExpired      = errors.New("token is expired")
+)
+
+//Returned by Keyfunc for tokens it has no key for
+var (
+	ErrUnknownKey  = errors.New("token was signed with an unknown key")
+	ErrAlgMismatch = errors.New("token alg does not match its key")
+)
+
+//A key tokens are signed or verified with. Keys loaded from a public key
+//can only verify.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+//Keys for signing and verifying access tokens. Tokens are signed with one
+//key and carry its id as their kid header so that keys which signed tokens
+//before a rotation can keep verifying them.
+type KeySet struct {
+	signer *Key
+	keys   map[string]*Key
+	order  []*Key
+}
+
+//Key set that signs and verifies with an HS256 secret. Tokens signed with it
+//have no kid.
+func NewHMAC(secret []byte) *KeySet {
+	ks := &KeySet{keys: map[string]*Key{}}
+	ks.add(&Key{Method: jwt.SigningMethodHS256, sign: secret, verify: secret})
+	ks.signer = ks.keys[""]
+	return ks
+}
+
+//Loads a key set that signs with the private key in the PEM file at
+//signingKey and also verifies with the keys at verifyKeys, which can be
+//public or private. A secret, when given, keeps verifying HS256 tokens
+//without a kid so they last until they expire after switching keys.
+func Load(signingKey string, verifyKeys []string, secret string) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]*Key{}}
+
+	k, err := readPEM(signingKey)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newKey(k)
+	if err != nil {
+		return nil, errors.New(signingKey + ": " + err.Error())
+	}
+	if signer.sign == nil {
+		return nil, errors.New(signingKey + " holds a public key, tokens can only be signed with a private key")
+	}
+	ks.add(signer)
+	ks.signer = signer
+
+	for _, path := range verifyKeys {
+		k, err := readPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newKey(k)
+		if err != nil {
+			return nil, errors.New(path + ": " + err.Error())
+		}
+		ks.add(key)
+	}
+
+	if secret != "" {
+		ks.add(&Key{Method: jwt.SigningMethodHS256, verify: []byte(secret)})
+	}
+	return ks, nil
+}
+
+func (ks *KeySet) add(key *Key) {
+	if _, ok := ks.keys[key.ID]; ok {
+		return
+	}
+	ks.keys[key.ID] = key
+	ks.order = append(ks.order, key)
+}
+
+//Wraps a parsed key with the signing method that goes with its type. Ids
+//are JWK thumbprints so a key keeps its id when it moves from signing to
+//verifying.
+func newKey(k interface{}) (*Key, error) {
+	key := &Key{}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		key.sign, key.verify = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.verify = k
+	case *ecdsa.PrivateKey:
+		key.sign, key.verify = k, &k.PublicKey
+	case *ecdsa.PublicKey:
+		key.verify = k
+	case ed25519.PrivateKey:
+		key.sign, key.verify = k, k.Public().(ed25519.PublicKey)
+	case ed25519.PublicKey:
+		key.verify = k
+	default:
+		return nil, errors.New("only RSA, ECDSA and Ed25519 keys are supported")
+	}
+
+	switch public := key.verify.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys need to be at least 2048 bits")
+		}
+		key.Method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			key.Method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.Method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.Method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("ECDSA keys need to be on P-256, P-384 or P-521")
+		}
+	case ed25519.PublicKey:
+		key.Method = SigningMethodEdDSA
+	}
+
+	key.ID = thumbprint(key.jwk())
+	return key, nil
+}
+
+//Signs claims with the signing key
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signer.Method, claims)
+	if ks.signer.ID != "" {
+		token.Header["kid"] = ks.signer.ID
+	}
+	return token.SignedString(ks.signer.sign)
+}
+
+//Picks the key to verify a token with by its kid, for jwt.Parse. The
+//token's alg has to be the key's so a public key can't be used as an HMAC
+//secret.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, ErrAlgMismatch
+	}
+	return key.verify, nil
+}
+
+//Finds a token in a request with the first of findTokenFns that returns
+//one, and verifies it
+func (ks *KeySet) VerifyRequest(r *http.Request, findTokenFns ...func(r *http.Request) string) (*jwt.Token, error) {
+	var tokenString string
+	for _, fn := range findTokenFns {
+		if tokenString = fn(r); tokenString != "" {
+			break
+		}
+	}
+	if tokenString == "" {
+		return nil, ErrNoTokenFound
+	}
+
+	token, err := jwt.Parse(tokenString, ks.Keyfunc)
+	//only tokens with a good signature are told apart as expired
+	if verr, ok := err.(*jwt.ValidationError); ok && verr.Errors == jwt.ValidationErrorExpired {
+		return token, ErrExpired
+	} else if err != nil || !token.Valid {
+		return token, ErrUnauthorized
+	}
+	return token, nil
+}
@@ -0,0 +1,144 @@
+package signing
+
+import (
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"email": "test@example.com", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func tokenRequest(token string) *http.Request {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func fromHeader(r *http.Request) string {
+	return r.Header.Get("Authorization")[len("Bearer "):]
+}
+
+func TestKeySet_SignAndVerify(t *testing.T) {
+	for key, alg := range map[string]string{
+		"testdata/rsa.pem":     "RS256",
+		"testdata/ec.pem":      "ES256",
+		"testdata/ed25519.pem": "EdDSA",
+	} {
+		ks, err := Load(key, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := ks.Sign(claims())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := ks.VerifyRequest(tokenRequest(signed), fromHeader)
+		if err != nil {
+			t.Fatalf("%s token didn't verify: %v", alg, err)
+		}
+		if token.Method.Alg() != alg || token.Header["kid"] != ks.signer.ID || ks.signer.ID == "" {
+			t.Fatalf("%s token has the header %v", alg, token.Header)
+		}
+	}
+}
+
+func TestKeySet_Rotation(t *testing.T) {
+	old, err := Load("testdata/rsa.pem", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := old.Sign(claims())
+
+	//the new key set signs with Ed25519 and still verifies with the old public key
+	ks, err := Load("testdata/ed25519.pem", []string{"testdata/rsa.pub.pem"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.VerifyRequest(tokenRequest(oldToken), fromHeader); err != nil {
+		t.Fatalf("token from the rotated key didn't verify: %v", err)
+	}
+
+	//once the old key is dropped its tokens stop verifying
+	dropped, _ := Load("testdata/ed25519.pem", nil, "")
+	if _, err := dropped.VerifyRequest(tokenRequest(oldToken), fromHeader); err != ErrUnauthorized {
+		t.Fatalf("%v was returned instead of ErrUnauthorized", err)
+	}
+
+	jwks := ks.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kty != "OKP" || jwks.Keys[1].Kty != "RSA" {
+		t.Fatalf("%+v", jwks)
+	}
+	if jwks.Keys[1].Kid != old.signer.ID || jwks.Keys[1].Alg != "RS256" || jwks.Keys[1].N == "" {
+		t.Fatalf("rotated key is listed as %+v", jwks.Keys[1])
+	}
+}
+
+func TestKeySet_RejectsAlgConfusion(t *testing.T) {
+	ks, err := Load("testdata/rsa.pem", nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//an HS256 token "signed" with the RSA key's id must not be checked as HMAC
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	forged.Header["kid"] = ks.signer.ID
+	signed, _ := forged.SignedString([]byte("secret"))
+	if _, err := ks.VerifyRequest(tokenRequest(signed), fromHeader); err != ErrUnauthorized {
+		t.Fatalf("%v was returned instead of ErrUnauthorized", err)
+	}
+
+	//tokens signed with the secret before switching keys verify until they expire
+	legacy, _ := NewHMAC([]byte("secret")).Sign(claims())
+	if _, err := ks.VerifyRequest(tokenRequest(legacy), fromHeader); err != nil {
+		t.Fatalf("HS256 token didn't verify: %v", err)
+	}
+	for _, key := range ks.JWKS().Keys {
+		if key.Kid == "" || key.Kty == "" {
+			t.Fatalf("the HMAC secret was published: %+v", key)
+		}
+	}
+}
+
+func TestKeySet_Expired(t *testing.T) {
+	ks := NewHMAC([]byte("secret"))
+	signed, _ := ks.Sign(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := ks.VerifyRequest(tokenRequest(signed), fromHeader); err != ErrExpired {
+		t.Fatalf("%v was returned instead of ErrExpired", err)
+	}
+	if _, err := ks.VerifyRequest(tokenRequest(""), fromHeader); err != ErrNoTokenFound {
+		t.Fatalf("%v was returned instead of ErrNoTokenFound", err)
+	}
+}
+
+func TestLoad_PublicSigningKey(t *testing.T) {
+	if _, err := Load("testdata/ed25519.pub.pem", nil, ""); err == nil {
+		t.Fatal("a public key was accepted for signing")
+	}
+}
+
+func TestFromJWKS(t *testing.T) {
+	ks, err := Load("testdata/ec.pem", []string{"testdata/rsa.pub.pem", "testdata/ed25519.pub.pem"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := ks.Sign(claims())
+
+	//the published keys verify the issuer's tokens and nothing signs with them
+	published := FromJWKS(ks.JWKS())
+	if _, err := published.VerifyRequest(tokenRequest(signed), fromHeader); err != nil {
+		t.Fatalf("token didn't verify with the published keys: %v", err)
+	}
+	if len(published.order) != 3 || published.signer != nil {
+		t.Fatalf("%d keys were read from the JWKS", len(published.order))
+	}
+
+	jwks := ks.JWKS()
+	jwks.Keys[0].Use = "enc"
+	if _, err := FromJWKS(jwks).VerifyRequest(tokenRequest(signed), fromHeader); err != ErrUnauthorized {
+		t.Fatalf("%v was returned instead of ErrUnauthorized for an encryption key", err)
+	}
+}
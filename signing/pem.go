@@ -0,0 +1,68 @@
+package signing
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+)
+
+//Object identifier of Ed25519 keys from RFC 8410
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type pkixPublicKey struct {
+	Algo      pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+//Reads the first PEM block in a file, which can hold a private key as
+//PKCS #1, SEC 1 or PKCS #8, or a public key as PKIX or PKCS #1. Ed25519 keys
+//are read here since crypto/x509 doesn't know them before Go 1.13.
+func readPEM(path string) (interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New(path + " has no PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PRIVATE KEY":
+		var key pkcs8
+		if _, err := asn1.Unmarshal(block.Bytes, &key); err == nil && key.Algo.Algorithm.Equal(oidEd25519) {
+			var seed []byte
+			if _, err := asn1.Unmarshal(key.PrivateKey, &seed); err != nil || len(seed) != ed25519.SeedSize {
+				return nil, errors.New(path + " has an invalid Ed25519 private key")
+			}
+			return ed25519.NewKeyFromSeed(seed), nil
+		}
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		var key pkixPublicKey
+		if _, err := asn1.Unmarshal(block.Bytes, &key); err == nil && key.Algo.Algorithm.Equal(oidEd25519) {
+			if len(key.PublicKey.Bytes) != ed25519.PublicKeySize {
+				return nil, errors.New(path + " has an invalid Ed25519 public key")
+			}
+			return ed25519.PublicKey(key.PublicKey.Bytes), nil
+		}
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return nil, errors.New(path + " holds a " + block.Type + " instead of a key")
+}
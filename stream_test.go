@@ -3,29 +3,47 @@ package main
 import (
 	"DiscoveryStreams/api"
 	"DiscoveryStreams/test_utilities"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"github.com/go-chi/chi"
-	"github.com/go-chi/jwtauth"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestStreamController_GetStream_Good(t *testing.T) {
-	client, err := test_utilities.GetMongoDBClient()
+	adServer, err := test_utilities.FakeAdServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adServer.Close()
+	adsURL := os.Getenv("ADS_URL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	defer os.Setenv("ADS_URL", adsURL)
+
+	streams, err := test_utilities.TestStreamStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	streamController := api.NewStreamController(client.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	streamController := api.NewStreamController(streams, tools)
 
-	testToken := test_utilities.GenerateFakeTestToken()
+	testToken := test_utilities.GenerateFakeTestTokenWithRole("editor")
 	chiRouter := chi.NewRouter()
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
 				s.Route("/{id}", func(sid chi.Router) {
@@ -43,18 +61,18 @@ func TestStreamController_GetStream_Good(t *testing.T) {
 	}
 }
 func TestStreamController_GetStream_NotFound(t *testing.T) {
-	client, err := test_utilities.GetMongoDBClient()
+	streams, err := test_utilities.TestStreamStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	streamController := api.NewStreamController(client.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	streamController := api.NewStreamController(streams, tools)
 
 	testToken := test_utilities.GenerateFakeTestToken()
 	chiRouter := chi.NewRouter()
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
 				s.Route("/{id}", func(sid chi.Router) {
@@ -75,19 +93,21 @@ func TestStreamController_GetStream_NotFound(t *testing.T) {
 	}
 }
 func TestStreamController_GetStream_AdsServiceDown(t *testing.T) {
+	adsURL := os.Getenv("ADS_URL")
 	os.Setenv("ADS_URL", "http://localhost:9000/")
-	client, err := test_utilities.GetMongoDBClient()
+	defer os.Setenv("ADS_URL", adsURL)
+	streams, err := test_utilities.TestStreamStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	streamController := api.NewStreamController(client.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	streamController := api.NewStreamController(streams, tools)
 
 	testToken := test_utilities.GenerateFakeTestToken()
 	chiRouter := chi.NewRouter()
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
 				s.Route("/{id}", func(sid chi.Router) {
@@ -105,25 +125,14 @@ func TestStreamController_GetStream_AdsServiceDown(t *testing.T) {
 	}
 }
 func TestStreamController_GetStream_DatabaseDown(t *testing.T) {
-	//Flushing redis cache before start of test
-	err := test_utilities.FlushRedis()
-	if err != nil {
-		t.Error(err)
-	}
-	client, err := test_utilities.GetMongoDBClient()
-	if err != nil {
-		t.Fatal(err)
-	}
 	tools := test_utilities.TestSetup()
-	streamController := api.NewStreamController(client.Database(os.Getenv("MONGO_DB_NAME")), tools)
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
-	_ = client.Disconnect(ctx)
+	streamController := api.NewStreamController(downStreamStore{}, tools)
 
 	testToken := test_utilities.GenerateFakeTestToken()
 	chiRouter := chi.NewRouter()
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
 				s.Route("/{id}", func(sid chi.Router) {
@@ -141,12 +150,9 @@ func TestStreamController_GetStream_DatabaseDown(t *testing.T) {
 	}
 }
 func TestStreamController_GetStream_DatabaseNameMissing(t *testing.T) {
-	//Flushing redis cache before start of test
-	err := test_utilities.FlushRedis()
-	if err != nil {
-		t.Error(err)
+	if os.Getenv("MONGO_URI") == "" {
+		t.Skip("MONGO_URI is not set")
 	}
-
 	client, err := test_utilities.GetMongoDBClient()
 	if err != nil {
 		t.Fatal(err)
@@ -154,12 +160,12 @@ func TestStreamController_GetStream_DatabaseNameMissing(t *testing.T) {
 
 	tools := test_utilities.TestSetup()
 
-	streamController := api.NewStreamController(client.Database(os.Getenv("")), tools)
+	streamController := api.NewStreamController(api.NewMongoStreamStore(client.Database(os.Getenv(""))), tools)
 	testToken := test_utilities.GenerateFakeTestToken()
 	dbnamemissing := chi.NewRouter()
 
 	dbnamemissing.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)))
+		guarded.Use(VerifyJWT(tools))
 		//guarded.Post("/refresh",usersController.Logout)
 		guarded.Route("/v1", func(v1 chi.Router) {
 			v1.Route("/streams", func(s chi.Router) {
@@ -177,6 +183,1078 @@ func TestStreamController_GetStream_DatabaseNameMissing(t *testing.T) {
 		t.Fatalf(fmt.Sprintf("%d", resp.StatusCode))
 	}
 }
+func TestStreamController_AdminCRUD(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1", func(v1 chi.Router) {
+			v1.Route("/streams", func(s chi.Router) {
+				s.Post("/", streamController.CreateStream)
+				s.Route("/{id}", func(sid chi.Router) {
+					sid.Put("/", streamController.ReplaceStream)
+					sid.Patch("/", streamController.UpdateStream)
+					sid.Delete("/", streamController.DeleteStream)
+				})
+			})
+		})
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	createBody := []byte(`{"id":"admin-crud-test","streamUrl":"https://example.com/master.m3u8","captions":{"vtt":{"en":"https://example.com/en.vtt","es":{"url":"https://example.com/es.vtt","label":"Español / CC"}},"scc":{"en":""}}}`)
+	if resp, body := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(createBody), testToken); resp.StatusCode != 201 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 with %s", resp.StatusCode, body))
+	}
+
+	if _, body := test_utilities.TestRequest(t, ts, "PATCH", "/v1/streams/admin-crud-test", bytes.NewReader([]byte(`{}`)), testToken); !strings.Contains(body, `"label": "Español / CC"`) || !strings.Contains(body, `"url": "https:\/\/example.com\/es.vtt"`) || !strings.Contains(body, `"en": "https:\/\/example.com\/en.vtt"`) {
+		t.Fatalf(body)
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(createBody), testToken); resp.StatusCode != 409 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 409", resp.StatusCode))
+	}
+
+	patchBody := []byte(`{"streamUrl":"https://example.com/other.m3u8"}`)
+	if resp, body := test_utilities.TestRequest(t, ts, "PATCH", "/v1/streams/admin-crud-test", bytes.NewReader(patchBody), testToken); resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+
+	mismatchBody := []byte(`{"id":"another-id","streamUrl":"https://example.com/master.m3u8"}`)
+	if resp, _ := test_utilities.TestRequest(t, ts, "PUT", "/v1/streams/admin-crud-test", bytes.NewReader(mismatchBody), testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/streams/admin-crud-test", nil, testToken); resp.StatusCode != 204 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204", resp.StatusCode))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/streams/admin-crud-test", nil, testToken); resp.StatusCode != 404 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", resp.StatusCode))
+	}
+}
+func TestStreamController_PlaybackLeases(t *testing.T) {
+	for k, v := range map[string]string{"PLAYBACK_MAX_STREAMS": "2", "PLAYBACK_LEASE_TTL": "1m"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1/streams/{id}", func(sid chi.Router) {
+			sid.Get("/", streamController.GetStream)
+			sid.Post("/play", streamController.PlayStream)
+			sid.Put("/play/{leaseId}", streamController.PlaybackHeartbeat)
+			sid.Delete("/play/{leaseId}", streamController.StopPlayback)
+		})
+		guarded.Get("/v1/me/playback", streamController.ListPlayback)
+		guarded.Delete("/v1/me/playback/{leaseId}", streamController.StopPlayback)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	type lease struct {
+		ID             string `json:"id"`
+		StreamID       string `json:"streamId"`
+		HeartbeatEvery int64  `json:"heartbeatEvery"`
+		ManifestURL    string `json:"manifestUrl"`
+	}
+	play := func() (int, lease) {
+		resp, body := test_utilities.TestRequest(t, ts, "POST", "/v1/streams/5938b99cb6906eb1fbaf1f1c/play", nil, testToken)
+		var l lease
+		json.Unmarshal([]byte(body), &l)
+		return resp.StatusCode, l
+	}
+
+	//viewers only get a playable url with a lease
+	if _, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/5938b99cb6906eb1fbaf1f1c", nil, testToken); strings.Contains(body, "streamUrl") {
+		t.Fatalf(fmt.Sprintf("%s was returned with the origin url to a viewer", body))
+	}
+	status, first := play()
+	if status != http.StatusCreated || first.ID == "" || first.HeartbeatEvery != 20 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v instead of 201 with a lease", status, first))
+	}
+	if first.ManifestURL != "/v1/streams/5938b99cb6906eb1fbaf1f1c/manifest.m3u8?lease="+first.ID {
+		t.Fatalf(fmt.Sprintf("%s was returned instead of the manifest url for the lease", first.ManifestURL))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams/no-such-stream/play", nil, testToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 playing a missing stream", resp.StatusCode))
+	}
+	if status, _ := play(); status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 for the second stream", status))
+	}
+	if status, over := play(); status != http.StatusConflict || over.ManifestURL != "" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v instead of 409 without a url over the limit", status, over))
+	}
+
+	resp, body := test_utilities.TestRequest(t, ts, "PUT", "/v1/streams/5938b99cb6906eb1fbaf1f1c/play/"+first.ID, nil, testToken)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, first.ID) {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s instead of 200 renewing a lease", resp.StatusCode, body))
+	}
+	var leases []lease
+	_, body = test_utilities.TestRequest(t, ts, "GET", "/v1/me/playback", nil, testToken)
+	if json.Unmarshal([]byte(body), &leases); len(leases) != 2 {
+		t.Fatalf(fmt.Sprintf("%s was listed instead of 2 leases", body))
+	}
+
+	//a lease can only be stopped under its own stream
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/streams/5938b99cb6906eb1fbaf1f1d/play/"+first.ID, nil, testToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 stopping a lease under another stream", resp.StatusCode))
+	}
+
+	//kicking a device frees its slot and stops its heartbeats
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/playback/"+first.ID, nil, testToken); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204 kicking a lease", resp.StatusCode))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "PUT", "/v1/streams/5938b99cb6906eb1fbaf1f1c/play/"+first.ID, nil, testToken); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 renewing a kicked lease", resp.StatusCode))
+	}
+	if status, _ := play(); status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 after a slot was freed", status))
+	}
+
+	//leases expire without heartbeats
+	os.Setenv("PLAYBACK_LEASE_TTL", "1s")
+	tools.Cache.DelPrefix("playback:")
+	status, short := play()
+	time.Sleep(1100 * time.Millisecond)
+	if resp, _ := test_utilities.TestRequest(t, ts, "PUT", "/v1/streams/5938b99cb6906eb1fbaf1f1c/play/"+short.ID, nil, testToken); status != http.StatusCreated || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 renewing an expired lease", resp.StatusCode))
+	}
+}
+func TestProgressController_ContinueWatching(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+	progressStore := api.NewMemoryProgressStore()
+	progressController := api.NewProgressController(progressStore, streamController, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1/me", func(me chi.Router) {
+			me.Get("/progress/{streamId}", progressController.GetProgress)
+			me.Put("/progress/{streamId}", progressController.SaveProgress)
+			me.Get("/continue-watching", progressController.ContinueWatching)
+		})
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	save := func(streamID string, body string) int {
+		resp, _ := test_utilities.TestRequest(t, ts, "PUT", "/v1/me/progress/"+streamID, strings.NewReader(body), testToken)
+		return resp.StatusCode
+	}
+	type watching struct {
+		StreamID string  `json:"streamId"`
+		Position float64 `json:"position"`
+		Stream   struct {
+			ID        string `json:"id"`
+			StreamURL string `json:"streamUrl"`
+		} `json:"stream"`
+	}
+	continueWatching := func() []watching {
+		resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me/continue-watching", nil, testToken)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+		}
+		var list []watching
+		json.Unmarshal([]byte(body), &list)
+		return list
+	}
+
+	if status := save("5938b99cb6906eb1fbaf1f1c", `{"position": 700, "duration": 600}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a position past the duration", status))
+	}
+	if status := save("no-such-stream", `{"position": 1, "duration": 600}`); status != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 for a missing stream", status))
+	}
+	for _, p := range []struct{ id, body string }{
+		{"5938b99cb6906eb1fbaf1f1c", `{"position": 100, "duration": 1000}`},
+		{"5938b99cb6906eb1fbaf1f1d", `{"position": 300, "duration": 600}`},
+		{"5938b99cb6906eb1fbaf1f1e", `{"position": 590, "duration": 600}`},
+	} {
+		if status := save(p.id, p.body); status != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 saving progress on %s", status, p.id))
+		}
+	}
+
+	//progress is listed from the cache before it is flushed, and finished streams are left out
+	list := continueWatching()
+	if len(list) != 2 || list[0].StreamID != "5938b99cb6906eb1fbaf1f1d" || list[1].StreamID != "5938b99cb6906eb1fbaf1f1c" || list[0].Stream.ID == "" || list[0].Stream.StreamURL != "" {
+		t.Fatalf(fmt.Sprintf("%+v was listed instead of the two unfinished streams without their origin urls, most recent first", list))
+	}
+	if _, err := progressStore.Get(context.Background(), "test@example", "5938b99cb6906eb1fbaf1f1c"); err != api.ErrNotFound {
+		t.Fatalf("progress was written to the store before it was flushed")
+	}
+
+	if flushed, err := progressController.Flush(context.Background()); err != nil || flushed != 3 {
+		t.Fatalf(fmt.Sprintf("%d were flushed with %v instead of 3", flushed, err))
+	}
+	if stored, err := progressStore.Get(context.Background(), "test@example", "5938b99cb6906eb1fbaf1f1c"); err != nil || stored.Position != 100 {
+		t.Fatalf(fmt.Sprintf("%+v was stored with %v after flushing", stored, err))
+	}
+	if flushed, _ := progressController.Flush(context.Background()); flushed != 0 {
+		t.Fatalf(fmt.Sprintf("%d were flushed again instead of 0", flushed))
+	}
+
+	//a flush leaves a lock taken by another instance alone
+	tools.Cache.SetNX("lock:progress-flush", []byte("another-instance"), time.Minute)
+	save("5938b99cb6906eb1fbaf1f1e", `{"position": 10, "duration": 1000}`)
+	if flushed, _ := progressController.Flush(context.Background()); flushed != 0 {
+		t.Fatalf(fmt.Sprintf("%d were flushed while another instance held the lock", flushed))
+	}
+	if held, err := tools.Cache.Get("lock:progress-flush"); err != nil || string(held) != "another-instance" {
+		t.Fatalf(fmt.Sprintf("%s was left in the lock with %v instead of the other instance's", held, err))
+	}
+	tools.Cache.Del("lock:progress-flush")
+	tools.Cache.DelPrefix("progress:")
+
+	//newer progress in the cache wins over the store and moves the stream up
+	save("5938b99cb6906eb1fbaf1f1c", `{"position": 200, "duration": 1000}`)
+	list = continueWatching()
+	if len(list) != 2 || list[0].StreamID != "5938b99cb6906eb1fbaf1f1c" || list[0].Position != 200 {
+		t.Fatalf(fmt.Sprintf("%+v was listed after resuming a stream", list))
+	}
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me/progress/5938b99cb6906eb1fbaf1f1c", nil, testToken)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"position":200`) {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s instead of the latest progress", resp.StatusCode, body))
+	}
+
+	//deleted streams are skipped
+	streams.Delete(context.Background(), "5938b99cb6906eb1fbaf1f1d")
+	tools.Cache.DelPrefix("stream:")
+	if list = continueWatching(); len(list) != 1 || list[0].StreamID != "5938b99cb6906eb1fbaf1f1c" {
+		t.Fatalf(fmt.Sprintf("%+v was listed after a stream was deleted", list))
+	}
+
+	//progress, flushed or not, moves with the user when their email changes
+	if err := progressController.ChangeOwner(context.Background(), "Test@example", "new@example"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := progressStore.Get(context.Background(), "test@example", "5938b99cb6906eb1fbaf1f1d"); err != api.ErrNotFound {
+		t.Fatalf("progress was left under the old email")
+	}
+	if flushed, err := progressController.Flush(context.Background()); err != nil || flushed != 1 {
+		t.Fatalf(fmt.Sprintf("%d were flushed with %v instead of the 1 that moved", flushed, err))
+	}
+	for streamID, position := range map[string]float64{"5938b99cb6906eb1fbaf1f1c": 200, "5938b99cb6906eb1fbaf1f1d": 300} {
+		if stored, err := progressStore.Get(context.Background(), "new@example", streamID); err != nil || stored.Position != position {
+			t.Fatalf(fmt.Sprintf("%+v was stored with %v under the new email", stored, err))
+		}
+	}
+}
+func TestWatchlistsController(t *testing.T) {
+	//lists don't ask the ad server for the ads of every stream in them
+	var adCalls int32
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&adCalls, 1)
+		w.Write([]byte(`{"breaks": []}`))
+	}))
+	defer adServer.Close()
+	for k, v := range map[string]string{"ADS_URL": adServer.URL + "/", "WATCHLIST_MAX_ITEMS": "3"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var extra api.Stream
+	extra.ID = "5938b99cb6906eb1fbaf1f1f"
+	extra.StreamURL = "https://example.com/master.m3u8"
+	if err := streams.Create(context.Background(), extra); err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	counted := &countingStreamStore{StreamStore: streams}
+	streamController := api.NewStreamController(counted, tools)
+	listStore := api.NewMemoryWatchlistStore()
+	watchlistsController := api.NewWatchlistsController(listStore, streamController, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1/me/lists", func(lists chi.Router) {
+			lists.Get("/", watchlistsController.ListWatchlists)
+			lists.Post("/", watchlistsController.CreateWatchlist)
+			lists.Route("/{listId}", func(list chi.Router) {
+				list.Get("/", watchlistsController.GetWatchlist)
+				list.Patch("/", watchlistsController.RenameWatchlist)
+				list.Delete("/", watchlistsController.DeleteWatchlist)
+				list.Post("/items", watchlistsController.AddWatchlistItem)
+				list.Put("/items", watchlistsController.ReorderWatchlist)
+				list.Delete("/items/{streamId}", watchlistsController.RemoveWatchlistItem)
+			})
+		})
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	type watchlist struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Default   bool   `json:"default"`
+		ItemCount int    `json:"itemCount"`
+		Items     []struct {
+			ID  string          `json:"id"`
+			Ads json.RawMessage `json:"ads"`
+		} `json:"items"`
+	}
+	request := func(method string, path string, body string) (int, watchlist) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		resp, respBody := test_utilities.TestRequest(t, ts, method, path, reader, testToken)
+		var list watchlist
+		json.Unmarshal([]byte(respBody), &list)
+		return resp.StatusCode, list
+	}
+	order := func(list watchlist) string {
+		var ids []string
+		for _, item := range list.Items {
+			ids = append(ids, item.ID[len(item.ID)-1:])
+		}
+		return strings.Join(ids, ",")
+	}
+
+	//favorites exists before anything is added to it
+	if status, list := request("GET", "/v1/me/lists/favorites", ""); status != http.StatusOK || !list.Default || len(list.Items) != 0 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v instead of an empty favorites list", status, list))
+	}
+	if status, _ := request("POST", "/v1/me/lists/favorites/items", `{"streamId":"no-such-stream"}`); status != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 adding a missing stream", status))
+	}
+	for _, id := range []string{"5938b99cb6906eb1fbaf1f1c", "5938b99cb6906eb1fbaf1f1d"} {
+		if status, _ := request("POST", "/v1/me/lists/favorites/items", `{"streamId":"`+id+`"}`); status != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 adding %s", status, id))
+		}
+	}
+	status, list := request("POST", "/v1/me/lists/favorites/items", `{"streamId":"5938b99cb6906eb1fbaf1f1e", "position": 0}`)
+	if status != http.StatusOK || order(list) != "e,c,d" || len(list.Items[0].Ads) != 0 || atomic.LoadInt32(&adCalls) != 0 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v instead of the streams in order without ads", status, list))
+	}
+	if status, _ := request("POST", "/v1/me/lists/favorites/items", `{"streamId":"5938b99cb6906eb1fbaf1f1c"}`); status != http.StatusConflict {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 409 adding a stream twice", status))
+	}
+	if status, _ := request("POST", "/v1/me/lists/favorites/items", `{"streamId":"5938b99cb6906eb1fbaf1f1f"}`); status != http.StatusConflict {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 409 adding to a full list", status))
+	}
+
+	//named lists
+	status, named := request("POST", "/v1/me/lists", `{"name":" Weekend "}`)
+	if status != http.StatusCreated || named.Name != "Weekend" || named.ID == "" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v instead of a new list", status, named))
+	}
+	if status, _ := request("POST", "/v1/me/lists", `{"name":""}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for an empty name", status))
+	}
+	request("POST", "/v1/me/lists/"+named.ID+"/items", `{"streamId":"5938b99cb6906eb1fbaf1f1d"}`)
+	if status, list := request("PATCH", "/v1/me/lists/"+named.ID, `{"name":"Later"}`); status != http.StatusOK || list.Name != "Later" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v renaming a list", status, list))
+	}
+	if status, _ := request("PATCH", "/v1/me/lists/favorites", `{"name":"Mine"}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 renaming favorites", status))
+	}
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me/lists", nil, testToken)
+	var lists []watchlist
+	json.Unmarshal([]byte(body), &lists)
+	if resp.StatusCode != http.StatusOK || len(lists) != 2 || lists[0].ID != "favorites" || lists[0].ItemCount != 3 || lists[1].ItemCount != 1 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s instead of favorites and the named list", resp.StatusCode, body))
+	}
+
+	//reordering, with deleted streams left out of reads but kept in place
+	if status, _ := request("PUT", "/v1/me/lists/favorites/items", `{"items":["5938b99cb6906eb1fbaf1f1c","5938b99cb6906eb1fbaf1f1c"]}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a repeated item", status))
+	}
+	if status, list := request("PUT", "/v1/me/lists/favorites/items", `{"items":["5938b99cb6906eb1fbaf1f1d","5938b99cb6906eb1fbaf1f1c"]}`); status != http.StatusOK || order(list) != "d,c,e" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v reordering", status, list))
+	}
+	streams.Delete(context.Background(), "5938b99cb6906eb1fbaf1f1c")
+	tools.Cache.DelPrefix("stream:")
+	atomic.StoreInt32(&counted.gets, 0)
+	if status, list := request("GET", "/v1/me/lists/favorites", ""); status != http.StatusOK || order(list) != "d,e" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v after a stream was deleted", status, list))
+	}
+	//streams that aren't cached are read from the store at once
+	if gets, getManys := atomic.LoadInt32(&counted.gets), atomic.LoadInt32(&counted.getManys); gets != 0 || getManys != 1 {
+		t.Fatalf(fmt.Sprintf("the store was read %d times one by one and %d times at once instead of once at once", gets, getManys))
+	}
+
+	if status, _ := request("DELETE", "/v1/me/lists/favorites/items/5938b99cb6906eb1fbaf1f1d", ""); status != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204 removing an item", status))
+	}
+	if status, _ := request("DELETE", "/v1/me/lists/favorites/items/5938b99cb6906eb1fbaf1f1d", ""); status != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 removing it again", status))
+	}
+	if status, _ := request("DELETE", "/v1/me/lists/favorites", ""); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 deleting favorites", status))
+	}
+	if status, _ := request("DELETE", "/v1/me/lists/"+named.ID, ""); status != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204 deleting a list", status))
+	}
+	if status, _ := request("GET", "/v1/me/lists/"+named.ID, ""); status != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 for a deleted list", status))
+	}
+
+	//lists move with the user when their email changes
+	if err := watchlistsController.ChangeOwner(context.Background(), "test@example", "new@example"); err != nil {
+		t.Fatal(err)
+	}
+	if moved, err := listStore.List(context.Background(), "new@example"); err != nil || len(moved) != 1 || !moved[0].Default || len(moved[0].Items) != 2 {
+		t.Fatalf(fmt.Sprintf("%+v was stored with %v under the new email", moved, err))
+	}
+	if left, _ := listStore.List(context.Background(), "test@example"); len(left) != 0 {
+		t.Fatalf(fmt.Sprintf("%+v was left under the old email", left))
+	}
+}
+func TestWatchlistsController_FavoritesCreatedConcurrently(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	listStore := racingWatchlistStore{WatchlistStore: api.NewMemoryWatchlistStore()}
+	watchlistsController := api.NewWatchlistsController(listStore, api.NewStreamController(streams, tools), tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Post("/v1/me/lists/{listId}/items", watchlistsController.AddWatchlistItem)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	resp, body := test_utilities.TestRequest(t, ts, "POST", "/v1/me/lists/favorites/items", strings.NewReader(`{"streamId":"5938b99cb6906eb1fbaf1f1c"}`), testToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s instead of 200 when another request created favorites first", resp.StatusCode, body))
+	}
+	if stored, err := listStore.Get(context.Background(), "test@example", "favorites"); err != nil || len(stored.Items) != 1 {
+		t.Fatalf(fmt.Sprintf("%+v was stored with %v instead of favorites with the stream", stored, err))
+	}
+}
+func TestStreamController_CreateStream_Invalid(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Post("/v1/streams", streamController.CreateStream)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	badBody := []byte(`{"id":"","streamUrl":"not a url"}`)
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(badBody), testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+
+	badLanguage := []byte(`{"id":"bad-language","streamUrl":"https://example.com/master.m3u8","captions":{"vtt":{"english!":"https://example.com/en.vtt"}}}`)
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(badLanguage), testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(badBody), ""); resp.StatusCode != 401 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401", resp.StatusCode))
+	}
+}
+func TestStreamController_ListStreamIds_Paging(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1", func(v1 chi.Router) {
+			v1.Route("/streams", func(s chi.Router) {
+				s.Get("/", streamController.ListStreamIds)
+			})
+		})
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	var page struct {
+		Ids  []string `json:"ids"`
+		Next string   `json:"next"`
+	}
+
+	_, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams", nil, testToken)
+	if err := json.Unmarshal([]byte(body), &page); err != nil || len(page.Ids) < 3 || page.Next != "" {
+		t.Fatalf(body)
+	}
+	total := len(page.Ids)
+
+	var seen []string
+	next := "/v1/streams?limit=2"
+	for next != "" {
+		page.Next = ""
+		resp, body := test_utilities.TestRequest(t, ts, "GET", next, nil, testToken)
+		if resp.StatusCode != 200 {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+		}
+		if err := json.Unmarshal([]byte(body), &page); err != nil || len(page.Ids) > 2 {
+			t.Fatalf(body)
+		}
+		seen = append(seen, page.Ids...)
+		next = page.Next
+	}
+	if len(seen) != total {
+		t.Fatalf(fmt.Sprintf("paged through %d ids instead of %d", len(seen), total))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams?limit=0", nil, testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams?sort=-id&cursor=bm90LWEtY3Vyc29y", nil, testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+}
+func TestStreamController_GetCaptions_Converts(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	streamController := api.NewStreamController(streams, tools)
+
+	srt, err := ioutil.ReadFile("captions/testdata/sample.srt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(srt)
+	}))
+	defer origin.Close()
+
+	var stream api.Stream
+	stream.ID = "captions-test"
+	stream.StreamURL = "https://example.com/master.m3u8"
+	stream.Captions.Srt = api.CaptionTracks{"es": {URL: origin.URL + "/es.srt"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := streams.Create(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/streams/{id}/captions/{lang}.{format}", streamController.GetCaptions)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/captions-test/captions/es.vtt", nil, testToken)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/vtt; charset=utf-8" {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	if !strings.HasPrefix(body, "WEBVTT") || !strings.Contains(body, "00:00:05.500 --> 00:00:07.250") {
+		t.Fatalf(body)
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/captions-test/captions/fr.vtt", nil, testToken); resp.StatusCode != 404 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", resp.StatusCode))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/captions-test/captions/es.scc", nil, testToken); resp.StatusCode != 400 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+
+	//converted captions are served from the cache once the origin is gone
+	origin.Close()
+	if resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/captions-test/captions/es.vtt", nil, testToken); resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+}
+func TestStreamController_GetManifest_InsertsAds(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,SUBTITLES=\"subs\"\nlow/index.m3u8\n" +
+				"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\",URI=\"subs/en.m3u8\"\n"))
+		case "/demuxed.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=800000,AUDIO=\"aac\"\nlow/index.m3u8\n" +
+				"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aac\",NAME=\"English\",URI=\"audio/en.m3u8\"\n"))
+		case "/audio/en.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000,\nen0.aac\n#EXTINF:10.000,\nen1.aac\n#EXT-X-ENDLIST\n"))
+		case "/subs/en.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000,\nen0.vtt\n#EXTINF:10.000,\nen1.vtt\n#EXT-X-ENDLIST\n"))
+		case "/low/index.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:10.000,\nseg0.ts\n#EXTINF:10.000,\nseg1.ts\n#EXT-X-ENDLIST\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer origin.Close()
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"breaks": [{"breakId": "mid0", "timeOffset": 10, "ads": [{"creative": "abcd1234", "duration": 15}]}]}`))
+	}))
+	defer adServer.Close()
+
+	adsURL, creativeURL := os.Getenv("ADS_URL"), os.Getenv("AD_CREATIVE_URL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	os.Setenv("AD_CREATIVE_URL", "https://ads.example.com/{creative}.ts")
+	defer os.Setenv("ADS_URL", adsURL)
+	defer os.Setenv("AD_CREATIVE_URL", creativeURL)
+	streamController := api.NewStreamController(streams, tools)
+
+	var stream api.Stream
+	stream.ID = "manifest-test"
+	stream.StreamURL = origin.URL + "/master.m3u8"
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := streams.Create(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+	stream.ID = "demuxed-test"
+	stream.StreamURL = origin.URL + "/demuxed.m3u8"
+	if err := streams.Create(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/streams/{id}/manifest.m3u8", streamController.GetManifest)
+		guarded.Post("/v1/streams/{id}/play", streamController.PlayStream)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	//playlists are only served with a lease for the stream
+	play := func(id string) string {
+		resp, body := test_utilities.TestRequest(t, ts, "POST", "/v1/streams/"+id+"/play", nil, testToken)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 201 playing %s", resp.StatusCode, id))
+		}
+		var lease struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal([]byte(body), &lease)
+		return lease.ID
+	}
+	lease := play("manifest-test")
+	for _, query := range []string{"", "?lease=made-up", "?lease=" + play("5938b99cb6906eb1fbaf1f1c")} {
+		if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/manifest-test/manifest.m3u8"+query, nil, testToken); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for %q", resp.StatusCode, query))
+		}
+	}
+
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/manifest-test/manifest.m3u8?jwt="+testToken+"&lease="+lease, nil, testToken)
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "application/vnd.apple.mpegurl" {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	if !strings.Contains(body, "manifest.m3u8?jwt="+testToken+"&lease="+lease+"&variant=0") {
+		t.Fatalf(body)
+	}
+
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/manifest-test/manifest.m3u8?variant=0&lease="+lease, nil, testToken)
+	if resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	want := []string{
+		origin.URL + "/low/seg0.ts",
+		"#EXT-X-DISCONTINUITY",
+		"#EXT-X-CUE-OUT:DURATION=15.000",
+		"https://ads.example.com/abcd1234.ts",
+		"#EXT-X-CUE-IN",
+		origin.URL + "/low/seg1.ts",
+	}
+	last := 0
+	for _, line := range want {
+		i := strings.Index(body[last:], line)
+		if i < 0 {
+			t.Fatalf("%s is missing or out of order in\n%s", line, body)
+		}
+		last += i + len(line)
+	}
+
+	//subtitle renditions leave a gap as long as the ads at the same time
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/manifest-test/manifest.m3u8?variant=1&lease="+lease, nil, testToken)
+	if resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	want = []string{
+		origin.URL + "/subs/en0.vtt",
+		"#EXT-X-DISCONTINUITY",
+		"#EXT-X-CUE-OUT:DURATION=15.000",
+		"#EXT-X-GAP",
+		"#EXTINF:15.000,",
+		"#EXT-X-CUE-IN",
+		origin.URL + "/subs/en1.vtt",
+	}
+	last = 0
+	for _, line := range want {
+		i := strings.Index(body[last:], line)
+		if i < 0 {
+			t.Fatalf("%s is missing or out of order in\n%s", line, body)
+		}
+		last += i + len(line)
+	}
+
+	//separate audio can't play the ads, so neither the video nor the audio get any
+	demuxed := play("demuxed-test")
+	for variant, segment := range map[string]string{"0": "/low/seg1.ts", "1": "/audio/en1.aac"} {
+		resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/demuxed-test/manifest.m3u8?variant="+variant+"&lease="+demuxed, nil, testToken)
+		if resp.StatusCode != 200 || !strings.Contains(body, origin.URL+segment) || strings.Contains(body, "DISCONTINUITY") {
+			t.Fatalf(fmt.Sprintf("%d was returned with %s instead of variant %s without ads", resp.StatusCode, body, variant))
+		}
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/manifest-test/manifest.m3u8?variant=5&lease="+lease, nil, testToken); resp.StatusCode != 404 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", resp.StatusCode))
+	}
+}
+func TestStreamController_GetVMAP_LinksVAST(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"breaks": [{"breakId": "0.0.1", "position": "preroll", "timeOffset": 0, "ads": [{"creative": "abcd1234", "duration": 15}]}]}`))
+	}))
+	defer adServer.Close()
+
+	adsURL, creativeURL := os.Getenv("ADS_URL"), os.Getenv("AD_CREATIVE_URL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	os.Setenv("AD_CREATIVE_URL", "https://ads.example.com/{creative}.mp4")
+	defer os.Setenv("ADS_URL", adsURL)
+	defer os.Setenv("AD_CREATIVE_URL", creativeURL)
+	streamController := api.NewStreamController(streams, tools)
+
+	var stream api.Stream
+	stream.ID = "vmap-test"
+	stream.StreamURL = "https://example.com/master.m3u8"
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := streams.Create(ctx, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/streams/{id}/ads.vmap", streamController.GetVMAP)
+		guarded.Get("/v1/streams/{id}/ads/{breakId}/vast.xml", streamController.GetVAST)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/vmap-test/ads.vmap", nil, testToken)
+	if resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	vastURL := ts.URL + "/v1/streams/vmap-test/ads/0.0.1/vast.xml"
+	if !strings.Contains(body, `timeOffset="start"`) || !strings.Contains(body, "<![CDATA["+vastURL+"]]>") {
+		t.Fatalf(body)
+	}
+
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/vmap-test/ads/0.0.1/vast.xml", nil, testToken)
+	if resp.StatusCode != 200 || !strings.Contains(body, "<Duration>00:00:15.000</Duration>") ||
+		!strings.Contains(body, "https://ads.example.com/abcd1234.mp4") {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/vmap-test/ads/missing/vast.xml", nil, testToken); resp.StatusCode != 404 {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", resp.StatusCode))
+	}
+}
+func TestStreamController_GetStream_AdsFallback(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	var down int32
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"breaks": [{"breakId": "mid0", "timeOffset": 10, "ads": []}]}`))
+	}))
+	defer adServer.Close()
+
+	adsURL, fallback := os.Getenv("ADS_URL"), os.Getenv("ADS_FALLBACK")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	os.Setenv("ADS_FALLBACK", "last-known-good")
+	defer os.Setenv("ADS_URL", adsURL)
+	defer os.Setenv("ADS_FALLBACK", fallback)
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/streams/{id}", streamController.GetStream)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	streamID := "5938b99cb6906eb1fbaf1f1c"
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/streams/"+streamID, nil, testToken)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Ads-Degraded") != "" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+
+	//the ad server goes down once the stream's ads have been evicted from the cache
+	atomic.StoreInt32(&down, 1)
+	tools.Cache.Del("ads:" + streamID)
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/"+streamID, nil, testToken)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Ads-Degraded") != "last-known-good" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	if !strings.Contains(body, `"breakId": "mid0"`) || !strings.Contains(body, `"adsDegraded": "last-known-good"`) {
+		t.Fatalf(body)
+	}
+
+	//without a last known-good copy the stream is served without ads
+	tools.Cache.Del("ads:lkg:" + streamID)
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/streams/"+streamID, nil, testToken)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Ads-Degraded") != "empty" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+}
+func TestStreamController_GetStream_StaleAdsRevalidate(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	var calls int32
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Write([]byte(fmt.Sprintf(`{"breaks": [{"breakId": "v%d", "timeOffset": 0, "ads": []}]}`, n)))
+	}))
+	defer adServer.Close()
+
+	adsURL, ttl, stale := os.Getenv("ADS_URL"), os.Getenv("ADS_CACHE_TTL"), os.Getenv("ADS_STALE_TTL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	os.Setenv("ADS_CACHE_TTL", "200ms")
+	os.Setenv("ADS_STALE_TTL", "1m")
+	defer os.Setenv("ADS_URL", adsURL)
+	defer os.Setenv("ADS_CACHE_TTL", ttl)
+	defer os.Setenv("ADS_STALE_TTL", stale)
+	streamController := api.NewStreamController(streams, tools)
+
+	testToken := test_utilities.GenerateFakeTestToken()
+	chiRouter := chi.NewRouter()
+
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/streams/{id}", streamController.GetStream)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	path := "/v1/streams/5938b99cb6906eb1fbaf1f1c"
+	for i := 0; i < 2; i++ {
+		if _, body := test_utilities.TestRequest(t, ts, "GET", path, nil, testToken); !strings.Contains(body, `"breakId": "v1"`) {
+			t.Fatalf(body)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("the ad server was called %d times instead of once while ads were fresh", n)
+	}
+
+	//expired ads are served stale while they refresh in the background
+	time.Sleep(300 * time.Millisecond)
+	if _, body := test_utilities.TestRequest(t, ts, "GET", path, nil, testToken); !strings.Contains(body, `"breakId": "v1"`) {
+		t.Fatalf(body)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, body := test_utilities.TestRequest(t, ts, "GET", path, nil, testToken)
+		if strings.Contains(body, `"breakId": "v2"`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ads were not refreshed: %s", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+func TestStreamController_GetStream_CoalescesParallelMisses(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	var calls int32
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"breaks": []}`))
+	}))
+	defer adServer.Close()
+
+	adsURL, lockTTL := os.Getenv("ADS_URL"), os.Getenv("CACHE_LOCK_TTL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	os.Setenv("CACHE_LOCK_TTL", "2s")
+	defer os.Setenv("ADS_URL", adsURL)
+	defer os.Setenv("CACHE_LOCK_TTL", lockTTL)
+
+	//two controllers stand in for two API instances sharing a cache
+	var servers []*httptest.Server
+	for i := 0; i < 2; i++ {
+		streamController := api.NewStreamController(streams, tools)
+		chiRouter := chi.NewRouter()
+		chiRouter.Get("/v1/streams/{id}", streamController.GetStream)
+		ts := httptest.NewServer(chiRouter)
+		defer ts.Close()
+		servers = append(servers, ts)
+	}
+
+	coalesced := func() int64 {
+		if v, ok := expvar.Get("streamCache").(*expvar.Map).Get("ads_coalesced").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := coalesced()
+
+	const n = 40
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(ts *httptest.Server) {
+			defer wg.Done()
+			resp, err := http.Get(ts.URL + "/v1/streams/5938b99cb6906eb1fbaf1f1c")
+			if err != nil {
+				errs <- err
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				errs <- fmt.Errorf("%d was returned instead of 200", resp.StatusCode)
+			}
+		}(servers[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("the ad server was called %d times instead of once", c)
+	}
+	if coalesced() == before {
+		t.Fatal("no requests were coalesced")
+	}
+}
+
+//Stream store that counts how its streams are read
+type countingStreamStore struct {
+	api.StreamStore
+	gets     int32
+	getManys int32
+}
+
+func (c *countingStreamStore) Get(ctx context.Context, id string) (api.Stream, error) {
+	atomic.AddInt32(&c.gets, 1)
+	return c.StreamStore.Get(ctx, id)
+}
+
+func (c *countingStreamStore) GetMany(ctx context.Context, ids []string) ([]api.Stream, error) {
+	atomic.AddInt32(&c.getManys, 1)
+	return c.StreamStore.GetMany(ctx, ids)
+}
+
+//Watchlist store where another request always creates a list first
+type racingWatchlistStore struct {
+	api.WatchlistStore
+}
+
+func (r racingWatchlistStore) Create(ctx context.Context, list api.Watchlist) error {
+	other := list
+	other.Items = []string{}
+	r.WatchlistStore.Create(ctx, other)
+	return r.WatchlistStore.Create(ctx, list)
+}
+
+//Stream store standing in for a database that can't be reached
+type downStreamStore struct {
+	api.StreamStore
+}
+
+func (downStreamStore) Get(ctx context.Context, id string) (api.Stream, error) {
+	return api.Stream{}, errors.New("server selection timeout")
+}
 
 const goodCase = `{
   "id": "5938b99cb6906eb1fbaf1f1c",
@@ -303,3 +1381,54 @@ const goodCase = `{
     ]
   }
 }`
+func TestStreamController_GetStream_WaitersOutliveLeader(t *testing.T) {
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+
+	var calls int32
+	adServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte(`{"breaks": []}`))
+	}))
+	defer adServer.Close()
+	adsURL := os.Getenv("ADS_URL")
+	os.Setenv("ADS_URL", adServer.URL+"/")
+	defer os.Setenv("ADS_URL", adsURL)
+
+	streamController := api.NewStreamController(streams, tools)
+	chiRouter := chi.NewRouter()
+	chiRouter.Get("/v1/streams/{id}", streamController.GetStream)
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	//the first request starts the ads load and gives up before it is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		req, _ := http.NewRequest("GET", ts.URL+"/v1/streams/5938b99cb6906eb1fbaf1f1c", nil)
+		if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := http.Get(ts.URL + "/v1/streams/5938b99cb6906eb1fbaf1f1c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-leaderDone
+	if resp.StatusCode != 200 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s instead of 200 after the leading request gave up", resp.StatusCode, body))
+	}
+	if c := atomic.LoadInt32(&calls); c != 1 {
+		t.Fatalf("the ad server was called %d times instead of once", c)
+	}
+}
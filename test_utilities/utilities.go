@@ -1,11 +1,15 @@
 package test_utilities
 
 import (
+	"DiscoveryStreams/api"
+	"DiscoveryStreams/cache"
 	"DiscoveryStreams/config"
+	"DiscoveryStreams/mail"
+	"DiscoveryStreams/oidc"
+	"DiscoveryStreams/signing"
 	"context"
 	"encoding/json"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -14,13 +18,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
-var tools *config.Tools
-
+//Tools for tests, with an in-memory cache that starts out empty on every call
 func TestSetup() *config.Tools {
 	rawJSON := []byte(`{
 	  "level": "debug",
@@ -41,17 +46,208 @@ func TestSetup() *config.Tools {
 	logger, _ := cfg.Build()
 	defer logger.Sync() // flushes buffer, if any
 
-	cache := redis.NewClient(&redis.Options{
-		Addr:         os.Getenv("REDIS_ADDRESS"),
-		Password:     os.Getenv("REDIS_PASSWORD"),
-		ReadTimeout:  2 * time.Second,
-		WriteTimeout: 2 * time.Second,
-	})
-	tools = &config.Tools{Cache: cache, Logger: logger}
+	memory := cache.NewMemory()
+	keys := signing.NewHMAC([]byte(os.Getenv("TOKEN_SECRET")))
+	return &config.Tools{Cache: memory, Blacklist: cache.NewTokenBlacklist(memory), Keys: keys, Mailer: &Outbox{}, Logger: logger}
+}
+
+//Mailer that keeps every message it is given so tests can read them
+type Outbox struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (o *Outbox) Send(ctx context.Context, msg mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+//How many messages were sent to an address
+func (o *Outbox) Count(to string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	count := 0
+	for _, msg := range o.messages {
+		if msg.To == to {
+			count++
+		}
+	}
+	return count
+}
 
-	return tools
+//The last message sent to an address, or false if there wasn't one
+func (o *Outbox) Last(to string) (mail.Message, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := len(o.messages) - 1; i >= 0; i-- {
+		if o.messages[i].To == to {
+			return o.messages[i], true
+		}
+	}
+	return mail.Message{}, false
+}
+
+//In-memory stream store seeded with the streams mongo is seeded with in docker
+func TestStreamStore() (api.StreamStore, error) {
+	raw, err := ioutil.ReadFile("build/mongo/streams.json")
+	if err != nil {
+		return nil, err
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(raw, &docs); err != nil {
+		return nil, err
+	}
+
+	var streams []api.Stream
+	for _, doc := range docs {
+		var stream api.Stream
+		var id struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal(doc, &stream); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(doc, &id); err != nil {
+			return nil, err
+		}
+		stream.ID = id.ID
+		streams = append(streams, stream)
+	}
+	return api.NewMemoryStreamStore(streams...), nil
+}
+
+//In-memory user store seeded with the users mongo is seeded with in docker
+func TestUserStore() (api.UserStore, error) {
+	raw, err := ioutil.ReadFile("build/mongo/users.json")
+	if err != nil {
+		return nil, err
+	}
+	var users []api.User
+	if err := json.Unmarshal(raw, &users); err != nil {
+		return nil, err
+	}
+	return api.NewMemoryUserStore(users...), nil
 }
+
+//Ad server that answers every stream with the ads from the sample response
+func FakeAdServer() (*httptest.Server, error) {
+	raw, err := ioutil.ReadFile("sample-api-response-with-ads.json")
+	if err != nil {
+		return nil, err
+	}
+	var sample struct {
+		Ads json.RawMessage `json:"ads"`
+	}
+	if err := json.Unmarshal(raw, &sample); err != nil {
+		return nil, err
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(sample.Ads)
+	})), nil
+}
+//Identity provider for signing in with OIDC. It signs in everyone who is
+//sent to it as Claims, which tests can change between sign ins.
+type FakeIdentityProvider struct {
+	*httptest.Server
+	ClientID string
+	//Claims put in the id_tokens it issues, over the iss, aud, exp, iat and
+	//nonce it fills in itself
+	Claims jwt.MapClaims
+
+	mu    sync.Mutex
+	codes map[string]fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+//Identity provider serving discovery, its keys, and the authorization and
+//token endpoints, which insist on PKCE
+func FakeOIDCProvider(clientID string) (*FakeIdentityProvider, error) {
+	keys, err := signing.Load("signing/testdata/rsa.pem", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	p := &FakeIdentityProvider{ClientID: clientID, Claims: jwt.MapClaims{}, codes: map[string]fakeAuthorization{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		doc, _ := json.Marshal(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		doc, _ := json.Marshal(keys.JWKS())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != clientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		code := uuid.New().String()
+		p.mu.Lock()
+		p.codes[code] = fakeAuthorization{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), redirectURI: q.Get("redirect_uri")}
+		p.mu.Unlock()
+		back, _ := url.Parse(q.Get("redirect_uri"))
+		params := back.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		back.RawQuery = params.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostFormValue("code")]
+		delete(p.codes, r.PostFormValue("code"))
+		claims := jwt.MapClaims{
+			"iss":   p.URL,
+			"aud":   clientID,
+			"exp":   time.Now().Add(5 * time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": auth.nonce,
+		}
+		for k, v := range p.Claims {
+			claims[k] = v
+		}
+		p.mu.Unlock()
+		if !ok || r.PostFormValue("client_id") != clientID || r.PostFormValue("redirect_uri") != auth.redirectURI ||
+			oidc.CodeChallenge(r.PostFormValue("code_verifier")) != auth.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		idToken, err := keys.Sign(claims)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		doc, _ := json.Marshal(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+		w.Write(doc)
+	})
+	p.Server = httptest.NewServer(mux)
+	return p, nil
+}
+
 func GenerateFakeTestToken() string {
+	return GenerateFakeTestTokenWithRole("viewer")
+}
+
+//Token for a test user with role, signed like GenerateFakeTestToken
+func GenerateFakeTestTokenWithRole(role string) string {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"exp":       time.Now().Add(time.Hour * 1).Unix(),
 		"iat":       time.Now().Unix(),
@@ -60,16 +256,14 @@ func GenerateFakeTestToken() string {
 		"lastname":  "Test",
 		"wholename": "Mister" + " " + "Test",
 		"jti":       uuid.New().String(),
+		"role":      role,
 	})
 
 	tokenString, _ := token.SignedString([]byte(os.Getenv("TOKEN_SECRET")))
 
 	return tokenString
 }
-func FlushRedis() error {
-	_, err := tools.Cache.FlushDB().Result()
-	return err
-}
+//Connects to MONGO_URI for tests that need a real mongo
 func GetMongoDBClient() (*mongo.Client, error) {
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("MONGO_URI")))
@@ -0,0 +1,54 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+//RFC 6238 appendix B, SHA1, cut down to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := Code(secret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("%s was returned at %d instead of %s", got, unix, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	previous, _ := Code(secret, Step(now)-1)
+	if step, ok := Validate(secret, previous, now, 1); !ok || step != Step(now)-1 {
+		t.Fatalf("the previous code was refused")
+	}
+	old, _ := Code(secret, Step(now)-2)
+	if _, ok := Validate(secret, old, now, 1); ok {
+		t.Fatalf("a code from two steps ago was accepted")
+	}
+	if _, ok := Validate(secret, "12345", now, 1); ok {
+		t.Fatalf("a short code was accepted")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("Discovery Streams", "user@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Discovery%20Streams:user@example.com?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Fatalf("%s was returned", uri)
+	}
+}
@@ -2,24 +2,32 @@ package main
 
 import (
 	"DiscoveryStreams/api"
+	"DiscoveryStreams/signing"
 	"DiscoveryStreams/test_utilities"
+	"DiscoveryStreams/totp"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
-	"github.com/go-chi/jwtauth"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestUsersController_SignUp_Good(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
@@ -32,12 +40,12 @@ func TestUsersController_SignUp_Good(t *testing.T) {
 }
 
 func TestUsersController_SignUp_Bad(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
@@ -55,12 +63,12 @@ func TestUsersController_SignUp_Bad(t *testing.T) {
 }
 
 func TestUsersController_Login_ValidCredentials(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
@@ -79,12 +87,12 @@ func TestUsersController_Login_ValidCredentials(t *testing.T) {
 }
 
 func TestUsersController_Login_InvalidCredentials(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
@@ -103,21 +111,19 @@ func TestUsersController_Login_InvalidCredentials(t *testing.T) {
 }
 
 func TestUsersController_LogOut_Good(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
-
-	tokenAuth := jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
 	chiRouter.Post("/login", usersController.Login)
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, tokenAuth))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Delete("/logout", usersController.Logout)
 	})
 
@@ -138,21 +144,19 @@ func TestUsersController_LogOut_Good(t *testing.T) {
 	}
 }
 func TestUsersController_ReuseToken_After_Logout(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
-
-	tokenAuth := jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Post("/signup", usersController.Signup)
 	chiRouter.Post("/login", usersController.Login)
 
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, tokenAuth))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Delete("/logout", usersController.Logout)
 	})
 
@@ -178,18 +182,16 @@ func TestUsersController_ReuseToken_After_Logout(t *testing.T) {
 }
 
 func TestUsersController_LogOut_NoToken(t *testing.T) {
-	mongo, err := test_utilities.GetMongoDBClient()
+	users, err := test_utilities.TestUserStore()
 	if err != nil {
 		t.Fatal(err)
 	}
 	tools := test_utilities.TestSetup()
-	usersController := api.NewUsersController(mongo.Database(os.Getenv("MONGO_DB_NAME")), tools)
-
-	tokenAuth := jwtauth.New("HS256", []byte(os.Getenv("TOKEN_SECRET")), nil)
+	usersController := api.NewUsersController(users, tools)
 
 	chiRouter := chi.NewRouter()
 	chiRouter.Group(func(guarded chi.Router) {
-		guarded.Use(VerifyJWT(tools, tokenAuth))
+		guarded.Use(VerifyJWT(tools))
 		guarded.Delete("/logout", usersController.Logout)
 	})
 
@@ -200,3 +202,1203 @@ func TestUsersController_LogOut_NoToken(t *testing.T) {
 		t.Fatalf(fmt.Sprintf("%d was returned instead of 401", logoutResp.StatusCode))
 	}
 }
+
+func TestUsersController_Login_RehashesLegacyPassword(t *testing.T) {
+	//unsalted sha1 of "test12" as passwords used to be stored
+	users := api.NewMemoryUserStore(api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User",
+		Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4"})
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/login", usersController.Login)
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	wrongBody := []byte(`{"email":"legacy@example.com", "password":"test13"}`)
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(wrongBody), ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401", resp.StatusCode))
+	}
+
+	loginBody := []byte(`{"email":"legacy@example.com", "password":"test12"}`)
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(loginBody), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", resp.StatusCode))
+	}
+
+	user, err := users.FindByEmail(context.Background(), "legacy@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Fatalf("legacy hash was not replaced: %s", user.Password)
+	}
+
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(loginBody), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 after the rehash", resp.StatusCode))
+	}
+}
+
+func TestUsersController_RefreshToken_RotatesAndDetectsReuse(t *testing.T) {
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/token/refresh", usersController.RefreshToken)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Delete("/logout", usersController.Logout)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	signUpBody := []byte(`{"email":"refresh@example.com","firstname":"Refresh", "lastname":"User", "password":"test12"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+
+	var tokens struct {
+		AccessToken  string `json:"accessToken"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	login := func() {
+		loginBody := []byte(`{"email":"refresh@example.com", "password":"test12"}`)
+		resp, body := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(loginBody), "")
+		if err := json.Unmarshal([]byte(body), &tokens); err != nil || resp.StatusCode != http.StatusOK || tokens.RefreshToken == "" {
+			t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+		}
+	}
+	refresh := func(token string) (*http.Response, string) {
+		return test_utilities.TestRequest(t, ts, "POST", "/token/refresh", strings.NewReader(`{"refreshToken":"`+token+`"}`), "")
+	}
+
+	login()
+	first := tokens.RefreshToken
+	resp, body := refresh(first)
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil || resp.StatusCode != http.StatusOK ||
+		tokens.RefreshToken == first || resp.Header.Get("Authorization") != "Bearer "+tokens.AccessToken {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	second := tokens.RefreshToken
+
+	//using a rotated token again revokes every token in its family
+	if resp, _ := refresh(first); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a reused token", resp.StatusCode))
+	}
+	if resp, _ := refresh(second); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 after the family was revoked", resp.StatusCode))
+	}
+
+	//logging out revokes the refresh token issued with the access token
+	login()
+	if resp, body := test_utilities.TestRequest(t, ts, "DELETE", "/logout", nil, tokens.AccessToken); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+	if resp, _ := refresh(tokens.RefreshToken); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 after logout", resp.StatusCode))
+	}
+
+	if resp, _ := refresh("not-a-token"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401", resp.StatusCode))
+	}
+}
+
+func TestUsersController_AsymmetricKeys_PublishesJWKS(t *testing.T) {
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	tools.Keys, err = signing.Load("signing/testdata/ec.pem", []string{"signing/testdata/rsa.pub.pem"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Get("/.well-known/jwks.json", usersController.GetJWKS)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Delete("/logout", usersController.Logout)
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	signUpBody := []byte(`{"email":"jwks@example.com","firstname":"Jwks", "lastname":"User", "password":"test12"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+
+	loginBody := []byte(`{"email":"jwks@example.com", "password":"test12"}`)
+	resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(loginBody), "")
+	access := strings.TrimPrefix(resp.Header.Get("Authorization"), "Bearer ")
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, _ := jwt.DecodeSegment(strings.Split(access, ".")[0])
+	if err := json.Unmarshal(raw, &header); err != nil || header.Alg != "ES256" || header.Kid == "" {
+		t.Fatalf("access token has the header %s", raw)
+	}
+
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/.well-known/jwks.json", nil, "")
+	var jwks signing.JWKS
+	if err := json.Unmarshal([]byte(body), &jwks); err != nil || resp.StatusCode != http.StatusOK || len(jwks.Keys) != 2 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	if jwks.Keys[0].Kid != header.Kid || jwks.Keys[0].Crv != "P-256" || jwks.Keys[1].Kty != "RSA" {
+		t.Fatalf(body)
+	}
+
+	if resp, body := test_utilities.TestRequest(t, ts, "DELETE", "/logout", nil, access); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 with %s", resp.StatusCode, body))
+	}
+
+	//HS256 tokens aren't accepted once keys are configured without TOKEN_SECRET
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/logout", nil, test_utilities.GenerateFakeTestToken()); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401", resp.StatusCode))
+	}
+}
+
+func TestUsersController_RoleBasedAccess(t *testing.T) {
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streams, err := test_utilities.TestStreamStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+	streamController := api.NewStreamController(streams, tools)
+
+	if created, err := usersController.BootstrapAdmin(context.Background(), "admin@example.com", "admin123"); err != nil || !created {
+		t.Fatalf("admin wasn't bootstrapped: %v", err)
+	}
+	if created, err := usersController.BootstrapAdmin(context.Background(), "admin@example.com", "admin123"); err != nil || created {
+		t.Fatalf("bootstrapping an existing admin created it again: %v", err)
+	}
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Route("/v1", func(v1 chi.Router) {
+			v1.Route("/streams", func(s chi.Router) {
+				s.Use(api.RequirePermission(api.PermStreamsRead))
+				s.Get("/", streamController.ListStreamIds)
+				s.With(api.RequirePermission(api.PermStreamsWrite)).Post("/", streamController.CreateStream)
+			})
+			v1.With(api.RequirePermission(api.PermUsersManage)).Put("/users/{email}/role", usersController.UpdateRole)
+		})
+	})
+
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(email string) string {
+		loginBody := []byte(`{"email":"` + email + `", "password":"admin123"}`)
+		resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", bytes.NewReader(loginBody), "")
+		return strings.TrimPrefix(resp.Header.Get("Authorization"), "Bearer ")
+	}
+	createStream := func(token string, id string) int {
+		body := []byte(`{"id":"` + id + `","streamUrl":"https://example.com/master.m3u8"}`)
+		resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/streams", bytes.NewReader(body), token)
+		return resp.StatusCode
+	}
+	setRole := func(token string, email string, role string) int {
+		resp, _ := test_utilities.TestRequest(t, ts, "PUT", "/v1/users/"+email+"/role", strings.NewReader(`{"role":"`+role+`"}`), token)
+		return resp.StatusCode
+	}
+
+	//new users are viewers
+	signUpBody := []byte(`{"email":"editor@example.com","firstname":"Editor", "lastname":"User", "password":"admin123", "role":"admin"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+	viewer := login("editor@example.com")
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams", nil, viewer); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for a viewer reading", resp.StatusCode))
+	}
+	if status := createStream(viewer, "rbac-viewer"); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for a viewer writing", status))
+	}
+	if status := setRole(viewer, "editor@example.com", "admin"); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for a viewer changing roles", status))
+	}
+
+	admin := login("admin@example.com")
+	if status := setRole(admin, "editor@example.com", "editor"); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", status))
+	}
+	if status := setRole(admin, "editor@example.com", "owner"); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for an unknown role", status))
+	}
+	if status := setRole(admin, "missing@example.com", "editor"); status != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", status))
+	}
+	for _, self := range []string{"admin@example.com", "Admin@Example.com"} {
+		if status := setRole(admin, self, "viewer"); status != http.StatusBadRequest {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for an admin demoting themselves as %s", status, self))
+		}
+	}
+
+	//tokens with the old role are revoked and the new role is in tokens
+	//issued after the change
+	if resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/streams", nil, viewer); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a token with the old role", resp.StatusCode))
+	}
+	if status := createStream(login("editor@example.com"), "rbac-editor"); status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 for an editor writing", status))
+	}
+}
+
+func TestUsersController_EmailVerificationAndPasswordReset(t *testing.T) {
+	defer os.Setenv("REQUIRE_EMAIL_VERIFICATION", os.Getenv("REQUIRE_EMAIL_VERIFICATION"))
+	os.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+
+	//sha1 of test12, stored before email verification existed
+	users := api.NewMemoryUserStore(api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4"})
+	tools := test_utilities.TestSetup()
+	outbox := tools.Mailer.(*test_utilities.Outbox)
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/verify-email", usersController.VerifyEmail)
+	chiRouter.Post("/password/forgot", usersController.ForgotPassword)
+	chiRouter.Post("/password/reset", usersController.ResetPassword)
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	tokenIn := regexp.MustCompile(`[A-Za-z0-9_-]{20,}\.[A-Za-z0-9_-]{20,}`)
+	lastToken := func(email string) string {
+		msg, ok := outbox.Last(email)
+		if !ok {
+			t.Fatalf("no email was sent to %s", email)
+		}
+		return tokenIn.FindString(msg.Body)
+	}
+	post := func(path string, body string) int {
+		resp, _ := test_utilities.TestRequest(t, ts, "POST", path, strings.NewReader(body), "")
+		return resp.StatusCode
+	}
+	login := func(password string) int {
+		return post("/login", `{"email":"verify@example.com", "password":"`+password+`"}`)
+	}
+	//reset emails are sent after answering, so this waits for one to arrive
+	forgot := func(email string) bool {
+		sent := outbox.Count(email)
+		if status := post("/password/forgot", `{"email":"`+email+`"}`); status != http.StatusAccepted {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 202", status))
+		}
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if outbox.Count(email) > sent {
+				return true
+			}
+		}
+		return false
+	}
+
+	//new accounts can't log in until they verify their email
+	if status := post("/signup", `{"email":"verify@example.com","firstname":"Verify", "lastname":"User", "password":"test12"}`); status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201", status))
+	}
+	if status := login("test12"); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for an unverified account", status))
+	}
+	verify := lastToken("verify@example.com")
+	if status := post("/password/reset", `{"token":"`+verify+`", "password":"other12"}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a verification token used to reset", status))
+	}
+	if status := post("/verify-email", `{"token":"`+verify+`"}`); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", status))
+	}
+	if status := post("/verify-email", `{"token":"`+verify+`"}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a used token", status))
+	}
+	if status := login("test12"); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for a verified account", status))
+	}
+
+	//accounts from before verification existed can still log in
+	if status := post("/login", `{"email":"legacy@example.com", "password":"test12"}`); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for an existing account", status))
+	}
+
+	//unknown emails are answered the same as known ones
+	if forgot("nobody@example.com") {
+		t.Fatal("a reset email was sent to an unknown address")
+	}
+
+	forgot("verify@example.com")
+	first := lastToken("verify@example.com")
+	forgot("verify@example.com")
+	second := lastToken("verify@example.com")
+	tampered := second + "A"
+	if status := post("/password/reset", `{"token":"`+tampered+`", "password":"changed12"}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a tampered token", status))
+	}
+	if status := post("/password/reset", `{"token":"`+second+`", "password":"changed12"}`); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", status))
+	}
+	if status := post("/password/reset", `{"token":"`+first+`", "password":"again12"}`); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a token issued before the password changed", status))
+	}
+	if status := login("test12"); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for the old password", status))
+	}
+	if status := login("changed12"); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for the new password", status))
+	}
+}
+
+func TestUsersController_LoginLockout(t *testing.T) {
+	for key, value := range map[string]string{"LOGIN_MAX_FAILURES": "3", "LOGIN_MAX_IP_FAILURES": "100", "LOGIN_LOCKOUT": "1s"} {
+		defer os.Setenv(key, os.Getenv(key))
+		os.Setenv(key, value)
+	}
+
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Use(api.RequirePermission(api.PermUsersManage))
+		guarded.Delete("/v1/users/{email}/lockout", usersController.UnlockUser)
+		guarded.Delete("/v1/lockouts/ips/{ip}", usersController.UnlockIP)
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(email string, password string) *http.Response {
+		body := `{"email":"` + email + `", "password":"` + password + `"}`
+		resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(body), "")
+		return resp
+	}
+	failUntilLocked := func(email string, failures int) *http.Response {
+		for i := 0; i < failures; i++ {
+			if resp := login(email, "wrong12"); resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for failure %d", resp.StatusCode, i+1))
+			}
+		}
+		return login(email, "test12")
+	}
+	admin := test_utilities.GenerateFakeTestTokenWithRole(api.RoleAdmin)
+
+	signUpBody := []byte(`{"email":"lock@example.com","firstname":"Lock", "lastname":"User", "password":"test12"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+
+	//even the right password is refused while the account is locked
+	resp := failUntilLocked("LOCK@example.com", 3)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("%d with Retry-After %q was returned instead of 429 with 1", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	//the next lockout lasts twice as long
+	time.Sleep(1100 * time.Millisecond)
+	resp = failUntilLocked("lock@example.com", 3)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("%d with Retry-After %q was returned instead of 429 with 2", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	//only admins can unlock accounts
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/users/lock@example.com/lockout", nil, test_utilities.GenerateFakeTestToken()); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403", resp.StatusCode))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/users/lock@example.com/lockout", nil, admin); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204", resp.StatusCode))
+	}
+	if resp := login("lock@example.com", "test12"); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 after unlocking", resp.StatusCode))
+	}
+
+	//failures against any email count towards the IP's limit
+	os.Setenv("LOGIN_MAX_IP_FAILURES", "2")
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/lockouts/ips/127.0.0.1", nil, admin); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204", resp.StatusCode))
+	}
+	login("nobody@example.com", "wrong12")
+	login("someone@example.com", "wrong12")
+	if resp := login("lock@example.com", "test12"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 429 for a locked IP", resp.StatusCode))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/lockouts/ips/not-an-ip", nil, admin); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400", resp.StatusCode))
+	}
+	_, _ = test_utilities.TestRequest(t, ts, "DELETE", "/v1/lockouts/ips/127.0.0.1", nil, admin)
+	if resp := login("lock@example.com", "test12"); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 after unlocking the IP", resp.StatusCode))
+	}
+}
+
+func TestUsersController_Profile(t *testing.T) {
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	outbox := tools.Mailer.(*test_utilities.Outbox)
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/token/refresh", usersController.RefreshToken)
+	chiRouter.Post("/verify-email", usersController.VerifyEmail)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/me", usersController.GetMe)
+		guarded.Patch("/v1/me", usersController.UpdateMe)
+		guarded.Post("/v1/me/password", usersController.ChangePassword)
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(email string, password string) (access string, refresh string) {
+		body := `{"email":"` + email + `", "password":"` + password + `"}`
+		resp, respBody := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(body), "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 logging in as %s", resp.StatusCode, email))
+		}
+		var tokens struct {
+			AccessToken  string `json:"accessToken"`
+			RefreshToken string `json:"refreshToken"`
+		}
+		json.Unmarshal([]byte(respBody), &tokens)
+		return tokens.AccessToken, tokens.RefreshToken
+	}
+	me := func(token string) (int, map[string]interface{}) {
+		resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, token)
+		var profile map[string]interface{}
+		json.Unmarshal([]byte(body), &profile)
+		if strings.Contains(body, "password") || strings.Contains(body, "$argon2") {
+			t.Fatalf("the profile has the password in it: %s", body)
+		}
+		return resp.StatusCode, profile
+	}
+
+	signUpBody := []byte(`{"email":"me@example.com","firstname":"Old", "lastname":"Name", "password":"test12"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+	token, _ := login("me@example.com", "test12")
+	if status, profile := me(token); status != http.StatusOK || profile["firstname"] != "Old" || profile["verified"] != false {
+		t.Fatalf("%d was returned with %v", status, profile)
+	}
+
+	//profile changes follow the signup rules
+	if resp, _ := test_utilities.TestRequest(t, ts, "PATCH", "/v1/me", strings.NewReader(`{"firstname":""}`), token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for an empty name", resp.StatusCode))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "PATCH", "/v1/me", strings.NewReader(`{"email":"not an email"}`), token); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a bad email", resp.StatusCode))
+	}
+	resp, body := test_utilities.TestRequest(t, ts, "PATCH", "/v1/me", strings.NewReader(`{"firstname":"New","email":"new@example.com","password":"ignored"}`), token)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"pendingEmail":"new@example.com"`) || !strings.Contains(body, `"email":"me@example.com"`) {
+		t.Fatalf("%d was returned with %s", resp.StatusCode, body)
+	}
+
+	//the new email only takes over once it is verified, which signs out the old one
+	msg, ok := outbox.Last("new@example.com")
+	if !ok {
+		t.Fatal("no email was sent to the new address")
+	}
+	verify := regexp.MustCompile(`[A-Za-z0-9_-]{20,}\.[A-Za-z0-9_-]{20,}`).FindString(msg.Body)
+	login("me@example.com", "test12")
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/verify-email", strings.NewReader(`{"token":"`+verify+`"}`), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", resp.StatusCode))
+	}
+	if status, _ := me(token); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a token of the old email", status))
+	}
+	token, _ = login("new@example.com", "test12")
+	if status, profile := me(token); status != http.StatusOK || profile["firstname"] != "New" || profile["verified"] != true {
+		t.Fatalf("%d was returned with %v", status, profile)
+	}
+
+	//changing the password signs out every other session
+	other, otherRefresh := login("new@example.com", "test12")
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/v1/me/password", strings.NewReader(`{"currentPassword":"wrong12","newPassword":"changed12"}`), token); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for the wrong current password", resp.StatusCode))
+	}
+	resp, body = test_utilities.TestRequest(t, ts, "POST", "/v1/me/password", strings.NewReader(`{"currentPassword":"test12","newPassword":"changed12"}`), token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", resp.StatusCode))
+	}
+	if status, _ := me(other); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for another session", status))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/token/refresh", strings.NewReader(`{"refreshToken":"`+otherRefresh+`"}`), ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for another session's refresh token", resp.StatusCode))
+	}
+	if status, _ := me(strings.TrimPrefix(resp.Header.Get("Authorization"), "Bearer ")); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for the new token", status))
+	}
+	login("new@example.com", "changed12")
+}
+
+func TestUsersController_Sessions(t *testing.T) {
+	users, err := test_utilities.TestUserStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/token/refresh", usersController.RefreshToken)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Delete("/logout", usersController.Logout)
+		guarded.Get("/v1/me/sessions", usersController.ListSessions)
+		guarded.Delete("/v1/me/sessions", usersController.RevokeAllSessions)
+		guarded.Delete("/v1/me/sessions/{id}", usersController.RevokeSession)
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(device string) (access string, refresh string) {
+		req, _ := http.NewRequest("POST", ts.URL+"/login", strings.NewReader(`{"email":"sessions@example.com", "password":"test12"}`))
+		req.Header.Set("User-Agent", device)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var tokens struct {
+			AccessToken  string `json:"accessToken"`
+			RefreshToken string `json:"refreshToken"`
+		}
+		json.NewDecoder(resp.Body).Decode(&tokens)
+		return tokens.AccessToken, tokens.RefreshToken
+	}
+	type session struct {
+		ID        string `json:"id"`
+		UserAgent string `json:"userAgent"`
+		IP        string `json:"ip"`
+		Current   bool   `json:"current"`
+	}
+	list := func(token string) []session {
+		resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me/sessions", nil, token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200", resp.StatusCode))
+		}
+		var sessions []session
+		json.Unmarshal([]byte(body), &sessions)
+		return sessions
+	}
+	works := func(token string) bool {
+		resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/me/sessions", nil, token)
+		return resp.StatusCode == http.StatusOK
+	}
+
+	signUpBody := []byte(`{"email":"sessions@example.com","firstname":"Session", "lastname":"User", "password":"test12"}`)
+	_, _ = test_utilities.TestRequest(t, ts, "POST", "/signup", bytes.NewReader(signUpBody), "")
+	phone, phoneRefresh := login("phone")
+	laptop, _ := login("laptop")
+
+	sessions := list(laptop)
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions were listed instead of 2", len(sessions))
+	}
+	var phoneID string
+	for _, s := range sessions {
+		if s.IP != "127.0.0.1" || s.Current != (s.UserAgent == "laptop") {
+			t.Fatalf("session was listed as %+v", s)
+		}
+		if s.UserAgent == "phone" {
+			phoneID = s.ID
+		}
+	}
+
+	//signing out another session revokes its access and refresh tokens
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/sessions/"+phoneID, nil, laptop); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204", resp.StatusCode))
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/sessions/"+phoneID, nil, laptop); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404", resp.StatusCode))
+	}
+	if works(phone) {
+		t.Fatal("the signed out session's token still works")
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/token/refresh", strings.NewReader(`{"refreshToken":"`+phoneRefresh+`"}`), ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for the signed out session's refresh token", resp.StatusCode))
+	}
+
+	//logging out ends the session too
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/logout", nil, laptop); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", resp.StatusCode))
+	}
+	if works(laptop) {
+		t.Fatal("the logged out token still works")
+	}
+
+	//and everything can be signed out at once
+	first, _ := login("phone")
+	second, _ := login("laptop")
+	if len(list(second)) != 2 {
+		t.Fatal("logged out sessions are still listed")
+	}
+	if resp, _ := test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/sessions", nil, second); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204", resp.StatusCode))
+	}
+	if works(first) || works(second) {
+		t.Fatal("a token still works after signing out everywhere")
+	}
+	third, _ := login("tablet")
+	if sessions := list(third); len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("%+v were listed instead of the new session", sessions)
+	}
+}
+
+func TestUsersController_OIDCLogin(t *testing.T) {
+	idp, err := test_utilities.FakeOIDCProvider("discovery-streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	users := api.NewMemoryUserStore(
+		api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4"},
+		api.User{Email: "editor@example.com", FirstName: "Editor", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleEditor},
+		api.User{Email: "viewer@example.com", FirstName: "Viewer", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleViewer})
+	tools := test_utilities.TestSetup()
+
+	//the redirect url has to be known before the controller is made. The
+	//strict provider is the same one, without being trusted to link accounts.
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+	for k, v := range map[string]string{
+		"OIDC_PROVIDERS":            "mock,strict",
+		"OIDC_MOCK_ISSUER":          idp.URL,
+		"OIDC_MOCK_CLIENT_ID":       "discovery-streams",
+		"OIDC_MOCK_CLIENT_SECRET":   "",
+		"OIDC_MOCK_REDIRECT_URL":    ts.URL + "/oidc/mock/callback",
+		"OIDC_MOCK_AUTO_LINK":       "true",
+		"OIDC_STRICT_ISSUER":        idp.URL,
+		"OIDC_STRICT_CLIENT_ID":     "discovery-streams",
+		"OIDC_STRICT_CLIENT_SECRET": "",
+		"OIDC_STRICT_REDIRECT_URL":  ts.URL + "/oidc/strict/callback",
+	} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/signup", usersController.Signup)
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Get("/oidc/{provider}/login", usersController.OIDCLogin)
+	chiRouter.Get("/oidc/{provider}/callback", usersController.OIDCCallback)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/me", usersController.GetMe)
+	})
+	ts.Config.Handler = chiRouter
+
+	//the client follows the redirects to the provider and back
+	signInWith := func(provider string, claims jwt.MapClaims) (int, string) {
+		idp.Claims = claims
+		resp, body := test_utilities.TestRequest(t, ts, "GET", "/oidc/"+provider+"/login", nil, "")
+		var tokens struct {
+			AccessToken string `json:"accessToken"`
+		}
+		json.Unmarshal([]byte(body), &tokens)
+		return resp.StatusCode, tokens.AccessToken
+	}
+	signIn := func(claims jwt.MapClaims) (int, string) {
+		return signInWith("mock", claims)
+	}
+	me := func(token string) string {
+		resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, token)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for /v1/me", resp.StatusCode))
+		}
+		return body
+	}
+
+	//a new identity with a verified email gets an account
+	status, token := signIn(jwt.MapClaims{"sub": "ada", "email": "ada@example.com", "email_verified": true, "given_name": "Ada", "family_name": "Lovelace"})
+	if status != http.StatusOK || token == "" {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200", status))
+	}
+	if body := me(token); !strings.Contains(body, `"email":"ada@example.com"`) || !strings.Contains(body, `"firstname":"Ada"`) || !strings.Contains(body, `"role":"viewer"`) {
+		t.Fatalf("%s was returned for the new account", body)
+	}
+
+	//the identity stays linked to the account even if its email changes
+	status, token = signIn(jwt.MapClaims{"sub": "ada", "email": "countess@example.com", "email_verified": true})
+	if status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for a linked identity", status))
+	}
+	if body := me(token); !strings.Contains(body, `"email":"ada@example.com"`) {
+		t.Fatalf("%s was returned for the linked account", body)
+	}
+
+	//accounts made this way have no password to log in with
+	resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"ada@example.com", "password":""}`), "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a password login", resp.StatusCode))
+	}
+
+	//a verified email only links the identity to the existing account when
+	//the provider is trusted to, and only for viewers
+	if status, _ = signInWith("strict", jwt.MapClaims{"sub": "viewer", "email": "viewer@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 linking with a provider that isn't trusted to", status))
+	}
+	if status, _ = signIn(jwt.MapClaims{"sub": "editor", "email": "editor@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 linking an editor", status))
+	}
+
+	//someone who signed up with an email they don't own can't have its owner's
+	//identity linked to their account
+	signUp := `{"email":"victim@example.com","firstname":"Not","lastname":"Victim","password":"attacker1"}`
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/signup", strings.NewReader(signUp), ""); resp.StatusCode != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 signing up", resp.StatusCode))
+	}
+	if status, _ = signIn(jwt.MapClaims{"sub": "victim", "email": "victim@example.com", "email_verified": true}); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 linking an unverified account", status))
+	}
+	status, token = signIn(jwt.MapClaims{"sub": "legacy", "email": "legacy@example.com", "email_verified": "true"})
+	if status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for an existing account", status))
+	}
+	if body := me(token); !strings.Contains(body, `"firstname":"Legacy"`) {
+		t.Fatalf("%s was returned for the existing account", body)
+	}
+
+	//an unverified email could belong to anyone
+	if status, _ = signIn(jwt.MapClaims{"sub": "mallory", "email": "legacy@example.com", "email_verified": false}); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for an unverified email", status))
+	}
+
+	//tokens for another client or from another issuer are refused
+	for _, claims := range []jwt.MapClaims{
+		{"sub": "ada", "aud": "someone-else"},
+		{"sub": "ada", "iss": "https://evil.example.com"},
+		{"sub": "ada", "exp": time.Now().Add(-time.Hour).Unix()},
+		{"sub": "ada", "nonce": "replayed"},
+	} {
+		if status, _ = signIn(claims); status != http.StatusUnauthorized {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for %v", status, claims))
+		}
+	}
+
+	//states can't be made up or used twice
+	resp, _ = test_utilities.TestRequest(t, ts, "GET", "/oidc/mock/callback?code=abc&state=made-up", nil, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for an unknown state", resp.StatusCode))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "GET", "/oidc/mock/callback?error=access_denied", nil, "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a refused sign in", resp.StatusCode))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "GET", "/oidc/nobody/login", nil, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 for an unknown provider", resp.StatusCode))
+	}
+}
+
+func TestUsersController_MFA(t *testing.T) {
+	users := api.NewMemoryUserStore(api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User",
+		Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleEditor})
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+	defer os.Setenv("MFA_REQUIRED_ROLES", os.Getenv("MFA_REQUIRED_ROLES"))
+	os.Setenv("MFA_REQUIRED_ROLES", "editor,admin")
+
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/login/mfa", usersController.LoginMFA)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(VerifyJWT(tools))
+		guarded.Get("/v1/me", usersController.GetMe)
+		guarded.Post("/v1/me/mfa/totp", usersController.StartTOTP)
+		guarded.Post("/v1/me/mfa/totp/confirm", usersController.ConfirmTOTP)
+		guarded.Delete("/v1/me/mfa/totp", usersController.DisableTOTP)
+		guarded.With(api.RequirePermission(api.PermStreamsWrite)).Get("/v1/editors", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	type loginResponse struct {
+		AccessToken string `json:"accessToken"`
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+	}
+	post := func(path string, body string, token string) (int, loginResponse) {
+		resp, respBody := test_utilities.TestRequest(t, ts, "POST", path, strings.NewReader(body), token)
+		var res loginResponse
+		json.Unmarshal([]byte(respBody), &res)
+		return resp.StatusCode, res
+	}
+	login := func() loginResponse {
+		status, res := post("/login", `{"email":"legacy@example.com", "password":"test12"}`, "")
+		if status != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 logging in", status))
+		}
+		return res
+	}
+	editor := func(token string) int {
+		resp, _ := test_utilities.TestRequest(t, ts, "GET", "/v1/editors", nil, token)
+		return resp.StatusCode
+	}
+
+	//editors have to set up two-factor authentication before they can edit
+	password := login()
+	if password.AccessToken == "" || password.MFARequired {
+		t.Fatalf("login without two-factor authentication returned %+v", password)
+	}
+	if status := editor(password.AccessToken); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for an editor without mfa", status))
+	}
+
+	resp, body := test_utilities.TestRequest(t, ts, "POST", "/v1/me/mfa/totp", nil, password.AccessToken)
+	var enrolment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	json.Unmarshal([]byte(body), &enrolment)
+	if resp.StatusCode != http.StatusOK || enrolment.Secret == "" || !strings.HasPrefix(enrolment.URI, "otpauth://totp/") {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	code := func(steps int64) string {
+		c, err := totp.Code(enrolment.Secret, totp.Step(time.Now())+steps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if status, _ := post("/v1/me/mfa/totp/confirm", `{"code":"`+code(5)+`"}`, password.AccessToken); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a wrong code", status))
+	}
+	resp, body = test_utilities.TestRequest(t, ts, "POST", "/v1/me/mfa/totp/confirm", strings.NewReader(`{"code":"`+code(0)+`"}`), password.AccessToken)
+	var recovery struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	json.Unmarshal([]byte(body), &recovery)
+	if resp.StatusCode != http.StatusOK || len(recovery.RecoveryCodes) != 10 {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	if _, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, password.AccessToken); !strings.Contains(body, `"mfa":true`) {
+		t.Fatalf("%s was returned for /v1/me", body)
+	}
+
+	//logins now need a second step
+	challenge := login()
+	if challenge.AccessToken != "" || !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("login with two-factor authentication returned %+v", challenge)
+	}
+	if status, _ := post("/login/mfa", `{"mfaToken":"`+challenge.MFAToken+`", "code":"`+code(0)+`"}`, ""); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a code that was already used", status))
+	}
+	status, tokens := post("/login/mfa", `{"mfaToken":"`+challenge.MFAToken+`", "code":"`+code(-1)+`"}`, "")
+	if status != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for the second step", status))
+	}
+	if status := editor(tokens.AccessToken); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for an editor with mfa", status))
+	}
+	if status, _ := post("/login/mfa", `{"mfaToken":"`+challenge.MFAToken+`", "code":"`+code(1)+`"}`, ""); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a challenge that was already finished", status))
+	}
+
+	//recovery codes work once
+	recoveryLogin := `", "code":"` + strings.ToUpper(recovery.RecoveryCodes[0]) + `"}`
+	if status, _ := post("/login/mfa", `{"mfaToken":"`+login().MFAToken+recoveryLogin, ""); status != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 for a recovery code", status))
+	}
+	if status, _ := post("/login/mfa", `{"mfaToken":"`+login().MFAToken+recoveryLogin, ""); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a used recovery code", status))
+	}
+
+	if status, _ := post("/login/mfa", `{"mfaToken":"x", "code":"`+code(1)+`"}`, ""); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a made up challenge", status))
+	}
+
+	//it can only be turned off when the role doesn't require it
+	resp, _ = test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/mfa/totp", strings.NewReader(`{"code":"`+recovery.RecoveryCodes[1]+`"}`), tokens.AccessToken)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 turning off required mfa", resp.StatusCode))
+	}
+	os.Setenv("MFA_REQUIRED_ROLES", "admin")
+	resp, _ = test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/mfa/totp", strings.NewReader(`{"code":"`+recovery.RecoveryCodes[2]+`"}`), tokens.AccessToken)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204 turning off mfa", resp.StatusCode))
+	}
+	if password := login(); password.AccessToken == "" {
+		t.Fatalf("login after turning off two-factor authentication returned %+v", password)
+	}
+}
+
+func TestAPIKeysController(t *testing.T) {
+	users := api.NewMemoryUserStore(
+		api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleEditor},
+		api.User{Email: "admin@example.com", FirstName: "Admin", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleAdmin})
+	tools := test_utilities.TestSetup()
+	outbox := tools.Mailer.(*test_utilities.Outbox)
+	usersController := api.NewUsersController(users, tools)
+	keysController := api.NewAPIKeysController(api.NewMemoryAPIKeyStore(), users, tools)
+	usersController.OnEmailChange(keysController.ChangeOwner)
+
+	whoami := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(api.PrincipalFromContext(r.Context()).Email))
+	}
+	chiRouter := chi.NewRouter()
+	chiRouter.Post("/login", usersController.Login)
+	chiRouter.Post("/verify-email", usersController.VerifyEmail)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(Authenticate(tools, keysController))
+		guarded.With(api.RequirePermission(api.PermStreamsRead)).Get("/read", whoami)
+		guarded.With(api.RequirePermission(api.PermStreamsWrite)).Get("/write", whoami)
+		guarded.Route("/v1/me", func(me chi.Router) {
+			me.Use(api.RequireToken)
+			me.Get("/", usersController.GetMe)
+			me.Patch("/", usersController.UpdateMe)
+			me.Get("/keys", keysController.ListAPIKeys)
+			me.Post("/keys", keysController.CreateAPIKey)
+			me.Post("/keys/{id}/rotate", keysController.RotateAPIKey)
+			me.Delete("/keys/{id}", keysController.RevokeAPIKey)
+		})
+		guarded.With(api.RequirePermission(api.PermUsersManage)).Post("/v1/service-accounts", keysController.CreateServiceAccount)
+		guarded.With(api.RequirePermission(api.PermUsersManage)).Post("/v1/users/{email}/keys", keysController.CreateAPIKey)
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(email string) string {
+		resp, body := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"`+email+`", "password":"test12"}`), "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 logging in as %s", resp.StatusCode, email))
+		}
+		var tokens struct {
+			AccessToken string `json:"accessToken"`
+		}
+		json.Unmarshal([]byte(body), &tokens)
+		return tokens.AccessToken
+	}
+	type newKey struct {
+		ID     string   `json:"id"`
+		Scopes []string `json:"scopes"`
+		Key    string   `json:"key"`
+	}
+	create := func(path string, body string, token string) (int, newKey) {
+		resp, respBody := test_utilities.TestRequest(t, ts, "POST", path, strings.NewReader(body), token)
+		var key newKey
+		json.Unmarshal([]byte(respBody), &key)
+		return resp.StatusCode, key
+	}
+	withKey := func(method string, path string, key string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	editor := login("legacy@example.com")
+
+	//keys can only have scopes the owner's role has
+	if status, _ := create("/v1/me/keys", `{"name":"admin job", "scopes":["users:manage"]}`, editor); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a scope the role doesn't have", status))
+	}
+	if status, _ := create("/v1/me/keys", `{"name":"old job", "scopes":["streams:read"], "expiresAt":"2001-01-01T00:00:00Z"}`, editor); status != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for a key that has expired", status))
+	}
+	status, key := create("/v1/me/keys", `{"name":"reporting job", "scopes":["streams:read"]}`, editor)
+	if status != http.StatusCreated || !strings.HasPrefix(key.Key, "dsk_") {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v", status, key))
+	}
+
+	//a key acts for its owner with only its scopes
+	if status, body := withKey("GET", "/read", key.Key); status != http.StatusOK || body != "legacy@example.com" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s for a scope the key has", status, body))
+	}
+	if status, _ := withKey("GET", "/write", key.Key); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 for a scope the key doesn't have", status))
+	}
+	if status, _ := withKey("GET", "/v1/me/", key.Key); status != http.StatusForbidden {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 403 managing the account with a key", status))
+	}
+	if status, _ := withKey("GET", "/read", key.Key+"x"); status != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a wrong key", status))
+	}
+	resp, body := test_utilities.TestRequest(t, ts, "GET", "/v1/me/keys", nil, editor)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, key.ID) || strings.Contains(body, "dsk_") || strings.Contains(body, "hash") {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+
+	//the old secret keeps working for a while after rotating
+	status, rotated := create("/v1/me/keys/"+key.ID+"/rotate", "", editor)
+	if status != http.StatusOK || rotated.ID != key.ID || rotated.Key == key.Key {
+		t.Fatalf(fmt.Sprintf("%d was returned with %+v", status, rotated))
+	}
+	for _, k := range []string{key.Key, rotated.Key} {
+		if status, _ := withKey("GET", "/read", k); status != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 after rotating", status))
+		}
+	}
+
+	//admins make service accounts and their keys
+	admin := login("admin@example.com")
+	resp, body = test_utilities.TestRequest(t, ts, "POST", "/v1/service-accounts", strings.NewReader(`{"name":"nightly-import", "role":"editor"}`), admin)
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(body, "nightly-import@service-accounts.local") {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s", resp.StatusCode, body))
+	}
+	status, service := create("/v1/users/nightly-import@service-accounts.local/keys", `{"name":"import", "scopes":["streams:read","streams:write"]}`, admin)
+	if status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 for a service account key", status))
+	}
+	if status, body := withKey("GET", "/write", service.Key); status != http.StatusOK || body != "nightly-import@service-accounts.local" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s for a service account key", status, body))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"nightly-import@service-accounts.local", "password":""}`), "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 401 logging in as a service account", resp.StatusCode))
+	}
+
+	//users can only revoke their own keys, and revoked keys stop working at once
+	resp, _ = test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/keys/"+service.ID, nil, editor)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 404 revoking another user's key", resp.StatusCode))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "DELETE", "/v1/me/keys/"+key.ID, nil, editor)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 204 revoking a key", resp.StatusCode))
+	}
+	for _, k := range []string{key.Key, rotated.Key} {
+		if status, _ := withKey("GET", "/read", k); status != http.StatusUnauthorized {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 401 for a revoked key", status))
+		}
+	}
+
+	//keys keep working for their owner after the owner's email changes
+	status, adminKey := create("/v1/me/keys", `{"name":"admin job", "scopes":["streams:read"]}`, admin)
+	if status != http.StatusCreated {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 201 for an admin key", status))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "PATCH", "/v1/me/", strings.NewReader(`{"email":"boss@example.com"}`), admin)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 changing the email", resp.StatusCode))
+	}
+	msg, ok := outbox.Last("boss@example.com")
+	if !ok {
+		t.Fatal("no email was sent to the new address")
+	}
+	verify := regexp.MustCompile(`[A-Za-z0-9_-]{20,}\.[A-Za-z0-9_-]{20,}`).FindString(msg.Body)
+	if resp, _ := test_utilities.TestRequest(t, ts, "POST", "/verify-email", strings.NewReader(`{"token":"`+verify+`"}`), ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 verifying the new email", resp.StatusCode))
+	}
+	if status, body := withKey("GET", "/read", adminKey.Key); status != http.StatusOK || body != "boss@example.com" {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s for a key after its owner's email changed", status, body))
+	}
+	resp, body = test_utilities.TestRequest(t, ts, "GET", "/v1/me/keys", nil, login("boss@example.com"))
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, adminKey.ID) {
+		t.Fatalf(fmt.Sprintf("%d was returned with %s listing keys after the email changed", resp.StatusCode, body))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	for k, v := range map[string]string{"RATE_LIMIT_AUTH": "3/1h", "RATE_LIMIT_IP": "20/1h", "RATE_LIMIT_API": "4/1h", "RATE_LIMIT_API_PRO": "6/1h"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+	users := api.NewMemoryUserStore(
+		api.User{Email: "legacy@example.com", FirstName: "Legacy", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4"},
+		api.User{Email: "pro@example.com", FirstName: "Pro", LastName: "User", Password: "4ff1a33e188b7b86123d6e3be2722a23514a83b4", Role: api.RoleAdmin, Plan: "pro"})
+	tools := test_utilities.TestSetup()
+	usersController := api.NewUsersController(users, tools)
+
+	chiRouter := chi.NewRouter()
+	chiRouter.With(api.RateLimit(tools, "auth", api.Limit{Requests: 20, Window: time.Minute})).Post("/login", usersController.Login)
+	chiRouter.Group(func(guarded chi.Router) {
+		guarded.Use(api.RateLimit(tools, "ip", api.Limit{Requests: 600, Window: time.Minute}))
+		guarded.Use(VerifyJWT(tools))
+		guarded.Use(api.RateLimit(tools, "api", api.Limit{Requests: 300, Window: time.Minute}))
+		guarded.Get("/v1/me", usersController.GetMe)
+		guarded.With(api.RequirePermission(api.PermUsersManage)).Put("/v1/users/{email}/plan", usersController.UpdatePlan)
+	})
+	ts := httptest.NewServer(chiRouter)
+	defer ts.Close()
+
+	login := func(email string) string {
+		resp, body := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"`+email+`", "password":"test12"}`), "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(fmt.Sprintf("%d was returned instead of 200 logging in as %s", resp.StatusCode, email))
+		}
+		var tokens struct {
+			AccessToken string `json:"accessToken"`
+		}
+		json.Unmarshal([]byte(body), &tokens)
+		return tokens.AccessToken
+	}
+	free, pro := login("legacy@example.com"), login("pro@example.com")
+
+	//public routes are limited by IP
+	resp, _ := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"legacy@example.com", "password":"wrong"}`), "")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("RateLimit-Remaining") != "0" || resp.Header.Get("RateLimit-Limit") != "3" {
+		t.Fatalf(fmt.Sprintf("%d was returned with RateLimit-Remaining %q and RateLimit-Limit %q for the last login allowed",
+			resp.StatusCode, resp.Header.Get("RateLimit-Remaining"), resp.Header.Get("RateLimit-Limit")))
+	}
+	resp, body := test_utilities.TestRequest(t, ts, "POST", "/login", strings.NewReader(`{"email":"legacy@example.com", "password":"test12"}`), "")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" || !strings.Contains(body, "too many requests") {
+		t.Fatalf(fmt.Sprintf("%d was returned with Retry-After %q and %s instead of 429 over the limit", resp.StatusCode, resp.Header.Get("Retry-After"), body))
+	}
+
+	//signed in users are limited by the limit of their plan, each on their own
+	for i := 3; i >= 0; i-- {
+		resp, _ = test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, free)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Remaining") != fmt.Sprint(i) {
+			t.Fatalf(fmt.Sprintf("%d was returned with RateLimit-Remaining %q instead of 200 with %d", resp.StatusCode, resp.Header.Get("RateLimit-Remaining"), i))
+		}
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, free)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 429 over the free plan's limit", resp.StatusCode))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, pro)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("RateLimit-Limit") != "6" {
+		t.Fatalf(fmt.Sprintf("%d was returned with RateLimit-Limit %q instead of the pro plan's", resp.StatusCode, resp.Header.Get("RateLimit-Limit")))
+	}
+
+	//admins change plans
+	resp, _ = test_utilities.TestRequest(t, ts, "PUT", "/v1/users/legacy@example.com/plan", strings.NewReader(`{"plan":"Not A Plan"}`), pro)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 400 for an invalid plan", resp.StatusCode))
+	}
+	resp, _ = test_utilities.TestRequest(t, ts, "PUT", "/v1/users/legacy@example.com/plan", strings.NewReader(`{"plan":"pro"}`), pro)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 200 changing a plan", resp.StatusCode))
+	}
+	if user, _ := users.FindByEmail(context.Background(), "legacy@example.com"); user.Plan != "pro" {
+		t.Fatalf(fmt.Sprintf("the plan is %q instead of pro", user.Plan))
+	}
+
+	//made up credentials count against the IP before they are checked
+	for i := 0; i < 20; i++ {
+		if resp, _ = test_utilities.TestRequest(t, ts, "GET", "/v1/me", nil, "made-up"); resp.StatusCode != http.StatusUnauthorized {
+			break
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf(fmt.Sprintf("%d was returned instead of 429 for made up credentials over the IP's limit", resp.StatusCode))
+	}
+}